@@ -0,0 +1,56 @@
+package bookmark
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// placeholders are replaced in Browser.Args by the bookmark being opened.
+var placeholders = []string{"{url}", "{name}", "{host}", "{tags}"}
+
+// HasPlaceholders reports whether the arguments of b refer to the bookmark
+// with {url}, {name}, {host} or {tags}.
+func (b Browser) HasPlaceholders() bool {
+	return slices.ContainsFunc(b.Args, func(arg string) bool {
+		return slices.ContainsFunc(placeholders, func(p string) bool { return strings.Contains(arg, p) })
+	})
+}
+
+// Commands returns the arguments of each launch of b that opens bookmarks.
+// Without placeholders all URLs are appended to a single launch. Otherwise
+// every bookmark is opened by its own launch with the placeholders replaced,
+// and its URL is appended unless an argument places it with {url}.
+func (b Browser) Commands(bookmarks []Bookmark) [][]string {
+	if !b.HasPlaceholders() {
+		args := slices.Clone(b.Args)
+		for _, bm := range bookmarks {
+			args = append(args, bm.URL)
+		}
+		return [][]string{args}
+	}
+
+	placesURL := slices.ContainsFunc(b.Args, func(arg string) bool { return strings.Contains(arg, "{url}") })
+	commands := make([][]string, 0, len(bookmarks))
+	for _, bm := range bookmarks {
+		var host string
+		if u, err := url.Parse(bm.URL); err == nil {
+			host = u.Hostname()
+		}
+		r := strings.NewReplacer(
+			"{url}", bm.URL,
+			"{name}", bm.Name,
+			"{host}", host,
+			"{tags}", strings.Join(bm.Tags, ","),
+		)
+		args := make([]string, len(b.Args), len(b.Args)+1)
+		for i, arg := range b.Args {
+			args[i] = r.Replace(arg)
+		}
+		if !placesURL {
+			args = append(args, bm.URL)
+		}
+		commands = append(commands, args)
+	}
+	return commands
+}
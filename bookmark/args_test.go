@@ -0,0 +1,64 @@
+package bookmark
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBrowserCommands(t *testing.T) {
+	wiki := Bookmark{Name: "Wiki", URL: "https://wiki.corp.example.com:8443/page", Tags: []string{"docs", "work/infra"}}
+	mail := Bookmark{Name: "Mail", URL: "https://mail.example.com"}
+
+	tests := []struct {
+		name string
+		args []string
+		want [][]string
+	}{
+		{"no args", nil, [][]string{{wiki.URL, mail.URL}}},
+		{"append", []string{"-P", "work"}, [][]string{{"-P", "work", wiki.URL, mail.URL}}},
+		{"app", []string{"--app={url}"}, [][]string{{"--app=" + wiki.URL}, {"--app=" + mail.URL}}},
+		{"middle", []string{"--new-window", "{url}", "--incognito"}, [][]string{
+			{"--new-window", wiki.URL, "--incognito"},
+			{"--new-window", mail.URL, "--incognito"},
+		}},
+		{"name only", []string{"--class={name}"}, [][]string{
+			{"--class=Wiki", wiki.URL},
+			{"--class=Mail", mail.URL},
+		}},
+		{"host only", []string{"-P", "{host}"}, [][]string{
+			{"-P", "wiki.corp.example.com", wiki.URL},
+			{"-P", "mail.example.com", mail.URL},
+		}},
+		{"tags only", []string{"--tags={tags}"}, [][]string{
+			{"--tags=docs,work/infra", wiki.URL},
+			{"--tags=", mail.URL},
+		}},
+		{"all placeholders", []string{"--class={name}", "--host={host}", "--tags={tags}", "{url}"}, [][]string{
+			{"--class=Wiki", "--host=wiki.corp.example.com", "--tags=docs,work/infra", wiki.URL},
+			{"--class=Mail", "--host=mail.example.com", "--tags=", mail.URL},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Browser{Args: tt.args}.Commands([]Bookmark{wiki, mail})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Commands() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrowserCommandsKeepArgs(t *testing.T) {
+	// Spare capacity must not let launches share or overwrite Args.
+	args := make([]string, 1, 4)
+	args[0] = "-P"
+	b := Browser{Args: args}
+	first := b.Commands([]Bookmark{{URL: "https://a.com"}})[0]
+	second := b.Commands([]Bookmark{{URL: "https://b.com"}})[0]
+	if first[1] != "https://a.com" || second[1] != "https://b.com" {
+		t.Errorf("got %q and %q", first, second)
+	}
+	if len(b.Args) != 1 || args[:2][1] != "" {
+		t.Errorf("Args changed: %q", args[:2])
+	}
+}
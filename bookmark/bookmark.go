@@ -0,0 +1,279 @@
+// Package bookmark defines the bookmarks, browser profiles and collections
+// managed by bm and the Repository interface that stores them. The
+// implementations live in the packages under store.
+package bookmark
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Repository stores bookmarks, browser profiles, collections, routing rules
+// and tag defaults. Names identify bookmarks, profiles and collections.
+// Errors wrap ErrNotFound, ErrBrowserNotFound, ErrDuplicateName and the
+// other sentinels of this package, so they can be told apart with errors.Is.
+// Implementations are safe for concurrent use.
+type Repository interface {
+	// Add adds a bookmark. Its browser profile must exist.
+	Add(ctx context.Context, bm Bookmark) error
+	// Del moves a bookmark into the trash.
+	Del(ctx context.Context, name string) error
+	// Update applies the patch to a bookmark outside the trash.
+	Update(ctx context.Context, name string, p BookmarkPatch) error
+	// UpdateWhere applies the patch to all bookmarks outside the trash
+	// matching the filter and returns them as they were before. With dryRun
+	// nothing is changed.
+	UpdateWhere(ctx context.Context, f Filter, p BookmarkPatch, dryRun bool) ([]Bookmark, error)
+	// Ls lists the bookmarks outside the trash, sorted by name.
+	Ls(ctx context.Context, includeArchived bool) ([]Bookmark, error)
+	// LsByTag lists the bookmarks with a tag or one of its descendants.
+	LsByTag(ctx context.Context, tag string, includeArchived bool) ([]Bookmark, error)
+	// RenameTag renames a tag together with its descendants.
+	RenameTag(ctx context.Context, from, to string) error
+	// Get returns a bookmark outside the trash.
+	Get(ctx context.Context, name string) (Bookmark, error)
+	// Trash lists the bookmarks in the trash.
+	Trash(ctx context.Context) ([]Bookmark, error)
+	// Restore moves a bookmark out of the trash.
+	Restore(ctx context.Context, name string) error
+	// Purge deletes the bookmarks moved into the trash before the given time
+	// and returns their number.
+	Purge(ctx context.Context, before time.Time) (int64, error)
+
+	// AddBrowser adds a browser profile.
+	AddBrowser(ctx context.Context, b Browser) error
+	// DelBrowser deletes a browser profile. Bookmarks using it are kept
+	// without a profile; its routing rules and tag defaults are deleted.
+	DelBrowser(ctx context.Context, name string) error
+	// LsBrowsers lists the browser profiles, sorted by name.
+	LsBrowsers(ctx context.Context) ([]Browser, error)
+	// GetBrowser returns a browser profile.
+	GetBrowser(ctx context.Context, name string) (Browser, error)
+	// UpdateBrowser applies the patch to a browser profile.
+	UpdateBrowser(ctx context.Context, name string, p BrowserPatch) error
+	// SetDefaultBrowser makes a browser profile the default. An empty name
+	// clears the default.
+	SetDefaultBrowser(ctx context.Context, name string) error
+	// SetTagBrowser sets the default browser profile of a tag and its
+	// descendants. An empty browser clears it.
+	SetTagBrowser(ctx context.Context, tag, browser string) error
+	// LsTagBrowsers returns the default browser profile of each tag that
+	// has one.
+	LsTagBrowsers(ctx context.Context) (map[string]string, error)
+
+	// AddCollection creates an empty collection.
+	AddCollection(ctx context.Context, name string) error
+	// DelCollection deletes a collection, keeping its bookmarks.
+	DelCollection(ctx context.Context, name string) error
+	// LsCollections lists the collections with their members.
+	LsCollections(ctx context.Context) ([]Collection, error)
+	// GetCollection returns a collection with its members in order.
+	GetCollection(ctx context.Context, name string) (Collection, error)
+	// AddToCollection inserts a bookmark at a 1-based position; see
+	// Collection.Insert.
+	AddToCollection(ctx context.Context, collection, bookmark string, position int) error
+	// RemoveFromCollection removes a bookmark from a collection.
+	RemoveFromCollection(ctx context.Context, collection, bookmark string) error
+	// MoveInCollection moves a member to a 1-based position; see
+	// Collection.Move.
+	MoveInCollection(ctx context.Context, collection, bookmark string, position int) error
+
+	// AddRule inserts a routing rule at a 1-based position, 0 appends it,
+	// and returns its ID.
+	AddRule(ctx context.Context, rule Rule, position int) (int64, error)
+	// DelRule deletes a routing rule.
+	DelRule(ctx context.Context, id int64) error
+	// LsRules lists the routing rules in evaluation order.
+	LsRules(ctx context.Context) ([]Rule, error)
+
+	// Changes returns the latest changes, newest first, optionally of a
+	// single bookmark, browser profile or collection. Repositories without a
+	// change log return ErrNoChangeLog.
+	Changes(ctx context.Context, name string, limit int) ([]Change, error)
+	// Undo reverts the given number of most recent batches of changes and
+	// returns the reverted changes.
+	Undo(ctx context.Context, steps int) ([]Change, error)
+
+	// Export returns a lossless copy of all data.
+	Export(ctx context.Context) (Dump, error)
+	// Import writes a dump in a single step, so a failing import changes
+	// nothing.
+	Import(ctx context.Context, d Dump, mode ImportMode) (ImportResult, error)
+}
+
+// Bookmark is a named URL with tags and an optional browser profile.
+type Bookmark struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Tags        []string `json:"tags,omitempty"`
+	Archived    bool     `json:"archived,omitempty"`
+	BrowserName string   `json:"browser,omitempty"`
+	// DeletedAt is set while the bookmark is in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Browser is a browser profile: the binary and arguments bookmarks are
+// opened with. At most one profile is the default.
+type Browser struct {
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	// Env holds KEY=VALUE pairs added to the environment of the browser.
+	// $VAR and ${VAR} in values are expanded when it is launched.
+	Env []string `json:"env,omitempty"`
+	// Dir is the working directory of the browser; empty inherits it. $VAR
+	// is expanded as well.
+	Dir     string `json:"dir,omitempty"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// Validate checks that every Env entry has the form KEY=VALUE.
+func (b Browser) Validate() error {
+	if err := validateEnv(b.Env); err != nil {
+		return fmt.Errorf("browser profile %q: %w", b.Name, err)
+	}
+	return nil
+}
+
+func validateEnv(env []string) error {
+	for _, kv := range env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t\n$") {
+			return fmt.Errorf("invalid environment variable %q, want KEY=VALUE", kv)
+		}
+	}
+	return nil
+}
+
+// Filter selects bookmarks for bulk updates. All set fields must match.
+type Filter struct {
+	// Tag matches bookmarks with this tag or one of its descendants.
+	Tag         string
+	BrowserName string
+	// URLGlob matches the host of the URL (*.oldcorp.com) or the whole URL.
+	URLGlob string
+}
+
+// BookmarkPatch describes a change to bookmarks. Nil fields are left
+// unchanged, so every field can be set to any value including its zero
+// value: an empty BrowserName clears the association and an empty Tags
+// removes all tags. Tags are edited in order: Tags replaces all tags, then
+// RemoveTags and AddTags are applied.
+type BookmarkPatch struct {
+	URL         *string
+	Archived    *bool
+	BrowserName *string
+	Tags        *[]string
+	AddTags     []string
+	RemoveTags  []string
+}
+
+// IsEmpty reports whether the patch changes nothing.
+func (p BookmarkPatch) IsEmpty() bool {
+	return p.URL == nil && p.Archived == nil && p.BrowserName == nil && p.Tags == nil &&
+		len(p.AddTags) == 0 && len(p.RemoveTags) == 0
+}
+
+// Validate checks that the patch changes something and leaves a usable
+// bookmark behind.
+func (p BookmarkPatch) Validate() error {
+	if p.IsEmpty() {
+		return fmt.Errorf("no fields to update")
+	}
+	if p.URL != nil && *p.URL == "" {
+		return fmt.Errorf("url must not be empty")
+	}
+	return nil
+}
+
+// BrowserPatch describes a change to a browser profile. Nil fields are left
+// unchanged; an empty Args, Env or Dir clears it.
+type BrowserPatch struct {
+	Path *string
+	Args *[]string
+	Env  *[]string
+	Dir  *string
+}
+
+// IsEmpty reports whether the patch changes nothing.
+func (p BrowserPatch) IsEmpty() bool {
+	return p.Path == nil && p.Args == nil && p.Env == nil && p.Dir == nil
+}
+
+// Apply returns b with the patch applied.
+func (p BrowserPatch) Apply(b Browser) Browser {
+	if p.Path != nil {
+		b.Path = *p.Path
+	}
+	if p.Args != nil {
+		b.Args = slices.Clone(*p.Args)
+	}
+	if p.Env != nil {
+		b.Env = slices.Clone(*p.Env)
+	}
+	if p.Dir != nil {
+		b.Dir = *p.Dir
+	}
+	return b
+}
+
+// Validate checks that the patch changes something and leaves a usable
+// browser profile behind.
+func (p BrowserPatch) Validate() error {
+	if p.IsEmpty() {
+		return fmt.Errorf("no fields to update")
+	}
+	if p.Path != nil && *p.Path == "" {
+		return fmt.Errorf("path must not be empty")
+	}
+	if p.Env != nil {
+		return validateEnv(*p.Env)
+	}
+	return nil
+}
+
+// Collection is an ordered list of bookmark names.
+type Collection struct {
+	Name      string   `json:"name"`
+	Bookmarks []string `json:"bookmarks,omitempty"`
+}
+
+// Insert adds a bookmark at the given 1-based position. Position 0 or a
+// position past the end appends it.
+func (c *Collection) Insert(bookmark string, position int) error {
+	if slices.Contains(c.Bookmarks, bookmark) {
+		return fmt.Errorf("bookmark %q is already in collection %q", bookmark, c.Name)
+	}
+	c.Bookmarks = insertAt(c.Bookmarks, bookmark, position)
+	return nil
+}
+
+// Remove removes a bookmark.
+func (c *Collection) Remove(bookmark string) error {
+	i := slices.Index(c.Bookmarks, bookmark)
+	if i < 0 {
+		return fmt.Errorf("bookmark %q is not in collection %q", bookmark, c.Name)
+	}
+	c.Bookmarks = slices.Delete(c.Bookmarks, i, i+1)
+	return nil
+}
+
+// Move moves a bookmark to the given 1-based position. Position 0 or a
+// position past the end moves it to the end.
+func (c *Collection) Move(bookmark string, position int) error {
+	if err := c.Remove(bookmark); err != nil {
+		return err
+	}
+	c.Bookmarks = insertAt(c.Bookmarks, bookmark, position)
+	return nil
+}
+
+func insertAt(members []string, bookmark string, position int) []string {
+	if position <= 0 || position > len(members) {
+		return append(members, bookmark)
+	}
+	return slices.Insert(members, position-1, bookmark)
+}
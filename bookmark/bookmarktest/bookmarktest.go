@@ -0,0 +1,1644 @@
+// Package bookmarktest checks that a bookmark.Repository implementation
+// behaves like the others. Implementations run it from their tests:
+//
+//	func TestRepository(t *testing.T) {
+//		bookmarktest.Run(t, bookmarktest.Backend{Open: ...})
+//	}
+package bookmarktest
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// Backend is a Repository implementation under test.
+type Backend struct {
+	// Open returns a new, empty repository.
+	Open func(t *testing.T) bookmark.Repository
+	// BackdateTrash moves the deletion time of a bookmark in the trash back
+	// by d. Tests that need it are skipped when it is nil.
+	BackdateTrash func(t *testing.T, repo bookmark.Repository, name string, d time.Duration)
+	// NoChangeLog declares that the backend keeps no change log. Changes
+	// and Undo must then fail with ErrNoChangeLog, and the tests of undo
+	// are skipped.
+	NoChangeLog bool
+}
+
+// Run runs the whole suite, each test on a repository of its own.
+func Run(t *testing.T, b Backend) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo bookmark.Repository)
+	}{
+		{"Add", testAdd},
+		{"Del", testDel},
+		{"Trash", b.testTrash},
+		{"Ls", testLs},
+		{"Update", testUpdate},
+		{"UpdatePatch", testUpdatePatch},
+		{"UpdateWhere", b.testUpdateWhere},
+		{"ArchivedFiltering", testArchivedFiltering},
+		{"Browser", testBrowser},
+		{"HierarchicalTags", testHierarchicalTags},
+		{"RenameTagReferences", testRenameTagReferences},
+		{"Collections", testCollections},
+		{"Rules", testRules},
+		{"BrowserDefaults", testBrowserDefaults},
+		{"Constraints", testConstraints},
+		{"ContextCancellation", testContextCancellation},
+		{"ChangeLog", b.testChangeLog},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.run(t, b.Open(t)) })
+	}
+	t.Run("ExportImport", b.testExportImport)
+}
+
+// skipWithoutChangeLog skips tests of undo for backends that keep no change
+// log.
+func (b Backend) skipWithoutChangeLog(t *testing.T) {
+	t.Helper()
+	if b.NoChangeLog {
+		t.Skip("the backend keeps no change log")
+	}
+}
+
+// testChangeLog checks that a backend declared without a change log says so
+// rather than returning an empty one, and that the others record changes.
+func (b Backend) testChangeLog(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Google", URL: "https://google.com"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	changes, err := repo.Changes(ctx, "", 0)
+	if b.NoChangeLog {
+		if !errors.Is(err, bookmark.ErrNoChangeLog) {
+			t.Errorf("Changes() error = %v, want ErrNoChangeLog", err)
+		}
+		if _, err := repo.Undo(ctx, 1); !errors.Is(err, bookmark.ErrNoChangeLog) {
+			t.Errorf("Undo() error = %v, want ErrNoChangeLog", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Changes() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Op != "add" || changes[0].Name != "Google" {
+		t.Errorf("Changes() = %+v, want the addition of Google", changes)
+	}
+	if _, err := repo.Undo(ctx, 1); err != nil {
+		t.Fatalf("Undo() error = %v", err)
+	}
+	if _, err := repo.Get(ctx, "Google"); !errors.Is(err, bookmark.ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound after undoing the addition", err)
+	}
+}
+
+func (b Backend) backdateTrash(t *testing.T, repo bookmark.Repository, name string, d time.Duration) {
+	t.Helper()
+	if b.BackdateTrash == nil {
+		t.Skip("the backend cannot backdate deletions")
+	}
+	b.BackdateTrash(t, repo, name, d)
+}
+
+func testAdd(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		bm      bookmark.Bookmark
+		wantErr error
+	}{
+		{
+			name: "valid bookmark",
+			bm: bookmark.Bookmark{
+				Name: "Google",
+				URL:  "https://google.com",
+				Tags: []string{"Search", "web"},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "duplicate name",
+			bm: bookmark.Bookmark{
+				Name: "Google",
+				URL:  "https://different.com",
+			},
+			wantErr: bookmark.ErrDuplicateName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.Add(ctx, tt.bm)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Add() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func testDel(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	// Add a test bookmark
+	bm := bookmark.Bookmark{Name: "Test", URL: "https://test.com"}
+	if err := repo.Add(ctx, bm); err != nil {
+		t.Fatalf("failed to add test bookmark: %v", err)
+	}
+
+	// Add a tag for the test bookmark
+	if err := repo.Update(ctx, "Test", bookmark.BookmarkPatch{AddTags: []string{"testtag"}}); err != nil {
+		t.Fatalf("failed to add tag: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		bookmark  string
+		wantError bool
+	}{
+		{
+			name:      "existing bookmark",
+			bookmark:  "Test",
+			wantError: false,
+		},
+		{
+			name:      "already deleted bookmark",
+			bookmark:  "Test",
+			wantError: true,
+		},
+		{
+			name:      "non-existing bookmark",
+			bookmark:  "NonExistent",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.Del(ctx, tt.bookmark)
+			if (err != nil) != tt.wantError {
+				t.Errorf("Del() error = %v, wantError %v", err, tt.wantError)
+			}
+
+			if !tt.wantError {
+				// Verify bookmark was moved into the trash
+				if _, err := repo.Get(ctx, tt.bookmark); err == nil {
+					t.Errorf("deleted bookmark is still returned by Get()")
+				}
+				trash, err := repo.Trash(ctx)
+				if err != nil {
+					t.Fatalf("Trash() error = %v", err)
+				}
+				if len(trash) != 1 || trash[0].Name != tt.bookmark {
+					t.Fatalf("bookmark was not moved into the trash")
+				}
+
+				// Verify tag was kept for restoring
+				if !slices.Equal(trash[0].Tags, []string{"testtag"}) {
+					t.Errorf("tag entry was not kept, got %v", trash[0].Tags)
+				}
+			}
+		})
+	}
+}
+
+func (b Backend) testTrash(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	for _, bm := range []bookmark.Bookmark{
+		{Name: "Old", URL: "https://old.com", Tags: []string{"work"}, BrowserName: "work"},
+		{Name: "New", URL: "https://new.com"},
+	} {
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("failed to add test bookmark: %v", err)
+		}
+		if err := repo.Del(ctx, bm.Name); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+	}
+	// Backdate the first deletion to test retention.
+	b.backdateTrash(t, repo, "Old", time.Hour)
+
+	t.Run("deleted bookmarks are hidden", func(t *testing.T) {
+		got, err := repo.Ls(ctx, true)
+		if err != nil {
+			t.Fatalf("Ls() error = %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("got %d bookmarks, want 0", len(got))
+		}
+		if err := repo.Update(ctx, "Old", bookmark.BookmarkPatch{URL: ptr("https://changed.com")}); err == nil {
+			t.Error("expected error updating a deleted bookmark")
+		}
+	})
+
+	t.Run("list trash", func(t *testing.T) {
+		got, err := repo.Trash(ctx)
+		if err != nil {
+			t.Fatalf("Trash() error = %v", err)
+		}
+		if len(got) != 2 || got[0].Name != "New" || got[1].Name != "Old" {
+			t.Fatalf("got %+v, want New and Old", got)
+		}
+		if got[0].DeletedAt == nil || got[1].DeletedAt == nil || !got[1].DeletedAt.Before(*got[0].DeletedAt) {
+			t.Errorf("got deletion times %v and %v", got[0].DeletedAt, got[1].DeletedAt)
+		}
+	})
+
+	t.Run("name stays reserved while in trash", func(t *testing.T) {
+		err := repo.Add(ctx, bookmark.Bookmark{Name: "Old", URL: "https://other.com"})
+		if !errors.Is(err, bookmark.ErrNameInTrash) || !errors.Is(err, bookmark.ErrDuplicateName) {
+			t.Errorf("Add() error = %v, want ErrNameInTrash", err)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		if err := repo.Restore(ctx, "Old"); err != nil {
+			t.Fatalf("Restore() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Old")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.BrowserName != "work" || !slices.Equal(got.Tags, []string{"work"}) {
+			t.Errorf("got %+v, want tags and browser restored", got)
+		}
+		if err := repo.Restore(ctx, "Old"); err == nil {
+			t.Error("expected error restoring a bookmark that is not in the trash")
+		}
+		if err := repo.Del(ctx, "Old"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		b.backdateTrash(t, repo, "Old", time.Hour)
+	})
+
+	t.Run("purge older entries", func(t *testing.T) {
+		n, err := repo.Purge(ctx, time.Now().Add(-30*time.Minute))
+		if err != nil {
+			t.Fatalf("Purge() error = %v", err)
+		}
+		if n != 1 {
+			t.Errorf("purged %d bookmarks, want 1", n)
+		}
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: "Old", URL: "https://other.com"}); err != nil {
+			t.Errorf("Add() error = %v, want name to be free after purge", err)
+		}
+		if got, err := repo.Get(ctx, "Old"); err != nil || len(got.Tags) != 0 {
+			t.Errorf("Get() = %+v, %v, want the tags purged with the old bookmark", got, err)
+		}
+	})
+
+	t.Run("purge everything", func(t *testing.T) {
+		n, err := repo.Purge(ctx, time.Now())
+		if err != nil {
+			t.Fatalf("Purge() error = %v", err)
+		}
+		if n != 1 {
+			t.Errorf("purged %d bookmarks, want 1", n)
+		}
+	})
+}
+
+func testLs(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	bookmarks := []bookmark.Bookmark{
+		{Name: "Google", URL: "https://google.com", Tags: []string{"search"}},
+		{Name: "GitHub", URL: "https://github.com", Tags: []string{"dev", "git"}},
+		{Name: "Archive", URL: "https://archive.org"},
+	}
+
+	for _, bm := range bookmarks {
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("failed to add test bookmark: %v", err)
+		}
+	}
+
+	result, err := repo.Ls(ctx, true)
+	if err != nil {
+		t.Fatalf("Ls() error = %v", err)
+	}
+
+	if len(result) != len(bookmarks) {
+		t.Errorf("got %d bookmarks, want %d", len(result), len(bookmarks))
+	}
+	var names []string
+	for _, got := range result {
+		names = append(names, got.Name)
+	}
+	if want := []string{"Archive", "GitHub", "Google"}; !slices.Equal(names, want) {
+		t.Errorf("got bookmarks %q, want them sorted by name as %q", names, want)
+	}
+
+	for _, want := range bookmarks {
+		found := false
+		for _, got := range result {
+			if got.Name == want.Name {
+				found = true
+				if got.URL != want.URL {
+					t.Errorf("got URL %q, want %q", got.URL, want.URL)
+				}
+				if !slices.Equal(got.Tags, want.Tags) {
+					t.Errorf("got tags %v, want %v", got.Tags, want.Tags)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("bookmark %q not found", want.Name)
+		}
+	}
+}
+
+func testUpdate(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	initial := bookmark.Bookmark{
+		Name: "Google",
+		URL:  "https://google.com",
+		Tags: []string{"search"},
+	}
+	if err := repo.Add(ctx, initial); err != nil {
+		t.Fatalf("failed to add initial bookmark: %v", err)
+	}
+
+	updated := bookmark.Bookmark{
+		Name: "Google",
+		URL:  "https://google.co.uk",
+		Tags: []string{"search", "uk"},
+	}
+	if err := repo.Update(ctx, updated.Name, bookmark.BookmarkPatch{URL: &updated.URL, Tags: &updated.Tags}); err != nil {
+		t.Errorf("Update() error = %v", err)
+	}
+
+	result, err := repo.Ls(ctx, true)
+	if err != nil {
+		t.Fatalf("Ls() error = %v", err)
+	}
+
+	found := false
+	for _, bm := range result {
+		if bm.Name == updated.Name {
+			found = true
+			if bm.URL != updated.URL {
+				t.Errorf("got URL %q, want %q", bm.URL, updated.URL)
+			}
+			if !slices.Equal(bm.Tags, updated.Tags) {
+				t.Errorf("got tags %v, want %v", bm.Tags, updated.Tags)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("bookmark %q not found", updated.Name)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func testUpdatePatch(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Wiki", URL: "https://wiki.com", Tags: []string{"docs", "work/infra"}}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// The cases run in order against the same bookmark; want is its state
+	// after each patch.
+	tests := []struct {
+		name    string
+		bm      string
+		patch   bookmark.BookmarkPatch
+		want    bookmark.Bookmark
+		wantErr bool
+	}{
+		{
+			name:  "url only keeps everything else",
+			patch: bookmark.BookmarkPatch{URL: ptr("https://wiki.org")},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"docs", "work/infra"}},
+		},
+		{
+			name:  "archive and set browser",
+			patch: bookmark.BookmarkPatch{Archived: ptr(true), BrowserName: ptr("work")},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"docs", "work/infra"}, Archived: true, BrowserName: "work"},
+		},
+		{
+			name:  "unarchive and clear browser",
+			patch: bookmark.BookmarkPatch{Archived: ptr(false), BrowserName: ptr("")},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"docs", "work/infra"}},
+		},
+		{
+			name:  "tags only",
+			patch: bookmark.BookmarkPatch{Tags: &[]string{"Search", "docs"}},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"docs", "search"}},
+		},
+		{
+			name:  "add keeps existing tags",
+			patch: bookmark.BookmarkPatch{AddTags: []string{"Wiki", "docs", "work/infra"}},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"docs", "search", "wiki", "work/infra"}},
+		},
+		{
+			name:  "remove leaves descendants",
+			patch: bookmark.BookmarkPatch{RemoveTags: []string{"docs", "work"}},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"search", "wiki", "work/infra"}},
+		},
+		{
+			name:  "replace then edit",
+			patch: bookmark.BookmarkPatch{Tags: &[]string{"a", "b"}, RemoveTags: []string{"b"}, AddTags: []string{"c"}},
+			want:  bookmark.Bookmark{URL: "https://wiki.org", Tags: []string{"a", "c"}},
+		},
+		{
+			name:  "clear all tags",
+			patch: bookmark.BookmarkPatch{Tags: &[]string{}},
+			want:  bookmark.Bookmark{URL: "https://wiki.org"},
+		},
+		{
+			name:    "empty patch",
+			patch:   bookmark.BookmarkPatch{},
+			want:    bookmark.Bookmark{URL: "https://wiki.org"},
+			wantErr: true,
+		},
+		{
+			name:    "empty url",
+			patch:   bookmark.BookmarkPatch{URL: ptr(""), AddTags: []string{"x"}},
+			want:    bookmark.Bookmark{URL: "https://wiki.org"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown browser changes nothing",
+			patch:   bookmark.BookmarkPatch{URL: ptr("https://wiki.net"), BrowserName: ptr("nope")},
+			want:    bookmark.Bookmark{URL: "https://wiki.org"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown bookmark",
+			bm:      "Missing",
+			patch:   bookmark.BookmarkPatch{Archived: ptr(true)},
+			want:    bookmark.Bookmark{URL: "https://wiki.org"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "Wiki"
+			if tt.bm != "" {
+				name = tt.bm
+			}
+			err := repo.Update(ctx, name, tt.patch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := repo.Get(ctx, "Wiki")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			slices.Sort(got.Tags)
+			if got.URL != tt.want.URL || got.Archived != tt.want.Archived || got.BrowserName != tt.want.BrowserName {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !slices.Equal(got.Tags, tt.want.Tags) {
+				t.Errorf("got tags %v, want %v", got.Tags, tt.want.Tags)
+			}
+		})
+	}
+}
+
+func (b Backend) testUpdateWhere(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	for _, browser := range []bookmark.Browser{
+		{Name: "old", Path: "/usr/bin/firefox"},
+		{Name: "new", Path: "/usr/bin/chromium"},
+	} {
+		if err := repo.AddBrowser(ctx, browser); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	}
+	for _, bm := range []bookmark.Bookmark{
+		{Name: "wiki", URL: "https://wiki.oldcorp.com", Tags: []string{"work/docs"}, BrowserName: "old"},
+		{Name: "jira", URL: "https://jira.oldcorp.com/browse", Tags: []string{"work"}},
+		{Name: "news", URL: "https://news.example.com", Tags: []string{"home"}, BrowserName: "old"},
+	} {
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	get := func(t *testing.T, name string) bookmark.Bookmark {
+		t.Helper()
+		bm, err := repo.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get(%q) error = %v", name, err)
+		}
+		slices.Sort(bm.Tags)
+		return bm
+	}
+	matchedNames := func(bookmarks []bookmark.Bookmark) []string {
+		var names []string
+		for _, bm := range bookmarks {
+			names = append(names, bm.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	t.Run("filter is required", func(t *testing.T) {
+		if _, err := repo.UpdateWhere(ctx, bookmark.Filter{}, bookmark.BookmarkPatch{AddTags: []string{"x"}}, false); err == nil {
+			t.Error("expected error for empty filter")
+		}
+		if _, err := repo.UpdateWhere(ctx, bookmark.Filter{URLGlob: "["}, bookmark.BookmarkPatch{}, true); err == nil {
+			t.Error("expected error for invalid glob")
+		}
+	})
+
+	t.Run("dry run changes nothing", func(t *testing.T) {
+		matched, err := repo.UpdateWhere(ctx, bookmark.Filter{URLGlob: "*.oldcorp.com"}, bookmark.BookmarkPatch{AddTags: []string{"moved"}}, true)
+		if err != nil {
+			t.Fatalf("UpdateWhere() error = %v", err)
+		}
+		if got := matchedNames(matched); !slices.Equal(got, []string{"jira", "wiki"}) {
+			t.Errorf("got matches %v, want [jira wiki]", got)
+		}
+		if got := get(t, "wiki").Tags; !slices.Equal(got, []string{"work/docs"}) {
+			t.Errorf("got tags %v after dry run, want [work/docs]", got)
+		}
+	})
+
+	t.Run("dry run rejects what the update would", func(t *testing.T) {
+		f := bookmark.Filter{URLGlob: "*.oldcorp.com"}
+		if _, err := repo.UpdateWhere(ctx, f, bookmark.BookmarkPatch{}, true); err == nil {
+			t.Error("expected error for empty patch")
+		}
+		if _, err := repo.UpdateWhere(ctx, f, bookmark.BookmarkPatch{URL: ptr("")}, true); err == nil {
+			t.Error("expected error for empty URL")
+		}
+		_, err := repo.UpdateWhere(ctx, f, bookmark.BookmarkPatch{BrowserName: ptr("nope")}, true)
+		if !errors.Is(err, bookmark.ErrUnknownBrowser) {
+			t.Errorf("UpdateWhere() error = %v, want ErrUnknownBrowser", err)
+		}
+	})
+
+	t.Run("retag by URL glob", func(t *testing.T) {
+		_, err := repo.UpdateWhere(ctx, bookmark.Filter{URLGlob: "*.oldcorp.com"},
+			bookmark.BookmarkPatch{AddTags: []string{"Legacy"}, RemoveTags: []string{"work"}}, false)
+		if err != nil {
+			t.Fatalf("UpdateWhere() error = %v", err)
+		}
+		if got := get(t, "jira").Tags; !slices.Equal(got, []string{"legacy"}) {
+			t.Errorf("got jira tags %v, want [legacy]", got)
+		}
+		// Removing a tag does not remove its descendants.
+		if got := get(t, "wiki").Tags; !slices.Equal(got, []string{"legacy", "work/docs"}) {
+			t.Errorf("got wiki tags %v, want [legacy work/docs]", got)
+		}
+	})
+
+	t.Run("move between browser profiles", func(t *testing.T) {
+		browser := "new"
+		matched, err := repo.UpdateWhere(ctx, bookmark.Filter{BrowserName: "old"}, bookmark.BookmarkPatch{BrowserName: &browser}, false)
+		if err != nil {
+			t.Fatalf("UpdateWhere() error = %v", err)
+		}
+		if got := matchedNames(matched); !slices.Equal(got, []string{"news", "wiki"}) {
+			t.Errorf("got matches %v, want [news wiki]", got)
+		}
+		for _, name := range []string{"news", "wiki"} {
+			if got := get(t, name).BrowserName; got != "new" {
+				t.Errorf("got browser %q for %s, want new", got, name)
+			}
+		}
+	})
+
+	t.Run("unknown browser rolls back", func(t *testing.T) {
+		browser := "nope"
+		archived := true
+		_, err := repo.UpdateWhere(ctx, bookmark.Filter{Tag: "work"}, bookmark.BookmarkPatch{BrowserName: &browser, Archived: &archived}, false)
+		if err == nil {
+			t.Fatal("expected error for nonexistent browser")
+		}
+		if get(t, "wiki").Archived {
+			t.Error("expected wiki to stay unarchived")
+		}
+	})
+
+	t.Run("archive by tag", func(t *testing.T) {
+		archived := true
+		matched, err := repo.UpdateWhere(ctx, bookmark.Filter{Tag: "work", BrowserName: "new"}, bookmark.BookmarkPatch{Archived: &archived}, false)
+		if err != nil {
+			t.Fatalf("UpdateWhere() error = %v", err)
+		}
+		if got := matchedNames(matched); !slices.Equal(got, []string{"wiki"}) {
+			t.Errorf("got matches %v, want [wiki]", got)
+		}
+		if !get(t, "wiki").Archived || get(t, "jira").Archived {
+			t.Error("expected only wiki to be archived")
+		}
+	})
+
+	t.Run("one undo step per bulk update", func(t *testing.T) {
+		b.skipWithoutChangeLog(t)
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if get(t, "wiki").Archived {
+			t.Error("expected wiki to be unarchived after undo")
+		}
+		undone, err := repo.Undo(ctx, 1)
+		if err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if len(undone) != 2 {
+			t.Errorf("got %d undone changes, want 2", len(undone))
+		}
+		if got := get(t, "news").BrowserName; got != "old" {
+			t.Errorf("got browser %q for news after undo, want old", got)
+		}
+	})
+}
+
+func testArchivedFiltering(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	bookmarks := []bookmark.Bookmark{
+		{Name: "Active1", URL: "https://active1.com", Archived: false},
+		{Name: "Active2", URL: "https://active2.com", Archived: false},
+		{Name: "Archived1", URL: "https://archived1.com", Archived: true},
+	}
+
+	for _, bm := range bookmarks {
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("failed to add test bookmark: %v", err)
+		}
+	}
+
+	t.Run("exclude archived", func(t *testing.T) {
+		result, err := repo.Ls(ctx, false)
+		if err != nil {
+			t.Fatalf("Ls(false) error = %v", err)
+		}
+
+		if len(result) != 2 {
+			t.Errorf("got %d bookmarks, want 2", len(result))
+		}
+
+		for _, bm := range result {
+			if bm.Archived {
+				t.Errorf("found archived bookmark %q in non-archived list", bm.Name)
+			}
+		}
+	})
+
+	t.Run("include archived", func(t *testing.T) {
+		result, err := repo.Ls(ctx, true)
+		if err != nil {
+			t.Fatalf("Ls(true) error = %v", err)
+		}
+
+		if len(result) != 3 {
+			t.Errorf("got %d bookmarks, want 3", len(result))
+		}
+
+		archivedCount := 0
+		for _, bm := range result {
+			if bm.Archived {
+				archivedCount++
+			}
+		}
+		if archivedCount != 1 {
+			t.Errorf("got %d archived bookmarks, want 1", archivedCount)
+		}
+	})
+}
+
+func testBrowser(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	zen := bookmark.Browser{Name: "zen-work", Path: "/Applications/Zen.app/Contents/MacOS/zen", Args: []string{"-p", "work"}}
+
+	t.Run("add browser", func(t *testing.T) {
+		if err := repo.AddBrowser(ctx, zen); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	})
+
+	t.Run("duplicate browser", func(t *testing.T) {
+		if !errors.Is(repo.AddBrowser(ctx, zen), bookmark.ErrDuplicateBrowser) {
+			t.Error("expected ErrDuplicateBrowser")
+		}
+	})
+
+	t.Run("list browsers", func(t *testing.T) {
+		browsers, err := repo.LsBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsBrowsers() error = %v", err)
+		}
+		if len(browsers) != 1 {
+			t.Fatalf("got %d browsers, want 1", len(browsers))
+		}
+		if browsers[0].Name != zen.Name || browsers[0].Path != zen.Path || !slices.Equal(browsers[0].Args, zen.Args) {
+			t.Errorf("got %+v, want %+v", browsers[0], zen)
+		}
+	})
+
+	t.Run("get browser", func(t *testing.T) {
+		b, err := repo.GetBrowser(ctx, zen.Name)
+		if err != nil {
+			t.Fatalf("GetBrowser() error = %v", err)
+		}
+		if b.Path != zen.Path || !slices.Equal(b.Args, zen.Args) {
+			t.Errorf("got %+v, want %+v", b, zen)
+		}
+	})
+
+	t.Run("get nonexistent browser", func(t *testing.T) {
+		if _, err := repo.GetBrowser(ctx, "nope"); err == nil {
+			t.Error("expected error for nonexistent browser")
+		}
+	})
+
+	t.Run("update browser", func(t *testing.T) {
+		env := []string{"MOZ_ENABLE_WAYLAND=1", "PATH=$HOME/bin:$PATH"}
+		if err := repo.UpdateBrowser(ctx, zen.Name, bookmark.BrowserPatch{Env: &env, Dir: ptr("/tmp"), Args: &[]string{}}); err != nil {
+			t.Fatalf("UpdateBrowser() error = %v", err)
+		}
+		b, err := repo.GetBrowser(ctx, zen.Name)
+		if err != nil {
+			t.Fatalf("GetBrowser() error = %v", err)
+		}
+		if b.Path != zen.Path || len(b.Args) != 0 || !slices.Equal(b.Env, env) || b.Dir != "/tmp" {
+			t.Errorf("got %+v", b)
+		}
+
+		if err := repo.UpdateBrowser(ctx, zen.Name, bookmark.BrowserPatch{Args: &zen.Args, Env: &[]string{}, Dir: ptr("")}); err != nil {
+			t.Fatalf("UpdateBrowser() error = %v", err)
+		}
+		if b, err := repo.GetBrowser(ctx, zen.Name); err != nil || !slices.Equal(b.Args, zen.Args) || len(b.Env) != 0 || b.Dir != "" {
+			t.Errorf("GetBrowser() = %+v, %v; want args restored and env and dir cleared", b, err)
+		}
+
+		if err := repo.UpdateBrowser(ctx, "nope", bookmark.BrowserPatch{Dir: ptr("/tmp")}); !errors.Is(err, bookmark.ErrBrowserNotFound) {
+			t.Errorf("UpdateBrowser() error = %v, want ErrBrowserNotFound", err)
+		}
+		if err := repo.UpdateBrowser(ctx, zen.Name, bookmark.BrowserPatch{Env: &[]string{"NOVALUE"}}); err == nil {
+			t.Error("UpdateBrowser(): expected error for invalid env")
+		}
+		if err := repo.UpdateBrowser(ctx, zen.Name, bookmark.BrowserPatch{}); err == nil {
+			t.Error("UpdateBrowser(): expected error for empty patch")
+		}
+	})
+
+	t.Run("browser env and dir", func(t *testing.T) {
+		want := bookmark.Browser{Name: "proxied", Path: "/usr/bin/firefox", Env: []string{"HTTPS_PROXY=http://proxy:3128"}, Dir: "/srv"}
+		if err := repo.AddBrowser(ctx, want); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+		if got, err := repo.GetBrowser(ctx, want.Name); err != nil || !bookmark.SameJSON(got, want) {
+			t.Errorf("GetBrowser() = %+v, %v; want %+v", got, err, want)
+		}
+		if err := repo.DelBrowser(ctx, want.Name); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "bad", Path: "/usr/bin/firefox", Env: []string{"=1"}}); err == nil {
+			t.Error("AddBrowser(): expected error for invalid env")
+		}
+	})
+
+	t.Run("bookmark with browser", func(t *testing.T) {
+		bm := bookmark.Bookmark{Name: "Work Google", URL: "https://google.com", BrowserName: zen.Name}
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+
+		got, err := repo.Get(ctx, bm.Name)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.BrowserName != zen.Name {
+			t.Errorf("got BrowserName %q, want %q", got.BrowserName, zen.Name)
+		}
+	})
+
+	t.Run("bookmark with invalid browser", func(t *testing.T) {
+		bm := bookmark.Bookmark{Name: "Bad BM", URL: "https://example.com", BrowserName: "nonexistent"}
+		if err := repo.Add(ctx, bm); err == nil {
+			t.Error("expected error for nonexistent browser profile")
+		}
+	})
+
+	t.Run("update bookmark browser", func(t *testing.T) {
+		if err := repo.Update(ctx, "Work Google", bookmark.BookmarkPatch{BrowserName: ptr("")}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Work Google")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.BrowserName != "" {
+			t.Errorf("expected BrowserName to be cleared, got %q", got.BrowserName)
+		}
+	})
+
+	t.Run("delete browser cascades to bookmarks", func(t *testing.T) {
+		// Re-associate the bookmark with the browser
+		if err := repo.Update(ctx, "Work Google", bookmark.BookmarkPatch{BrowserName: &zen.Name}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+
+		// Delete the browser; ON DELETE SET NULL should clear the FK
+		if err := repo.DelBrowser(ctx, zen.Name); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+
+		got, err := repo.Get(ctx, "Work Google")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.BrowserName != "" {
+			t.Errorf("expected BrowserName to be NULL after browser deletion, got %q", got.BrowserName)
+		}
+	})
+
+	t.Run("delete nonexistent browser", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "nope"); err == nil {
+			t.Error("expected error for nonexistent browser")
+		}
+	})
+}
+
+func testHierarchicalTags(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	bookmarks := []bookmark.Bookmark{
+		{Name: "K8s", URL: "https://kubernetes.io", Tags: []string{"Work/Infra/K8s"}},
+		{Name: "Grafana", URL: "https://grafana.com", Tags: []string{"work/infra", " work//infra "}},
+		{Name: "Jira", URL: "https://jira.com", Tags: []string{"work/tickets"}},
+		{Name: "Workout", URL: "https://workout.com", Tags: []string{"workout"}},
+	}
+	for _, bm := range bookmarks {
+		if err := repo.Add(ctx, bm); err != nil {
+			t.Fatalf("failed to add test bookmark: %v", err)
+		}
+	}
+
+	names := func(bms []bookmark.Bookmark) []string {
+		var result []string
+		for _, bm := range bms {
+			result = append(result, bm.Name)
+		}
+		slices.Sort(result)
+		return result
+	}
+
+	t.Run("tags are normalized", func(t *testing.T) {
+		got, err := repo.Get(ctx, "Grafana")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !slices.Equal(got.Tags, []string{"work/infra"}) {
+			t.Errorf("got tags %v, want [work/infra]", got.Tags)
+		}
+	})
+
+	t.Run("prefix matches descendants", func(t *testing.T) {
+		got, err := repo.LsByTag(ctx, "work/infra", true)
+		if err != nil {
+			t.Fatalf("LsByTag() error = %v", err)
+		}
+		if want := []string{"Grafana", "K8s"}; !slices.Equal(names(got), want) {
+			t.Errorf("got %v, want %v", names(got), want)
+		}
+	})
+
+	t.Run("prefix matches whole levels only", func(t *testing.T) {
+		got, err := repo.LsByTag(ctx, "work", true)
+		if err != nil {
+			t.Fatalf("LsByTag() error = %v", err)
+		}
+		if want := []string{"Grafana", "Jira", "K8s"}; !slices.Equal(names(got), want) {
+			t.Errorf("got %v, want %v", names(got), want)
+		}
+	})
+
+	t.Run("rename subtree", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "work/infra", "ops"); err != nil {
+			t.Fatalf("RenameTag() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "K8s")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !slices.Equal(got.Tags, []string{"ops/k8s"}) {
+			t.Errorf("got tags %v, want [ops/k8s]", got.Tags)
+		}
+		left, err := repo.LsByTag(ctx, "work/infra", true)
+		if err != nil {
+			t.Fatalf("LsByTag() error = %v", err)
+		}
+		if len(left) != 0 {
+			t.Errorf("got %v, want no bookmarks left under work/infra", names(left))
+		}
+	})
+
+	t.Run("rename into own subtree", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "ops", "ops/old"); err != nil {
+			t.Fatalf("RenameTag() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Grafana")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !slices.Equal(got.Tags, []string{"ops/old"}) {
+			t.Errorf("got tags %v, want [ops/old]", got.Tags)
+		}
+	})
+
+	t.Run("rename unknown tag", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "nope", "other"); err == nil {
+			t.Error("expected error for unknown tag")
+		}
+	})
+}
+
+func testRenameTagReferences(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	for _, name := range []string{"work", "home"} {
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: name, Path: "/usr/bin/firefox"}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	}
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Grafana", URL: "https://grafana.com", Tags: []string{"work/infra"}}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	for tag, browser := range map[string]string{"work": "work", "work/infra": "home", "job/infra": "work"} {
+		if err := repo.SetTagBrowser(ctx, tag, browser); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+	}
+	for _, rule := range []bookmark.Rule{
+		{Tag: "work/infra", BrowserName: "home"},
+		{Tag: "workshop", BrowserName: "work"},
+		{Host: "example.com", BrowserName: "work"},
+	} {
+		if _, err := repo.AddRule(ctx, rule, 0); err != nil {
+			t.Fatalf("AddRule() error = %v", err)
+		}
+	}
+	ruleTags := func(t *testing.T) []string {
+		t.Helper()
+		rules, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		var tags []string
+		for _, rule := range rules {
+			tags = append(tags, rule.Tag)
+		}
+		return tags
+	}
+
+	t.Run("defaults and rules follow the rename", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "work", "job"); err != nil {
+			t.Fatalf("RenameTag() error = %v", err)
+		}
+		got, err := repo.LsTagBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsTagBrowsers() error = %v", err)
+		}
+		// job/infra already had a default, which it keeps.
+		if want := map[string]string{"job": "work", "job/infra": "work"}; !maps.Equal(got, want) {
+			t.Errorf("got tag defaults %v, want %v", got, want)
+		}
+		if got, want := ruleTags(t), []string{"job/infra", "workshop", ""}; !slices.Equal(got, want) {
+			t.Errorf("got rule tags %q, want %q", got, want)
+		}
+	})
+
+	t.Run("rename a tag only rules use", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "workshop", "shop"); err != nil {
+			t.Fatalf("RenameTag() error = %v", err)
+		}
+		if got, want := ruleTags(t), []string{"job/infra", "shop", ""}; !slices.Equal(got, want) {
+			t.Errorf("got rule tags %q, want %q", got, want)
+		}
+	})
+}
+
+func testCollections(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	for _, name := range []string{"Wiki", "Chat", "Repo"} {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: name, URL: "https://" + name + ".com"}); err != nil {
+			t.Fatalf("failed to add test bookmark: %v", err)
+		}
+	}
+
+	members := func(t *testing.T) []string {
+		t.Helper()
+		c, err := repo.GetCollection(ctx, "onboarding")
+		if err != nil {
+			t.Fatalf("GetCollection() error = %v", err)
+		}
+		return c.Bookmarks
+	}
+
+	t.Run("create collection", func(t *testing.T) {
+		if err := repo.AddCollection(ctx, "onboarding"); err != nil {
+			t.Fatalf("AddCollection() error = %v", err)
+		}
+		if !errors.Is(repo.AddCollection(ctx, "onboarding"), bookmark.ErrDuplicateCollection) {
+			t.Error("expected ErrDuplicateCollection")
+		}
+	})
+
+	t.Run("add members in order", func(t *testing.T) {
+		for _, name := range []string{"Wiki", "Repo"} {
+			if err := repo.AddToCollection(ctx, "onboarding", name, 0); err != nil {
+				t.Fatalf("AddToCollection() error = %v", err)
+			}
+		}
+		if err := repo.AddToCollection(ctx, "onboarding", "Chat", 2); err != nil {
+			t.Fatalf("AddToCollection() error = %v", err)
+		}
+		if got, want := members(t), []string{"Wiki", "Chat", "Repo"}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("add invalid members", func(t *testing.T) {
+		if err := repo.AddToCollection(ctx, "onboarding", "Wiki", 0); err == nil {
+			t.Error("expected error for duplicate member")
+		}
+		if err := repo.AddToCollection(ctx, "onboarding", "nope", 0); err == nil {
+			t.Error("expected error for nonexistent bookmark")
+		}
+		if err := repo.AddToCollection(ctx, "nope", "Wiki", 0); err == nil {
+			t.Error("expected error for nonexistent collection")
+		}
+	})
+
+	t.Run("reorder", func(t *testing.T) {
+		if err := repo.MoveInCollection(ctx, "onboarding", "Repo", 1); err != nil {
+			t.Fatalf("MoveInCollection() error = %v", err)
+		}
+		if got, want := members(t), []string{"Repo", "Wiki", "Chat"}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("remove member", func(t *testing.T) {
+		if err := repo.RemoveFromCollection(ctx, "onboarding", "Wiki"); err != nil {
+			t.Fatalf("RemoveFromCollection() error = %v", err)
+		}
+		if got, want := members(t), []string{"Repo", "Chat"}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("deleting a bookmark removes it from collections", func(t *testing.T) {
+		if err := repo.Del(ctx, "Chat"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		collections, err := repo.LsCollections(ctx)
+		if err != nil {
+			t.Fatalf("LsCollections() error = %v", err)
+		}
+		if len(collections) != 1 || !slices.Equal(collections[0].Bookmarks, []string{"Repo"}) {
+			t.Errorf("got %+v, want onboarding with [Repo]", collections)
+		}
+	})
+
+	t.Run("delete collection", func(t *testing.T) {
+		if err := repo.DelCollection(ctx, "onboarding"); err != nil {
+			t.Fatalf("DelCollection() error = %v", err)
+		}
+		if _, err := repo.Get(ctx, "Repo"); err != nil {
+			t.Errorf("bookmark should survive its collection: %v", err)
+		}
+		if err := repo.DelCollection(ctx, "onboarding"); err == nil {
+			t.Error("expected error for nonexistent collection")
+		}
+	})
+}
+
+func testRules(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	for _, name := range []string{"work", "home"} {
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: name, Path: "/usr/bin/firefox"}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	}
+
+	ids := func(t *testing.T) []int64 {
+		t.Helper()
+		rules, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		var result []int64
+		for _, rule := range rules {
+			result = append(result, rule.ID)
+		}
+		return result
+	}
+
+	corp, err := repo.AddRule(ctx, bookmark.Rule{Host: "*.corp.example.com", BrowserName: "work"}, 0)
+	if err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	tagged, err := repo.AddRule(ctx, bookmark.Rule{Tag: "Home", BrowserName: "home"}, 0)
+	if err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	first, err := repo.AddRule(ctx, bookmark.Rule{Host: "vpn.corp.example.com", BrowserName: "home"}, 1)
+	if err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+
+	t.Run("rules are ordered by position", func(t *testing.T) {
+		if got, want := ids(t), []int64{first, corp, tagged}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("first matching rule wins", func(t *testing.T) {
+		rules, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		rule, ok, err := bookmark.MatchRule(rules, "https://vpn.corp.example.com", nil)
+		if err != nil || !ok || rule.ID != first {
+			t.Errorf("got rule %+v (ok %v, err %v), want #%d", rule, ok, err, first)
+		}
+		rule, ok, err = bookmark.MatchRule(rules, "https://example.com", []string{"home/media"})
+		if err != nil || !ok || rule.BrowserName != "home" {
+			t.Errorf("got rule %+v (ok %v, err %v), want the home tag rule", rule, ok, err)
+		}
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		if _, err := repo.AddRule(ctx, bookmark.Rule{Host: "example.com", BrowserName: "nope"}, 0); err == nil {
+			t.Error("expected error for nonexistent browser profile")
+		}
+		if _, err := repo.AddRule(ctx, bookmark.Rule{BrowserName: "work"}, 0); err == nil {
+			t.Error("expected error for rule without criteria")
+		}
+	})
+
+	t.Run("delete rule", func(t *testing.T) {
+		if err := repo.DelRule(ctx, first); err != nil {
+			t.Fatalf("DelRule() error = %v", err)
+		}
+		if err := repo.DelRule(ctx, first); err == nil {
+			t.Error("expected error for nonexistent rule")
+		}
+		if got, want := ids(t), []int64{corp, tagged}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("deleting a browser deletes its rules", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "home"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		if got, want := ids(t), []int64{corp}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("rules keep their order after deleting a browser", func(t *testing.T) {
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "temp", Path: "/usr/bin/firefox"}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+		add := func(rule bookmark.Rule, position int) int64 {
+			t.Helper()
+			id, err := repo.AddRule(ctx, rule, position)
+			if err != nil {
+				t.Fatalf("AddRule() error = %v", err)
+			}
+			return id
+		}
+		add(bookmark.Rule{Host: "temp.example.com", BrowserName: "temp"}, 0)
+		last := add(bookmark.Rule{Host: "last.example.com", BrowserName: "work"}, 0)
+		if err := repo.DelBrowser(ctx, "temp"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+
+		appended := add(bookmark.Rule{Host: "appended.example.com", BrowserName: "work"}, 0)
+		if got, want := ids(t), []int64{corp, last, appended}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		third := add(bookmark.Rule{Host: "third.example.com", BrowserName: "work"}, 3)
+		if got, want := ids(t), []int64{corp, last, third, appended}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func testBrowserDefaults(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	defaultOf := func(t *testing.T) string {
+		t.Helper()
+		browsers, err := repo.LsBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsBrowsers() error = %v", err)
+		}
+		name := ""
+		for _, b := range browsers {
+			if b.Default {
+				if name != "" {
+					t.Fatalf("both %q and %q are marked as default", name, b.Name)
+				}
+				name = b.Name
+			}
+		}
+		return name
+	}
+
+	t.Run("add default browser", func(t *testing.T) {
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox", Default: true}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "home", Path: "/usr/bin/firefox", Default: true}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+		if got := defaultOf(t); got != "home" {
+			t.Errorf("got default %q, want home", got)
+		}
+	})
+
+	t.Run("set default browser", func(t *testing.T) {
+		if err := repo.SetDefaultBrowser(ctx, "work"); err != nil {
+			t.Fatalf("SetDefaultBrowser() error = %v", err)
+		}
+		b, err := repo.GetBrowser(ctx, "work")
+		if err != nil {
+			t.Fatalf("GetBrowser() error = %v", err)
+		}
+		if !b.Default {
+			t.Error("expected work to be the default")
+		}
+		if err := repo.SetDefaultBrowser(ctx, "nope"); err == nil {
+			t.Error("expected error for nonexistent browser")
+		}
+		if got := defaultOf(t); got != "work" {
+			t.Errorf("got default %q, want work after failed update", got)
+		}
+	})
+
+	t.Run("clear default browser", func(t *testing.T) {
+		if err := repo.SetDefaultBrowser(ctx, ""); err != nil {
+			t.Fatalf("SetDefaultBrowser() error = %v", err)
+		}
+		if got := defaultOf(t); got != "" {
+			t.Errorf("got default %q, want none", got)
+		}
+	})
+
+	t.Run("tag defaults", func(t *testing.T) {
+		if err := repo.SetTagBrowser(ctx, "Work", "home"); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+		if err := repo.SetTagBrowser(ctx, "work", "work"); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+		if err := repo.SetTagBrowser(ctx, "home", "nope"); err == nil {
+			t.Error("expected error for nonexistent browser")
+		}
+		got, err := repo.LsTagBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsTagBrowsers() error = %v", err)
+		}
+		if len(got) != 1 || got["work"] != "work" {
+			t.Errorf("got %v, want map[work:work]", got)
+		}
+	})
+
+	t.Run("deleting a browser clears its tag defaults", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "work"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		got, err := repo.LsTagBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsTagBrowsers() error = %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("got %v, want no tag defaults", got)
+		}
+		if err := repo.SetTagBrowser(ctx, "work", ""); err == nil {
+			t.Error("expected error clearing a tag without default")
+		}
+	})
+}
+
+// testConstraints checks the rules the SQLite schema enforces with unique
+// keys, foreign keys and ON DELETE actions, which other backends must
+// follow as well.
+func testConstraints(t *testing.T, repo bookmark.Repository) {
+	ctx := context.Background()
+
+	if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Wiki", URL: "https://wiki.org", Tags: []string{"Docs", " WORK / Infra ", "docs"}, BrowserName: "work"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	t.Run("duplicate names", func(t *testing.T) {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: "Wiki", URL: "https://other.org"}); !errors.Is(err, bookmark.ErrDuplicateName) {
+			t.Errorf("Add() error = %v, want ErrDuplicateName", err)
+		}
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/chromium"}); !errors.Is(err, bookmark.ErrDuplicateBrowser) {
+			t.Errorf("AddBrowser() error = %v, want ErrDuplicateBrowser", err)
+		}
+		b, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if b.URL != "https://wiki.org" {
+			t.Errorf("duplicate overwrote the bookmark: %+v", b)
+		}
+	})
+
+	t.Run("tags are lowercased", func(t *testing.T) {
+		b, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if want := []string{"docs", "work/infra"}; !slices.Equal(b.Tags, want) {
+			t.Errorf("got tags %v, want %v", b.Tags, want)
+		}
+		bookmarks, err := repo.LsByTag(ctx, "WORK", false)
+		if err != nil {
+			t.Fatalf("LsByTag() error = %v", err)
+		}
+		if len(bookmarks) != 1 {
+			t.Errorf("LsByTag(WORK) got %d bookmarks, want 1", len(bookmarks))
+		}
+	})
+
+	t.Run("unknown browser", func(t *testing.T) {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: "Ghost", URL: "https://ghost.org", BrowserName: "nope"}); !errors.Is(err, bookmark.ErrUnknownBrowser) {
+			t.Errorf("Add() error = %v, want ErrUnknownBrowser", err)
+		}
+		if _, err := repo.Get(ctx, "Ghost"); err == nil {
+			t.Error("failed Add() left a bookmark behind")
+		}
+		if err := repo.Update(ctx, "Wiki", bookmark.BookmarkPatch{BrowserName: ptr("nope"), URL: ptr("https://changed.org")}); !errors.Is(err, bookmark.ErrUnknownBrowser) {
+			t.Errorf("Update() error = %v, want ErrUnknownBrowser", err)
+		}
+		if b, err := repo.Get(ctx, "Wiki"); err != nil || b.URL != "https://wiki.org" || b.BrowserName != "work" {
+			t.Errorf("failed Update() changed the bookmark: %+v, %v", b, err)
+		}
+		if err := repo.SetTagBrowser(ctx, "docs", "nope"); !errors.Is(err, bookmark.ErrUnknownBrowser) {
+			t.Errorf("SetTagBrowser() error = %v, want ErrUnknownBrowser", err)
+		}
+		if err := repo.SetDefaultBrowser(ctx, "nope"); !errors.Is(err, bookmark.ErrBrowserNotFound) {
+			t.Errorf("SetDefaultBrowser() error = %v, want ErrBrowserNotFound", err)
+		}
+		if _, err := repo.AddRule(ctx, bookmark.Rule{BrowserName: "nope", Tag: "docs"}, 0); !errors.Is(err, bookmark.ErrUnknownBrowser) {
+			t.Errorf("AddRule() error = %v, want ErrUnknownBrowser", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := repo.Get(ctx, "nope"); !errors.Is(err, bookmark.ErrBookmarkNotFound) || !errors.Is(err, bookmark.ErrNotFound) {
+			t.Errorf("Get() error = %v, want ErrBookmarkNotFound", err)
+		}
+		if err := repo.Update(ctx, "nope", bookmark.BookmarkPatch{URL: ptr("https://nope.org")}); !errors.Is(err, bookmark.ErrBookmarkNotFound) {
+			t.Errorf("Update() error = %v, want ErrBookmarkNotFound", err)
+		}
+		if _, err := repo.GetBrowser(ctx, "nope"); !errors.Is(err, bookmark.ErrBrowserNotFound) || !errors.Is(err, bookmark.ErrNotFound) {
+			t.Errorf("GetBrowser() error = %v, want ErrBrowserNotFound", err)
+		}
+		if err := repo.DelBrowser(ctx, "nope"); !errors.Is(err, bookmark.ErrBrowserNotFound) {
+			t.Errorf("DelBrowser() error = %v, want ErrBrowserNotFound", err)
+		}
+	})
+
+	t.Run("deleting a browser", func(t *testing.T) {
+		if err := repo.SetTagBrowser(ctx, "docs", "work"); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+		if _, err := repo.AddRule(ctx, bookmark.Rule{BrowserName: "work", Tag: "docs"}, 0); err != nil {
+			t.Fatalf("AddRule() error = %v", err)
+		}
+		if err := repo.SetDefaultBrowser(ctx, "work"); err != nil {
+			t.Fatalf("SetDefaultBrowser() error = %v", err)
+		}
+		if err := repo.DelBrowser(ctx, "work"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+
+		// Bookmarks are kept with their browser cleared (ON DELETE SET
+		// NULL), rules and tag defaults go away (ON DELETE CASCADE).
+		b, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if b.BrowserName != "" {
+			t.Errorf("got BrowserName %q, want it cleared", b.BrowserName)
+		}
+		if tagBrowsers, err := repo.LsTagBrowsers(ctx); err != nil || len(tagBrowsers) != 0 {
+			t.Errorf("LsTagBrowsers() = %v, %v; want none", tagBrowsers, err)
+		}
+		if rules, err := repo.LsRules(ctx); err != nil || len(rules) != 0 {
+			t.Errorf("LsRules() = %v, %v; want none", rules, err)
+		}
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+		if b, err := repo.GetBrowser(ctx, "work"); err != nil || b.Default {
+			t.Errorf("re-added browser is the default: %+v, %v", b, err)
+		}
+	})
+}
+
+func testContextCancellation(t *testing.T, repo bookmark.Repository) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Google", URL: "https://google.com"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Add() error = %v, want context.Canceled", err)
+	}
+	if _, err := repo.Ls(ctx, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("Ls() error = %v, want context.Canceled", err)
+	}
+
+	got, err := repo.Ls(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Ls() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %d bookmarks, want 0 after cancelled Add", len(got))
+	}
+}
+
+func (b Backend) testExportImport(t *testing.T) {
+	open := b.Open
+	ctx := context.Background()
+	src := open(t)
+
+	if err := src.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox", Args: []string{"-P", "work"}, Default: true}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	for _, bm := range []bookmark.Bookmark{
+		{Name: "Google", URL: "https://google.com", Tags: []string{"search", "dev/go"}, BrowserName: "work"},
+		{Name: "Old", URL: "https://old.com", Archived: true},
+	} {
+		if err := src.Add(ctx, bm); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := src.Del(ctx, "Old"); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if err := src.AddCollection(ctx, "daily"); err != nil {
+		t.Fatalf("AddCollection() error = %v", err)
+	}
+	if err := src.AddToCollection(ctx, "daily", "Google", 0); err != nil {
+		t.Fatalf("AddToCollection() error = %v", err)
+	}
+	if _, err := src.AddRule(ctx, bookmark.Rule{Host: "*.corp", BrowserName: "work"}, 0); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if err := src.SetTagBrowser(ctx, "dev", "work"); err != nil {
+		t.Fatalf("SetTagBrowser() error = %v", err)
+	}
+
+	dump, err := src.Export(ctx)
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		dst := open(t)
+		res, err := dst.Import(ctx, dump, bookmark.ImportMerge)
+		if err != nil {
+			t.Fatalf("Import() error = %v", err)
+		}
+		if res.Added != 6 || res.Updated != 0 || len(res.Conflicts) != 0 {
+			t.Errorf("Import() = %+v, want 6 added", res)
+		}
+		got, err := dst.Export(ctx)
+		if err != nil {
+			t.Fatalf("Export() error = %v", err)
+		}
+		if !bookmark.SameJSON(got, dump) {
+			t.Errorf("Export() after import = %+v, want %+v", got, dump)
+		}
+
+		res, err = dst.Import(ctx, dump, bookmark.ImportMerge)
+		if err != nil {
+			t.Fatalf("Import() again error = %v", err)
+		}
+		if res.Added != 0 || res.Updated != 0 || res.Unchanged != 6 {
+			t.Errorf("Import() again = %+v, want 6 unchanged", res)
+		}
+	})
+
+	t.Run("merge and skip-existing", func(t *testing.T) {
+		dst := open(t)
+		if err := dst.Add(ctx, bookmark.Bookmark{Name: "Google", URL: "https://local.example"}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+
+		res, err := dst.Import(ctx, dump, bookmark.ImportSkipExisting)
+		if err != nil {
+			t.Fatalf("Import(skip-existing) error = %v", err)
+		}
+		if res.Skipped != 1 || !slices.Equal(res.Conflicts, []string{`bookmark "Google"`}) {
+			t.Errorf("Import(skip-existing) = %+v, want Google skipped", res)
+		}
+		got, err := dst.Get(ctx, "Google")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.URL != "https://local.example" {
+			t.Errorf("skip-existing overwrote URL with %q", got.URL)
+		}
+
+		res, err = dst.Import(ctx, dump, bookmark.ImportMerge)
+		if err != nil {
+			t.Fatalf("Import(merge) error = %v", err)
+		}
+		if res.Updated != 1 || !slices.Equal(res.Conflicts, []string{`bookmark "Google"`}) {
+			t.Errorf("Import(merge) = %+v, want Google updated", res)
+		}
+		if got, _ = dst.Get(ctx, "Google"); got.URL != "https://google.com" {
+			t.Errorf("merge left URL %q", got.URL)
+		}
+
+		if b.NoChangeLog {
+			return
+		}
+		if _, err := dst.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got, _ = dst.Get(ctx, "Google"); got.URL != "https://local.example" {
+			t.Errorf("undo of import left URL %q", got.URL)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		dst := open(t)
+		if err := dst.Add(ctx, bookmark.Bookmark{Name: "Local", URL: "https://local.example"}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if _, err := dst.Import(ctx, dump, bookmark.ImportReplace); err != nil {
+			t.Fatalf("Import(replace) error = %v", err)
+		}
+		got, err := dst.Export(ctx)
+		if err != nil {
+			t.Fatalf("Export() error = %v", err)
+		}
+		if !bookmark.SameJSON(got, dump) {
+			t.Errorf("Export() after replace = %+v, want %+v", got, dump)
+		}
+	})
+
+	t.Run("errors roll back", func(t *testing.T) {
+		dst := open(t)
+		broken := dump
+		broken.Browsers = nil
+		broken.Rules = nil
+		broken.TagBrowsers = nil
+		if _, err := dst.Import(ctx, broken, bookmark.ImportMerge); err == nil {
+			t.Fatal("Import() with missing browser profile succeeded")
+		}
+		got, err := dst.Ls(ctx, true)
+		if err != nil {
+			t.Fatalf("Ls() error = %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("failed import left %d bookmarks", len(got))
+		}
+
+		newer := dump
+		newer.Version = bookmark.DumpVersion + 1
+		if _, err := dst.Import(ctx, newer, bookmark.ImportMerge); err == nil {
+			t.Error("Import() of a newer version succeeded")
+		}
+		if _, err := dst.Import(ctx, dump, bookmark.ImportMode("bogus")); err == nil {
+			t.Error("Import() with unknown mode succeeded")
+		}
+	})
+}
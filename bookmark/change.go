@@ -0,0 +1,37 @@
+package bookmark
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Entities tracked in the change log.
+const (
+	EntityBookmark   = "bookmark"
+	EntityBrowser    = "browser"
+	EntityCollection = "collection"
+)
+
+// Change is one recorded mutation of a bookmark, browser profile or
+// collection. Before and After hold the JSON snapshot of the entity and are
+// nil when it did not exist; changes to routing rules and tag defaults are
+// recorded with the browser profile they belong to. All changes made by one
+// repository call share a batch, which is the unit of undo.
+type Change struct {
+	ID     int64
+	Batch  int64
+	At     time.Time
+	Host   string
+	User   string
+	Op     string
+	Entity string
+	Name   string
+	Before json.RawMessage
+	After  json.RawMessage
+	Undone bool
+}
+
+// ErrUndoConflict is returned when an entity changed after the change that
+// should be undone.
+var ErrUndoConflict = errors.New("conflicting later change")
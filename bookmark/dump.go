@@ -0,0 +1,143 @@
+package bookmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DumpVersion is the version of the format written by Export. Import reads
+// this and all earlier versions.
+const DumpVersion = 1
+
+// Dump is a lossless copy of all bookmarks, including the trash, together
+// with browser profiles, collections, routing rules and tag defaults. The
+// change log is not part of it.
+type Dump struct {
+	Version     int               `json:"version"`
+	Browsers    []Browser         `json:"browsers,omitempty"`
+	Bookmarks   []Bookmark        `json:"bookmarks,omitempty"`
+	Collections []Collection      `json:"collections,omitempty"`
+	Rules       []Rule            `json:"rules,omitempty"`
+	TagBrowsers map[string]string `json:"tag_browsers,omitempty"`
+}
+
+// ImportMode decides what happens to entities that exist both locally and in
+// an imported dump.
+type ImportMode string
+
+const (
+	// ImportMerge overwrites local entities with the imported ones.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace deletes all local data before importing.
+	ImportReplace ImportMode = "replace"
+	// ImportSkipExisting keeps local entities and only adds new ones.
+	ImportSkipExisting ImportMode = "skip-existing"
+)
+
+// ImportResult summarizes an import. Conflicts names the entities that
+// exist locally with different contents; merge overwrote them (Updated),
+// skip-existing kept them (Skipped).
+type ImportResult struct {
+	Added     int
+	Updated   int
+	Skipped   int
+	Unchanged int
+	Conflicts []string
+}
+
+// Reconcile counts one imported entity and reports whether it should be
+// written. It is meant for Repository implementations.
+func (res *ImportResult) Reconcile(mode ImportMode, kind, name string, exists, equal bool) bool {
+	switch {
+	case !exists:
+		res.Added++
+		return true
+	case equal:
+		res.Unchanged++
+		return false
+	}
+	res.Conflicts = append(res.Conflicts, fmt.Sprintf("%s %q", kind, name))
+	if mode == ImportSkipExisting {
+		res.Skipped++
+		return false
+	}
+	res.Updated++
+	return true
+}
+
+// SameJSON reports whether a and b have the same JSON encoding. Repository
+// implementations use it to tell an imported entity from the local one.
+func SameJSON(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// Validate checks the dump before anything is imported and brings its tags
+// into normalized form.
+func (d *Dump) Validate() error {
+	if d.Version < 1 {
+		return fmt.Errorf("missing or invalid dump version %d", d.Version)
+	}
+	if d.Version > DumpVersion {
+		return fmt.Errorf("dump version %d was written by a newer bm, this one reads up to version %d", d.Version, DumpVersion)
+	}
+
+	seen := map[string]bool{}
+	defaults := 0
+	for _, b := range d.Browsers {
+		if b.Name == "" || b.Path == "" {
+			return fmt.Errorf("browser profile %q needs a name and a path", b.Name)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("browser profile %q appears twice", b.Name)
+		}
+		if err := b.Validate(); err != nil {
+			return err
+		}
+		seen[b.Name] = true
+		if b.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("%d browser profiles are marked as default", defaults)
+	}
+
+	seen = map[string]bool{}
+	for i := range d.Bookmarks {
+		b := &d.Bookmarks[i]
+		if b.Name == "" || b.URL == "" {
+			return fmt.Errorf("bookmark %q needs a name and a URL", b.Name)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("bookmark %q appears twice", b.Name)
+		}
+		seen[b.Name] = true
+		b.Tags = NormalizeTags(b.Tags)
+		slices.Sort(b.Tags)
+		if b.DeletedAt != nil {
+			deleted := b.DeletedAt.UTC().Truncate(time.Second)
+			b.DeletedAt = &deleted
+		}
+	}
+
+	for i := range d.Rules {
+		d.Rules[i].Tag = NormalizeTag(d.Rules[i].Tag)
+		if err := d.Rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	tagBrowsers := make(map[string]string, len(d.TagBrowsers))
+	for tag, browser := range d.TagBrowsers {
+		if tag = NormalizeTag(tag); tag == "" {
+			return fmt.Errorf("tag defaults need a tag")
+		}
+		tagBrowsers[tag] = browser
+	}
+	d.TagBrowsers = tagBrowsers
+	return nil
+}
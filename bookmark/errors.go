@@ -0,0 +1,32 @@
+package bookmark
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when a named entity does not exist. The more
+	// specific errors below wrap it.
+	ErrNotFound = errors.New("not found")
+	// ErrBookmarkNotFound is returned when a bookmark does not exist. It
+	// wraps ErrNotFound.
+	ErrBookmarkNotFound = fmt.Errorf("bookmark %w", ErrNotFound)
+	// ErrBrowserNotFound is returned when a browser profile that is looked
+	// up, changed or deleted does not exist. It wraps ErrNotFound.
+	ErrBrowserNotFound = fmt.Errorf("browser profile %w", ErrNotFound)
+	// ErrUnknownBrowser is returned when a bookmark, routing rule or tag
+	// default refers to a browser profile that does not exist.
+	ErrUnknownBrowser = errors.New("unknown browser profile")
+
+	ErrDuplicateName       = errors.New("name already exists")
+	ErrDuplicateBrowser    = errors.New("browser profile already exists")
+	ErrDuplicateCollection = errors.New("collection already exists")
+	// ErrNameInTrash is returned when a bookmark is added under the name of
+	// one in the trash. It wraps ErrDuplicateName.
+	ErrNameInTrash = fmt.Errorf("%w in the trash, restore or purge it first", ErrDuplicateName)
+
+	// ErrNoChangeLog is returned by Changes and Undo of repositories that do
+	// not record changes.
+	ErrNoChangeLog = errors.New("this backend keeps no change log")
+)
@@ -0,0 +1,17 @@
+package bookmark
+
+import "context"
+
+// Maintainer is implemented by repositories backed by a database file that
+// can be backed up, restored and checked.
+type Maintainer interface {
+	// Backup writes a consistent copy of the database to dest, keeping up to
+	// keep-1 older backups as dest.1, dest.2, ...
+	Backup(ctx context.Context, dest string, keep int) error
+	// RestoreFrom replaces all data with the contents of the backup at src.
+	RestoreFrom(ctx context.Context, src string) error
+	// Check returns the problems found in the database.
+	Check(ctx context.Context) ([]string, error)
+	// Vacuum rebuilds the database file to reclaim unused space.
+	Vacuum(ctx context.Context) error
+}
@@ -0,0 +1,95 @@
+package bookmark
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BrowserResolver picks the browser profile a bookmark is opened with. The
+// bookmark's own profile wins, followed by the first matching routing rule,
+// the default profile of its most specific tag and the global default
+// profile. An empty result means the OS default browser.
+type BrowserResolver struct {
+	rules          []Rule
+	tagBrowsers    map[string]string
+	defaultBrowser string
+}
+
+// NewBrowserResolver loads the routing rules, tag defaults and default
+// profile from repo.
+func NewBrowserResolver(ctx context.Context, repo Repository) (*BrowserResolver, error) {
+	rules, err := repo.LsRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tagBrowsers, err := repo.LsTagBrowsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	browsers, err := repo.LsBrowsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &BrowserResolver{rules: rules, tagBrowsers: tagBrowsers}
+	for _, b := range browsers {
+		if b.Default {
+			r.defaultBrowser = b.Name
+		}
+	}
+	return r, nil
+}
+
+// Resolve returns the browser profile for a bookmark together with the steps
+// of the resolution chain, for diagnostics.
+func (r *BrowserResolver) Resolve(bm Bookmark) (string, []string, error) {
+	if bm.BrowserName != "" {
+		return bm.BrowserName, []string{"bookmark profile: " + bm.BrowserName}, nil
+	}
+	steps := []string{"bookmark profile: none"}
+
+	rule, ok, err := MatchRule(r.rules, bm.URL, bm.Tags)
+	if err != nil {
+		return "", steps, fmt.Errorf("routing %q: %w", bm.Name, err)
+	}
+	if ok {
+		steps = append(steps, fmt.Sprintf("routing rule #%d (%s): %s", rule.ID, rule, rule.BrowserName))
+		return rule.BrowserName, steps, nil
+	}
+	steps = append(steps, "routing rule: no match")
+
+	if tag, browser, ok := r.tagDefault(bm.Tags); ok {
+		steps = append(steps, fmt.Sprintf("tag default (%s): %s", tag, browser))
+		return browser, steps, nil
+	}
+	steps = append(steps, "tag default: none")
+
+	if r.defaultBrowser != "" {
+		steps = append(steps, "global default: "+r.defaultBrowser)
+		return r.defaultBrowser, steps, nil
+	}
+	steps = append(steps, "global default: none", "OS default browser")
+	return "", steps, nil
+}
+
+// tagDefault returns the default profile of the most specific tag or tag
+// ancestor that has one. Ties between equally deep tags go to the tag that
+// sorts first, so the result does not depend on the order of the tags.
+func (r *BrowserResolver) tagDefault(tags []string) (tag, browser string, ok bool) {
+	depth := -1
+	for _, t := range tags {
+		for candidate := t; candidate != ""; candidate = parentTag(candidate) {
+			b, found := r.tagBrowsers[candidate]
+			if !found {
+				continue
+			}
+			d := strings.Count(candidate, TagSeparator)
+			if d > depth || d == depth && candidate < tag {
+				depth, tag, browser, ok = d, candidate, b, true
+			}
+			break
+		}
+	}
+	return tag, browser, ok
+}
@@ -0,0 +1,48 @@
+package bookmark
+
+import "testing"
+
+func TestBrowserResolver(t *testing.T) {
+	r := &BrowserResolver{
+		rules:          []Rule{{ID: 1, Host: "*.corp.example.com", BrowserName: "corp"}},
+		tagBrowsers:    map[string]string{"work": "work", "work/infra": "infra", "home": "home"},
+		defaultBrowser: "fallback",
+	}
+
+	tests := []struct {
+		name string
+		bm   Bookmark
+		want string
+	}{
+		{"explicit profile", Bookmark{URL: "https://wiki.corp.example.com", BrowserName: "own"}, "own"},
+		{"routing rule", Bookmark{URL: "https://wiki.corp.example.com", Tags: []string{"home"}}, "corp"},
+		{"tag default", Bookmark{URL: "https://example.com", Tags: []string{"home"}}, "home"},
+		{"ancestor tag default", Bookmark{URL: "https://example.com", Tags: []string{"work/tickets"}}, "work"},
+		{"most specific tag wins", Bookmark{URL: "https://example.com", Tags: []string{"work", "work/infra/k8s"}}, "infra"},
+		{"equally specific tags", Bookmark{URL: "https://example.com", Tags: []string{"work", "home"}}, "home"},
+		{"global default", Bookmark{URL: "https://example.com", Tags: []string{"misc"}}, "fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, steps, err := r.Resolve(tt.bm)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q (steps %q)", got, tt.want, steps)
+			}
+		})
+	}
+
+	t.Run("OS default", func(t *testing.T) {
+		r := &BrowserResolver{}
+		got, steps, err := r.Resolve(Bookmark{URL: "https://example.com"})
+		if err != nil {
+			t.Fatalf("resolve() error = %v", err)
+		}
+		if got != "" || len(steps) != 5 {
+			t.Errorf("got %q with steps %q, want the OS default after 5 steps", got, steps)
+		}
+	})
+}
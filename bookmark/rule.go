@@ -0,0 +1,111 @@
+package bookmark
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rule routes bookmarks without an explicit browser profile to a profile. A
+// rule matches when its host pattern matches the host of the bookmark URL and
+// the bookmark carries its tag or one of the tag's descendants. Host is a
+// glob (e.g. *.corp.example.com), or an unanchored regular expression when
+// Regex is set. Empty criteria match everything, but a rule needs at least one.
+type Rule struct {
+	ID          int64  `json:"-"`
+	Host        string `json:"host,omitempty"`
+	Regex       bool   `json:"regex,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	BrowserName string `json:"browser"`
+}
+
+// Validate checks that the rule has a criterion and a usable host pattern.
+func (r Rule) Validate() error {
+	if r.Host == "" && r.Tag == "" {
+		return fmt.Errorf("a rule needs a host pattern, a tag or both")
+	}
+	if r.Regex {
+		if _, err := regexp.Compile(r.Host); err != nil {
+			return fmt.Errorf("invalid host regex %q: %w", r.Host, err)
+		}
+	} else if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob %q: %w", r.Host, err)
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to a URL with the given tags.
+func (r Rule) Matches(rawURL string, tags []string) (bool, error) {
+	if r.Tag != "" && !HasTag(tags, r.Tag) {
+		return false, nil
+	}
+	if r.Host == "" {
+		return true, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false, err
+	}
+	host := strings.ToLower(u.Hostname())
+	if r.Regex {
+		return regexp.MatchString(r.Host, host)
+	}
+	return path.Match(strings.ToLower(r.Host), host)
+}
+
+// String describes the criteria of the rule, e.g. `host *.corp.com, tag work`.
+func (r Rule) String() string {
+	var criteria []string
+	if r.Host != "" {
+		kind := "host"
+		if r.Regex {
+			kind = "host regex"
+		}
+		criteria = append(criteria, kind+" "+r.Host)
+	}
+	if r.Tag != "" {
+		criteria = append(criteria, "tag "+r.Tag)
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// MatchRule returns the first of the ordered rules matching a URL and tags.
+func MatchRule(rules []Rule, rawURL string, tags []string) (Rule, bool, error) {
+	for _, rule := range rules {
+		ok, err := rule.Matches(rawURL, tags)
+		if err != nil {
+			return Rule{}, false, err
+		}
+		if ok {
+			return rule, true, nil
+		}
+	}
+	return Rule{}, false, nil
+}
+
+// MatchURLGlob reports whether a glob matches the host of a URL, e.g.
+// *.oldcorp.com, or the whole URL, e.g. https://github.com/*/*.
+func MatchURLGlob(rawURL, glob string) (bool, error) {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		ok, err := path.Match(strings.ToLower(glob), strings.ToLower(u.Hostname()))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return path.Match(glob, rawURL)
+}
+
+// HasTag reports whether one of tags equals prefix or is one of its
+// descendants.
+func HasTag(tags []string, prefix string) bool {
+	for _, tag := range tags {
+		if TagMatches(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
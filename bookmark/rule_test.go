@@ -0,0 +1,43 @@
+package bookmark
+
+import "testing"
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		url  string
+		tags []string
+		want bool
+	}{
+		{"glob subdomain", Rule{Host: "*.corp.example.com"}, "https://wiki.corp.example.com/page", nil, true},
+		{"glob is case insensitive", Rule{Host: "*.Corp.example.com"}, "https://WIKI.corp.example.com", nil, true},
+		{"glob needs subdomain", Rule{Host: "*.corp.example.com"}, "https://corp.example.com", nil, false},
+		{"glob other host", Rule{Host: "*.corp.example.com"}, "https://example.com", nil, false},
+		{"regex", Rule{Host: `^(www\.)?github\.com$`, Regex: true}, "https://github.com/allaman/bm", nil, true},
+		{"regex miss", Rule{Host: `^github\.com$`, Regex: true}, "https://gist.github.com", nil, false},
+		{"tag descendant", Rule{Tag: "work"}, "https://example.com", []string{"work/infra"}, true},
+		{"tag miss", Rule{Tag: "work"}, "https://example.com", []string{"workout"}, false},
+		{"host and tag", Rule{Host: "example.com", Tag: "work"}, "https://example.com", []string{"home"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule.Matches(tt.url, tt.tags)
+			if err != nil {
+				t.Fatalf("Matches() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	for _, rule := range []Rule{{}, {Host: "[", Regex: false}, {Host: "(", Regex: true}} {
+		if err := rule.Validate(); err == nil {
+			t.Errorf("expected error for %+v", rule)
+		}
+	}
+}
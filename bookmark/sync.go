@@ -0,0 +1,57 @@
+package bookmark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// SyncStrategy decides which side of a conflicting edit wins.
+type SyncStrategy string
+
+const (
+	// SyncNewest keeps the version with the later modification stamp.
+	SyncNewest SyncStrategy = "newest"
+	// SyncLocal keeps the version of the database being synced.
+	SyncLocal SyncStrategy = "local"
+	// SyncRemote keeps the version of the peer.
+	SyncRemote SyncStrategy = "remote"
+	// SyncInteractive asks a SyncResolver.
+	SyncInteractive SyncStrategy = "interactive"
+)
+
+// SyncConflict is an entity that changed on both sides since the last sync.
+// Local and Remote hold its JSON snapshot and are nil when it was deleted.
+type SyncConflict struct {
+	Entity   string
+	Name     string
+	Local    json.RawMessage
+	Remote   json.RawMessage
+	LocalAt  time.Time
+	RemoteAt time.Time
+}
+
+// SyncResolver decides a conflict for SyncInteractive and reports whether
+// the remote version should win.
+type SyncResolver func(SyncConflict) (useRemote bool, err error)
+
+// SyncResult summarizes a sync. Pulled and Pushed count the entities copied
+// from the peer and to the peer.
+type SyncResult struct {
+	Pulled    int
+	Pushed    int
+	Conflicts []SyncConflict
+}
+
+// ErrSyncChanged is returned when a database changed while conflicts were
+// being resolved interactively.
+var ErrSyncChanged = errors.New("database changed while resolving conflicts, run sync again")
+
+// Syncer is implemented by repositories that can merge their contents with
+// another database of the same kind.
+type Syncer interface {
+	// Sync merges bookmarks and browser profiles with the database at
+	// peerPath in both directions.
+	Sync(ctx context.Context, peerPath string, strategy SyncStrategy, resolve SyncResolver) (SyncResult, error)
+}
@@ -0,0 +1,108 @@
+package bookmark
+
+import (
+	"sort"
+	"strings"
+)
+
+// TagSeparator separates the levels of a hierarchical tag, e.g. work/infra/k8s.
+const TagSeparator = "/"
+
+// NormalizeTag lowercases a tag and cleans up its hierarchy: surrounding
+// whitespace is trimmed from every level and empty levels are dropped, so
+// " Work//Infra/ " becomes "work/infra".
+func NormalizeTag(tag string) string {
+	parts := strings.Split(strings.ToLower(tag), TagSeparator)
+	levels := parts[:0]
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			levels = append(levels, p)
+		}
+	}
+	return strings.Join(levels, TagSeparator)
+}
+
+// NormalizeTags normalizes every tag and drops empty and duplicate entries
+// while keeping the original order.
+func NormalizeTags(tags []string) []string {
+	var result []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// TagMatches reports whether tag equals prefix or is one of its descendants.
+func TagMatches(tag, prefix string) bool {
+	return tag == prefix || strings.HasPrefix(tag, prefix+TagSeparator)
+}
+
+// parentTag returns the parent of a hierarchical tag, or "" for a top-level tag.
+func parentTag(tag string) string {
+	i := strings.LastIndex(tag, TagSeparator)
+	if i < 0 {
+		return ""
+	}
+	return tag[:i]
+}
+
+// TagNode is one level of the tag hierarchy. Count is the number of distinct
+// bookmarks carrying the tag itself or any of its descendants.
+type TagNode struct {
+	Name     string
+	Path     string
+	Count    int
+	Children []*TagNode
+}
+
+// BuildTagTree arranges the tags of the given bookmarks into a hierarchy
+// sorted by name.
+func BuildTagTree(bookmarks []Bookmark) []*TagNode {
+	root := &TagNode{}
+	members := make(map[*TagNode]map[string]bool)
+	for _, bm := range bookmarks {
+		for _, tag := range bm.Tags {
+			node := root
+			for _, level := range strings.Split(tag, TagSeparator) {
+				node = node.child(level)
+				if members[node] == nil {
+					members[node] = make(map[string]bool)
+				}
+				members[node][bm.Name] = true
+			}
+		}
+	}
+	for node, names := range members {
+		node.Count = len(names)
+	}
+	root.sort()
+	return root.Children
+}
+
+func (n *TagNode) child(name string) *TagNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	path := name
+	if n.Path != "" {
+		path = n.Path + TagSeparator + name
+	}
+	c := &TagNode{Name: name, Path: path}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+func (n *TagNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
@@ -0,0 +1,29 @@
+package bookmark
+
+import "testing"
+
+func TestBuildTagTree(t *testing.T) {
+	bookmarks := []Bookmark{
+		{Name: "a", Tags: []string{"work/infra/k8s", "work"}},
+		{Name: "b", Tags: []string{"work/infra"}},
+		{Name: "c", Tags: []string{"home"}},
+	}
+
+	nodes := BuildTagTree(bookmarks)
+	if len(nodes) != 2 || nodes[0].Name != "home" || nodes[1].Name != "work" {
+		t.Fatalf("got top level %+v, want home and work", nodes)
+	}
+
+	work := nodes[1]
+	if work.Count != 2 {
+		t.Errorf("work: got count %d, want 2 distinct bookmarks", work.Count)
+	}
+	infra := work.Children[0]
+	if infra.Path != "work/infra" || infra.Count != 2 {
+		t.Errorf("got %s (%d), want work/infra (2)", infra.Path, infra.Count)
+	}
+	k8s := infra.Children[0]
+	if k8s.Path != "work/infra/k8s" || k8s.Count != 1 {
+		t.Errorf("got %s (%d), want work/infra/k8s (1)", k8s.Path, k8s.Count)
+	}
+}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"log"
 	"os"
-	"os/exec"
-	"runtime"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/discover"
+	"github.com/allaman/bm/launch"
 )
 
 const (
@@ -16,14 +29,28 @@ const (
 )
 
 type CLI struct {
-	Add     AddCmd     `cmd:"" help:"Add a new bookmark"`
-	Del     DelCmd     `cmd:"" help:"Delete a bookmark"`
-	Ls      LsCmd      `cmd:"" help:"List all bookmarks"`
-	Upd     UpdateCmd  `cmd:"" help:"Update a bookmark"`
-	Open    OpenCmd    `cmd:"" help:"Open a bookmark in its configured browser"`
-	Browser BrowserCmd `cmd:"" help:"Manage browser profiles"`
-	Path    string     `short:"p" default:"./bm.sqlite" help:"Path to the sqlite database"`
-	Version VersionCmd `cmd:"" help:"Show version information"`
+	Add         AddCmd        `cmd:"" help:"Add a new bookmark"`
+	Del         DelCmd        `cmd:"" help:"Delete a bookmark"`
+	Ls          LsCmd         `cmd:"" help:"List all bookmarks"`
+	Upd         UpdateCmd     `cmd:"" help:"Update a bookmark, or all bookmarks matching --where-* filters"`
+	Open        OpenCmd       `cmd:"" help:"Open a bookmark in its configured browser"`
+	Browser     BrowserCmd    `cmd:"" help:"Manage browser profiles"`
+	Tag         TagCmd        `cmd:"" help:"Manage tags"`
+	Collection  CollectionCmd `cmd:"" help:"Manage ordered collections of bookmarks"`
+	Trash       TrashCmd      `cmd:"" help:"Manage deleted bookmarks"`
+	Log         LogCmd        `cmd:"" help:"Show the change log (SQLite backend only)"`
+	Undo        UndoCmd       `cmd:"" help:"Revert the most recent changes (SQLite backend only)"`
+	DB          DBCmd         `cmd:"" name:"db" help:"Back up, restore and check the database"`
+	Sync        SyncCmd       `cmd:"" help:"Merge bookmarks and browser profiles with another database"`
+	Export      ExportCmd     `cmd:"" help:"Export all data in a lossless, versioned format"`
+	Import      ImportCmd     `cmd:"" help:"Import data written by export"`
+	Path        string        `short:"p" default:"./bm.sqlite" help:"Path to the sqlite database or JSON file"`
+	Backend     string        `enum:"auto,sqlite,file" default:"auto" help:"Storage backend: sqlite, file, or auto to use file for a --path ending in .json"`
+	Git         bool          `help:"Commit every change to the git repository containing the file (file backend)"`
+	Timeout     time.Duration `help:"Abort the command after this duration, e.g. 30s (0 waits forever)"`
+	BusyTimeout time.Duration `default:"5s" help:"How long to wait for a database locked by another bm process"`
+	JSONErrors  bool          `name:"json-errors" help:"Print errors to stderr as JSON objects with code, message and details"`
+	Version     VersionCmd    `cmd:"" help:"Show version information"`
 }
 
 type VersionCmd struct {
@@ -35,8 +62,11 @@ func (c *VersionCmd) Run() error {
 	return nil
 }
 
+// Context is passed to every command. The embedded context is cancelled on
+// interrupt or when --timeout expires.
 type Context struct {
-	Repository Repository
+	context.Context
+	Repository bookmark.Repository
 }
 
 type AddCmd struct {
@@ -52,12 +82,83 @@ type DelCmd struct {
 }
 
 type UpdateCmd struct {
-	URL       string   `short:"u" help:"URL of the bookmark"`
-	Name      string   `short:"n" required:"" help:"Name of the bookmark (must be unique)"`
-	Tags      []string `short:"t" help:"Tags for the bookmark"`
-	Archive   bool     `short:"a" help:"Mark bookmark as archived"`
-	Unarchive bool     `help:"Mark bookmark as not archived"`
-	Browser   *string  `help:"Browser profile name; pass empty string to clear"`
+	URL          *string  `short:"u" placeholder:"STRING" help:"URL of the bookmark"`
+	Name         string   `short:"n" help:"Name of the bookmark (must be unique)"`
+	Tags         []string `short:"t" help:"Replace all tags of the bookmark"`
+	ClearTags    bool     `help:"Remove all tags of the bookmark"`
+	Archive      bool     `short:"a" help:"Mark bookmark as archived"`
+	Unarchive    bool     `help:"Mark bookmark as not archived"`
+	Browser      *string  `aliases:"set-browser" help:"Browser profile name; pass empty string to clear"`
+	WhereTag     string   `help:"Update all bookmarks with this tag or one of its descendants"`
+	WhereBrowser string   `help:"Update all bookmarks using this browser profile"`
+	WhereURLGlob string   `name:"where-url-glob" help:"Update all bookmarks whose host or URL matches this glob (e.g. *.oldcorp.com)"`
+	AddTag       []string `help:"Add a tag, keeping the existing ones; repeat for several"`
+	RemoveTag    []string `help:"Remove a tag, keeping its descendants; repeat for several"`
+	DryRun       bool     `help:"Check the update and print the bookmarks the --where-* filters match, without saving it"`
+}
+
+type TrashCmd struct {
+	Ls      TrashLsCmd      `cmd:"" help:"List deleted bookmarks"`
+	Restore TrashRestoreCmd `cmd:"" help:"Restore a deleted bookmark with its tags and browser profile"`
+	Purge   TrashPurgeCmd   `cmd:"" help:"Permanently delete bookmarks from the trash"`
+}
+
+type TrashLsCmd struct{}
+
+type TrashRestoreCmd struct {
+	Name string `short:"n" required:"" help:"Name of the bookmark to restore"`
+}
+
+type TrashPurgeCmd struct {
+	OlderThan string `default:"0s" help:"Only purge bookmarks deleted longer ago than this (e.g. 30d, 2w, 12h)"`
+}
+
+type DBCmd struct {
+	Backup  DBBackupCmd  `cmd:"" help:"Write a consistent copy of the database, safe while bm is in use"`
+	Restore DBRestoreCmd `cmd:"" help:"Replace all data with a backup"`
+	Check   DBCheckCmd   `cmd:"" help:"Check the database for corruption and dangling references"`
+	Vacuum  DBVacuumCmd  `cmd:"" help:"Rebuild the database file to reclaim unused space"`
+}
+
+type DBBackupCmd struct {
+	Dest string `arg:"" help:"Path of the backup file"`
+	Keep int    `default:"1" help:"Number of backups to keep; older ones are rotated to <dest>.1, <dest>.2, ..."`
+}
+
+type DBRestoreCmd struct {
+	Src string `arg:"" help:"Path of the backup file"`
+	Yes bool   `short:"y" help:"Do not ask for confirmation"`
+}
+
+type DBCheckCmd struct{}
+
+type DBVacuumCmd struct{}
+
+type SyncCmd struct {
+	With     string `required:"" type:"existingfile" help:"Database to sync with"`
+	Strategy string `enum:"newest,local,remote,interactive" default:"newest" help:"How to resolve edits made on both sides: newest, local, remote or interactive"`
+}
+
+type ExportCmd struct {
+	Format string `enum:"json" default:"json" help:"Output format (json)"`
+	Output string `short:"o" help:"Write to this file instead of stdout"`
+}
+
+type ImportCmd struct {
+	File   string `arg:"" help:"File written by export; - reads stdin"`
+	Format string `enum:"json" default:"json" help:"Input format (json)"`
+	Mode   string `enum:"merge,replace,skip-existing" default:"merge" help:"What to do with existing data: merge overwrites, replace deletes everything first, skip-existing keeps it"`
+	Yes    bool   `short:"y" help:"Do not ask for confirmation in replace mode"`
+}
+
+type LogCmd struct {
+	Name    string `short:"n" help:"Only show changes of this bookmark, browser profile or collection"`
+	Limit   int    `default:"20" help:"Maximum number of changes to show; 0 shows all"`
+	Verbose bool   `short:"v" help:"Show the state before and after every change"`
+}
+
+type UndoCmd struct {
+	Steps int `default:"1" help:"Number of commands to revert"`
 }
 
 type LsCmd struct {
@@ -66,24 +167,59 @@ type LsCmd struct {
 	IncludeArchived bool   `short:"a" default:"false" help:"Include archived bookmarks"`
 	ShowTags        bool   `short:"t" default:"false" help:"Show tags"`
 	ShowBrowser     bool   `short:"b" default:"false" help:"Show browser profile"`
+	Tag             string `help:"Only list bookmarks with this tag or one of its descendants"`
 }
 
 type OpenCmd struct {
-	Name string `short:"n" required:"" help:"Name of the bookmark to open"`
-	Wait bool   `help:"Wait for the browser command and report its exit status"`
-	Log  string `help:"Append browser command diagnostics to this file"`
+	Name       []string `short:"n" required:"" xor:"target" sep:"none" help:"Name of the bookmark to open; repeat to open several"`
+	Tag        string   `required:"" xor:"target" help:"Open every unarchived bookmark with this tag or one of its descendants"`
+	Collection string   `required:"" xor:"target" help:"Open every bookmark of this collection in order"`
+	Max        int      `default:"20" help:"Refuse to open more than this many bookmarks at once"`
+	Confirm    int      `default:"5" help:"Ask for confirmation when opening more than this many bookmarks"`
+	Yes        bool     `short:"y" help:"Do not ask for confirmation"`
+	Wait       bool     `help:"Wait for the browser command and report its exit status"`
+	Log        string   `help:"Append browser command diagnostics to this file"`
+	DryRun     bool     `help:"Print the browser commands and how their profiles were resolved instead of running them"`
+	Format     string   `enum:"shell,json" default:"shell" help:"Output format of --dry-run (shell, json)"`
 }
 
 type BrowserCmd struct {
-	Add BrowserAddCmd `cmd:"" help:"Add a browser profile"`
-	Del BrowserDelCmd `cmd:"" help:"Delete a browser profile"`
-	Ls  BrowserLsCmd  `cmd:"" help:"List browser profiles"`
+	Add      BrowserAddCmd      `cmd:"" help:"Add a browser profile"`
+	Upd      BrowserUpdCmd      `cmd:"" help:"Update a browser profile"`
+	Del      BrowserDelCmd      `cmd:"" help:"Delete a browser profile"`
+	Ls       BrowserLsCmd       `cmd:"" help:"List browser profiles"`
+	Default  BrowserDefaultCmd  `cmd:"" help:"Set or clear the default browser profile"`
+	Rule     BrowserRuleCmd     `cmd:"" help:"Manage rules routing bookmarks to browser profiles"`
+	Which    BrowserWhichCmd    `cmd:"" help:"Show which browser profile a URL would be opened with"`
+	Discover BrowserDiscoverCmd `cmd:"" help:"Find installed browsers and their profiles and offer to add them"`
+	Test     BrowserTestCmd     `cmd:"" help:"Check a browser profile and show the command it runs"`
+	Doctor   BrowserDoctorCmd   `cmd:"" help:"Check the binaries of all browser profiles"`
 }
 
 type BrowserAddCmd struct {
-	Name   string   `short:"n" required:"" help:"Profile name (e.g. zen-work)"`
-	Binary string   `short:"x" required:"" help:"Absolute path to the browser binary"`
-	Args   []string `help:"Arguments passed before the URL; repeat for each arg (e.g. --args=-p --args=work)"`
+	Name    string   `short:"n" required:"" help:"Profile name (e.g. zen-work)"`
+	Binary  string   `short:"x" required:"" help:"Absolute path to the browser binary"`
+	Resolve bool     `help:"Look up a --binary without a path in $PATH"`
+	Args    []string `help:"Arguments passed before the URL; repeat for each arg (e.g. --args=-p --args=work)"`
+	Env     []string `sep:"none" placeholder:"KEY=VALUE" help:"Environment variable for the browser, $VAR is expanded at launch; repeat for several"`
+	Dir     string   `help:"Working directory of the browser"`
+	Default bool     `help:"Use this profile for bookmarks without a profile, rule or tag default"`
+}
+
+type BrowserUpdCmd struct {
+	Name      string   `short:"n" required:"" help:"Profile name to update"`
+	Binary    *string  `short:"x" placeholder:"STRING" help:"Absolute path to the browser binary"`
+	Resolve   bool     `help:"Look up a --binary without a path in $PATH"`
+	Args      []string `help:"Replace the arguments passed before the URL; repeat for each arg"`
+	ClearArgs bool     `help:"Remove all arguments"`
+	Env       []string `sep:"none" placeholder:"KEY=VALUE" help:"Replace the environment variables; repeat for several"`
+	ClearEnv  bool     `help:"Remove all environment variables"`
+	Dir       *string  `placeholder:"STRING" help:"Working directory of the browser; pass empty string to clear"`
+}
+
+type BrowserDefaultCmd struct {
+	Name  string `short:"n" required:"" xor:"default" help:"Profile name to make the default"`
+	Clear bool   `required:"" xor:"default" help:"Clear the default profile"`
 }
 
 type BrowserDelCmd struct {
@@ -92,6 +228,114 @@ type BrowserDelCmd struct {
 
 type BrowserLsCmd struct{}
 
+type BrowserRuleCmd struct {
+	Add BrowserRuleAddCmd `cmd:"" help:"Add a routing rule"`
+	Del BrowserRuleDelCmd `cmd:"" help:"Delete a routing rule"`
+	Ls  BrowserRuleLsCmd  `cmd:"" help:"List routing rules in evaluation order"`
+}
+
+type BrowserRuleAddCmd struct {
+	Browser  string `short:"b" required:"" help:"Browser profile to route matching bookmarks to"`
+	Host     string `xor:"pattern" help:"Host glob (e.g. *.corp.example.com)"`
+	Regex    string `xor:"pattern" help:"Host regular expression (unanchored)"`
+	Tag      string `short:"t" help:"Only match bookmarks with this tag or one of its descendants"`
+	Position int    `help:"1-based position in the rule list; appends by default"`
+}
+
+type BrowserRuleDelCmd struct {
+	ID int64 `required:"" help:"ID of the rule to delete (see browser rule ls)"`
+}
+
+type BrowserRuleLsCmd struct{}
+
+type BrowserDiscoverCmd struct {
+	List bool `short:"l" help:"Only list what was found"`
+	Yes  bool `short:"y" help:"Add all found profiles without asking"`
+}
+
+type BrowserTestCmd struct {
+	Name   string `short:"n" required:"" help:"Profile name to test"`
+	Launch bool   `name:"run" help:"Open a local test page with the profile"`
+}
+
+type BrowserDoctorCmd struct{}
+
+type BrowserWhichCmd struct {
+	URL  string   `arg:"" help:"URL to route"`
+	Tags []string `short:"t" help:"Tags the bookmark would carry"`
+}
+
+type TagCmd struct {
+	Ls      TagLsCmd      `cmd:"" help:"List tags with their bookmark counts"`
+	Rename  TagRenameCmd  `cmd:"" help:"Rename a tag together with all of its descendants"`
+	Browser TagBrowserCmd `cmd:"" help:"Manage default browser profiles of tags"`
+}
+
+type TagBrowserCmd struct {
+	Set   TagBrowserSetCmd   `cmd:"" help:"Set the default browser profile of a tag and its descendants"`
+	Unset TagBrowserUnsetCmd `cmd:"" help:"Clear the default browser profile of a tag"`
+	Ls    TagBrowserLsCmd    `cmd:"" help:"List tags with a default browser profile"`
+}
+
+type TagBrowserSetCmd struct {
+	Tag     string `short:"t" required:"" help:"Tag (e.g. work)"`
+	Browser string `short:"b" required:"" help:"Browser profile name"`
+}
+
+type TagBrowserUnsetCmd struct {
+	Tag string `short:"t" required:"" help:"Tag (e.g. work)"`
+}
+
+type TagBrowserLsCmd struct{}
+
+type TagLsCmd struct {
+	Tree            bool `help:"Render the tag hierarchy with aggregate counts"`
+	IncludeArchived bool `short:"a" default:"false" help:"Include archived bookmarks"`
+}
+
+type TagRenameCmd struct {
+	From string `required:"" help:"Tag to rename (e.g. work/infra)"`
+	To   string `required:"" help:"New tag name (e.g. job/infra)"`
+}
+
+type CollectionCmd struct {
+	Create CollectionCreateCmd `cmd:"" help:"Create a collection"`
+	Del    CollectionDelCmd    `cmd:"" help:"Delete a collection (its bookmarks are kept)"`
+	Ls     CollectionLsCmd     `cmd:"" help:"List collections or the members of one collection"`
+	Add    CollectionAddCmd    `cmd:"" help:"Add a bookmark to a collection"`
+	Rm     CollectionRmCmd     `cmd:"" help:"Remove a bookmark from a collection"`
+	Mv     CollectionMvCmd     `cmd:"" help:"Move a bookmark to another position in a collection"`
+}
+
+type CollectionCreateCmd struct {
+	Name string `short:"n" required:"" help:"Collection name (e.g. onboarding)"`
+}
+
+type CollectionDelCmd struct {
+	Name string `short:"n" required:"" help:"Collection name to delete"`
+}
+
+type CollectionLsCmd struct {
+	Name string `short:"n" help:"List the members of this collection in order"`
+}
+
+type CollectionAddCmd struct {
+	Name     string `short:"n" required:"" help:"Collection name"`
+	Bookmark string `short:"b" required:"" help:"Name of the bookmark to add"`
+	Position int    `help:"1-based position to insert at; appends by default"`
+}
+
+type CollectionRmCmd struct {
+	Name     string `short:"n" required:"" help:"Collection name"`
+	Bookmark string `short:"b" required:"" help:"Name of the bookmark to remove"`
+}
+
+type CollectionMvCmd struct {
+	Name     string `short:"n" required:"" help:"Collection name"`
+	Bookmark string `short:"b" required:"" help:"Name of the bookmark to move"`
+	Position int    `required:"" help:"New 1-based position"`
+}
+
 func (c *LsCmd) Validate() error {
 	if utf8.RuneCountInString(c.Separator) != 1 {
 		return fmt.Errorf("separator must be exactly one character, got %d", utf8.RuneCountInString(c.Separator))
@@ -99,18 +343,72 @@ func (c *LsCmd) Validate() error {
 	return nil
 }
 
+func (c *TrashPurgeCmd) Validate() error {
+	_, err := parseAge(c.OlderThan)
+	return err
+}
+
 func (c *UpdateCmd) Validate() error {
 	if c.Archive && c.Unarchive {
 		return fmt.Errorf("--archive and --unarchive are mutually exclusive")
 	}
-	if c.URL == "" && !c.Archive && !c.Unarchive && len(c.Tags) == 0 && c.Browser == nil {
-		return fmt.Errorf("at least one of --url, --tags, --archive, --unarchive, or --browser must be specified")
+	if c.bulk() {
+		if c.Name != "" {
+			return fmt.Errorf("--name cannot be combined with --where-* filters")
+		}
+		if c.URL != nil || len(c.Tags) > 0 || c.ClearTags {
+			return fmt.Errorf("--url, --tags and --clear-tags cannot be used with --where-* filters, use --add-tag and --remove-tag")
+		}
+		if c.DryRun {
+			return nil
+		}
+		if c.patch().IsEmpty() {
+			return fmt.Errorf("at least one of --add-tag, --remove-tag, --archive, --unarchive, --set-browser or --dry-run must be specified")
+		}
+		return c.patch().Validate()
+	}
+	if c.Name == "" {
+		return fmt.Errorf("either --name or at least one of --where-tag, --where-browser or --where-url-glob must be specified")
 	}
-	return nil
+	if c.DryRun {
+		return fmt.Errorf("--dry-run requires --where-* filters")
+	}
+	if c.ClearTags && len(c.Tags) > 0 {
+		return fmt.Errorf("--tags and --clear-tags are mutually exclusive")
+	}
+	if c.patch().IsEmpty() {
+		return fmt.Errorf("at least one of --url, --tags, --clear-tags, --add-tag, --remove-tag, --archive, --unarchive, or --browser must be specified")
+	}
+	return c.patch().Validate()
+}
+
+// bulk reports whether the command updates all bookmarks matching filters.
+func (c *UpdateCmd) bulk() bool {
+	return c.WhereTag != "" || c.WhereBrowser != "" || c.WhereURLGlob != ""
+}
+
+// patch translates the flags into the changes to apply.
+func (c *UpdateCmd) patch() bookmark.BookmarkPatch {
+	p := bookmark.BookmarkPatch{
+		URL:         c.URL,
+		AddTags:     c.AddTag,
+		RemoveTags:  c.RemoveTag,
+		BrowserName: c.Browser,
+	}
+	if len(c.Tags) > 0 {
+		p.Tags = &c.Tags
+	} else if c.ClearTags {
+		p.Tags = &[]string{}
+	}
+	if c.Archive || c.Unarchive {
+		archived := c.Archive
+		p.Archived = &archived
+	}
+	return p
 }
 
 func (c *AddCmd) Run(ctx *Context) error {
-	return ctx.Repository.Add(Bookmark{
+	return ctx.Repository.Add(ctx, bookmark.Bookmark{
 		Name:        c.Name,
 		URL:         c.URL,
 		Tags:        c.Tags,
@@ -120,7 +418,13 @@ func (c *AddCmd) Run(ctx *Context) error {
 }
 
 func (c *LsCmd) Run(ctx *Context) error {
-	bookmarks, err := ctx.Repository.Ls(c.IncludeArchived)
+	var bookmarks []bookmark.Bookmark
+	var err error
+	if c.Tag != "" {
+		bookmarks, err = ctx.Repository.LsByTag(ctx, c.Tag, c.IncludeArchived)
+	} else {
+		bookmarks, err = ctx.Repository.Ls(ctx, c.IncludeArchived)
+	}
 	if err != nil {
 		return err
 	}
@@ -148,118 +452,962 @@ func (c *LsCmd) Run(ctx *Context) error {
 }
 
 func (c *DelCmd) Run(ctx *Context) error {
-	return ctx.Repository.Del(c.Name)
+	return ctx.Repository.Del(ctx, c.Name)
+}
+
+func (c *TrashLsCmd) Run(ctx *Context) error {
+	bookmarks, err := ctx.Repository.Trash(ctx)
+	if err != nil {
+		return err
+	}
+	for _, bm := range bookmarks {
+		fmt.Printf("%s\t%s\t%s\n", bm.Name, bm.URL, bm.DeletedAt.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+func (c *TrashRestoreCmd) Run(ctx *Context) error {
+	return ctx.Repository.Restore(ctx, c.Name)
+}
+
+func (c *TrashPurgeCmd) Run(ctx *Context) error {
+	age, err := parseAge(c.OlderThan)
+	if err != nil {
+		return err
+	}
+	n, err := ctx.Repository.Purge(ctx, time.Now().Add(-age))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d bookmarks\n", n)
+	return nil
+}
+
+// parseAge parses a duration like time.ParseDuration, additionally accepting
+// whole days (30d) and weeks (2w).
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// maintainer returns the repository if it supports database maintenance.
+func maintainer(ctx *Context) (bookmark.Maintainer, error) {
+	m, ok := ctx.Repository.(bookmark.Maintainer)
+	if !ok {
+		return nil, fmt.Errorf("the database does not support maintenance commands")
+	}
+	return m, nil
+}
+
+func (c *DBBackupCmd) Validate() error {
+	if c.Keep < 1 {
+		return fmt.Errorf("--keep must be at least 1")
+	}
+	return nil
+}
+
+func (c *DBBackupCmd) Run(ctx *Context) error {
+	m, err := maintainer(ctx)
+	if err != nil {
+		return err
+	}
+	return m.Backup(ctx, c.Dest, c.Keep)
+}
+
+func (c *DBRestoreCmd) Run(ctx *Context) error {
+	m, err := maintainer(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.Yes {
+		ok, err := confirm(ctx, fmt.Sprintf("Replace all bookmarks with the contents of %s?", c.Src))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
+	}
+	return m.RestoreFrom(ctx, c.Src)
+}
+
+func (c *DBCheckCmd) Run(ctx *Context) error {
+	m, err := maintainer(ctx)
+	if err != nil {
+		return err
+	}
+	problems, err := m.Check(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func (c *DBVacuumCmd) Run(ctx *Context) error {
+	m, err := maintainer(ctx)
+	if err != nil {
+		return err
+	}
+	return m.Vacuum(ctx)
+}
+
+func (c *SyncCmd) Run(ctx *Context) error {
+	s, ok := ctx.Repository.(bookmark.Syncer)
+	if !ok {
+		return fmt.Errorf("the database does not support sync")
+	}
+	var resolve bookmark.SyncResolver
+	if c.Strategy == string(bookmark.SyncInteractive) {
+		resolve = func(conflict bookmark.SyncConflict) (bool, error) {
+			return resolveConflict(ctx, conflict)
+		}
+	}
+	result, err := s.Sync(ctx, c.With, bookmark.SyncStrategy(c.Strategy), resolve)
+	if err != nil {
+		return err
+	}
+	for _, conflict := range result.Conflicts {
+		fmt.Printf("conflict on %s %q\n", conflict.Entity, conflict.Name)
+	}
+	fmt.Printf("%d pulled, %d pushed, %d conflicts\n", result.Pulled, result.Pushed, len(result.Conflicts))
+	return nil
+}
+
+// resolveConflict shows both versions of a conflicting entity and asks
+// which one to keep.
+func resolveConflict(ctx context.Context, c bookmark.SyncConflict) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s %q changed on both sides\n", c.Entity, c.Name)
+	for _, side := range []struct {
+		label    string
+		snapshot json.RawMessage
+		at       time.Time
+	}{{"local", c.Local, c.LocalAt}, {"remote", c.Remote, c.RemoteAt}} {
+		version := "deleted"
+		if side.snapshot != nil {
+			version = string(side.snapshot)
+		}
+		when := "unknown time"
+		if !side.at.IsZero() {
+			when = side.at.Format(time.DateTime)
+		}
+		fmt.Fprintf(os.Stderr, "  %-6s (%s): %s\n", side.label, when, version)
+	}
+	for {
+		answer, err := prompt(ctx, "Keep [l]ocal or [r]emote?")
+		if err != nil {
+			return false, err
+		}
+		switch answer {
+		case "l", "local":
+			return false, nil
+		case "r", "remote":
+			return true, nil
+		case "":
+			return false, fmt.Errorf("aborted")
+		}
+	}
+}
+
+func (c *ExportCmd) Run(ctx *Context) error {
+	dump, err := ctx.Repository.Export(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if c.Output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(c.Output, data, 0o600)
+}
+
+func (c *ImportCmd) Validate() error {
+	if c.Mode == string(bookmark.ImportReplace) && c.File == "-" && !c.Yes {
+		return fmt.Errorf("--mode replace reading from stdin requires --yes")
+	}
+	return nil
+}
+
+func (c *ImportCmd) Run(ctx *Context) error {
+	var data []byte
+	var err error
+	if c.File == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(c.File)
+	}
+	if err != nil {
+		return err
+	}
+	var dump bookmark.Dump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return fmt.Errorf("decoding %s: %w", c.File, err)
+	}
+
+	if c.Mode == string(bookmark.ImportReplace) && !c.Yes {
+		ok, err := confirm(ctx, "Delete all bookmarks, browser profiles and collections before importing?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	result, err := ctx.Repository.Import(ctx, dump, bookmark.ImportMode(c.Mode))
+	if err != nil {
+		return err
+	}
+	for _, conflict := range result.Conflicts {
+		if c.Mode == string(bookmark.ImportSkipExisting) {
+			fmt.Printf("kept local %s\n", conflict)
+		} else {
+			fmt.Printf("overwrote %s\n", conflict)
+		}
+	}
+	fmt.Printf("%d added, %d updated, %d skipped, %d unchanged\n",
+		result.Added, result.Updated, result.Skipped, result.Unchanged)
+	return nil
+}
+
+func (c *LogCmd) Run(ctx *Context) error {
+	changes, err := ctx.Repository.Changes(ctx, c.Name, c.Limit)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		undone := ""
+		if change.Undone {
+			undone = "\t(undone)"
+		}
+		fmt.Printf("#%d\t%s\t%s@%s\t%s\t%s\t%s%s\n",
+			change.ID, change.At.Format(time.DateTime), change.User, change.Host,
+			change.Op, change.Entity, change.Name, undone)
+		if c.Verbose {
+			fmt.Printf("\tbefore: %s\n\tafter:  %s\n", snapshotString(change.Before), snapshotString(change.After))
+		}
+	}
+	return nil
+}
+
+func snapshotString(snapshot []byte) string {
+	if snapshot == nil {
+		return "-"
+	}
+	return string(snapshot)
+}
+
+func (c *UndoCmd) Run(ctx *Context) error {
+	changes, err := ctx.Repository.Undo(ctx, c.Steps)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("undone #%d: %s %s %q\n", change.ID, change.Op, change.Entity, change.Name)
+	}
+	return nil
 }
 
 func (c *UpdateCmd) Run(ctx *Context) error {
-	updateArchived := c.Archive || c.Unarchive
-	archived := c.Archive && !c.Unarchive
-	browserName := ""
-	if c.Browser != nil {
-		browserName = *c.Browser
+	if c.bulk() {
+		return c.runBulk(ctx)
 	}
-	return ctx.Repository.Update(
-		Bookmark{Name: c.Name, URL: c.URL, Tags: c.Tags, Archived: archived, BrowserName: browserName},
-		updateArchived,
-		c.Browser != nil,
-	)
+	return ctx.Repository.Update(ctx, c.Name, c.patch())
 }
 
-func (c *OpenCmd) Run(ctx *Context) error {
-	bm, err := ctx.Repository.Get(c.Name)
+func (c *UpdateCmd) runBulk(ctx *Context) error {
+	filter := bookmark.Filter{Tag: c.WhereTag, BrowserName: c.WhereBrowser, URLGlob: c.WhereURLGlob}
+	bookmarks, err := ctx.Repository.UpdateWhere(ctx, filter, c.patch(), c.DryRun)
 	if err != nil {
 		return err
 	}
+	for _, bm := range bookmarks {
+		fmt.Printf("%s|%s\n", bm.Name, bm.URL)
+	}
+	if c.DryRun {
+		fmt.Printf("%d bookmarks would be updated\n", len(bookmarks))
+	} else {
+		fmt.Printf("%d bookmarks updated\n", len(bookmarks))
+	}
+	return nil
+}
 
-	if bm.BrowserName == "" {
-		return openDefault(bm.URL, c.Wait, c.Log)
+func (c *OpenCmd) Run(ctx *Context) error {
+	bookmarks, err := c.bookmarks(ctx)
+	if err != nil {
+		return err
+	}
+	if len(bookmarks) == 0 {
+		return fmt.Errorf("no bookmarks to open")
+	}
+	if len(bookmarks) > c.Max {
+		return fmt.Errorf("refusing to open %d bookmarks, the limit is %d (see --max)", len(bookmarks), c.Max)
+	}
+	if len(bookmarks) > c.Confirm && !c.Yes && !c.DryRun {
+		ok, err := confirm(ctx, fmt.Sprintf("Open %d bookmarks?", len(bookmarks)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
 	}
 
-	browser, err := ctx.Repository.GetBrowser(bm.BrowserName)
+	commands, err := c.plan(ctx, bookmarks)
 	if err != nil {
 		return err
 	}
+	if c.DryRun {
+		return printLaunchCommands(os.Stdout, commands, c.Format)
+	}
+	for _, command := range commands {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opts := c.launchOptions()
+		opts.Env = command.Env
+		opts.Dir = command.Dir
+		if err := launch.Run(command.Argv[0], command.Argv[1:], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bookmarks resolves the bookmarks selected by --name, --tag or --collection
+// in the order they were given.
+func (c *OpenCmd) bookmarks(ctx *Context) ([]bookmark.Bookmark, error) {
+	if c.Tag != "" {
+		return ctx.Repository.LsByTag(ctx, c.Tag, false)
+	}
+
+	names := c.Name
+	if c.Collection != "" {
+		collection, err := ctx.Repository.GetCollection(ctx, c.Collection)
+		if err != nil {
+			return nil, err
+		}
+		names = collection.Bookmarks
+	}
+
+	var bookmarks []bookmark.Bookmark
+	for _, name := range names {
+		if slices.ContainsFunc(bookmarks, func(bm bookmark.Bookmark) bool { return bm.Name == name }) {
+			continue
+		}
+		bm, err := ctx.Repository.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, bm)
+	}
+	return bookmarks, nil
+}
+
+// resolveBrowsers assigns the resolved browser profile to every bookmark,
+// records the resolution chain in the diagnostics log and returns it by
+// bookmark name.
+func (c *OpenCmd) resolveBrowsers(ctx *Context, bookmarks []bookmark.Bookmark) (map[string][]string, error) {
+	resolver, err := bookmark.NewBrowserResolver(ctx, ctx.Repository)
+	if err != nil {
+		return nil, err
+	}
+	resolutions := map[string][]string{}
+	for i, bm := range bookmarks {
+		browser, steps, err := resolver.Resolve(bm)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks[i].BrowserName = browser
+		resolutions[bm.Name] = steps
+		if err := launch.AppendLog(c.Log, "resolve %q: %s\n", bm.Name, strings.Join(steps, " -> ")); err != nil {
+			return nil, err
+		}
+	}
+	return resolutions, nil
+}
+
+type browserGroup struct {
+	browserName string
+	bookmarks   []bookmark.Bookmark
+}
+
+// groupByBrowser batches bookmarks sharing a browser profile so that each
+// profile is launched once with all of its URLs, unless its arguments have
+// placeholders. Groups keep the order in which their profiles first appear.
+func groupByBrowser(bookmarks []bookmark.Bookmark) []browserGroup {
+	var groups []browserGroup
+	index := map[string]int{}
+	for _, bm := range bookmarks {
+		i, ok := index[bm.BrowserName]
+		if !ok {
+			i = len(groups)
+			index[bm.BrowserName] = i
+			groups = append(groups, browserGroup{browserName: bm.BrowserName})
+		}
+		groups[i].bookmarks = append(groups[i].bookmarks, bm)
+	}
+	return groups
+}
+
+// launchCommand is a browser command that opens bookmarks.
+type launchCommand struct {
+	// Browser is the browser profile; empty for the OS default browser.
+	Browser   string             `json:"browser"`
+	Bookmarks []resolvedBookmark `json:"bookmarks"`
+	Argv      []string           `json:"argv"`
+	// Env and Dir are unexpanded, as stored in the browser profile.
+	Env []string `json:"env,omitempty"`
+	Dir string   `json:"dir,omitempty"`
+}
+
+// resolvedBookmark is a bookmark with the steps that chose its browser
+// profile.
+type resolvedBookmark struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Resolution []string `json:"resolution"`
+}
+
+// plan resolves the browser profiles of bookmarks and returns the commands
+// that open them, falling back to the OS default browser for bookmarks
+// without a profile.
+func (c *OpenCmd) plan(ctx *Context, bookmarks []bookmark.Bookmark) ([]launchCommand, error) {
+	resolutions, err := c.resolveBrowsers(ctx, bookmarks)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []launchCommand
+	for _, group := range groupByBrowser(bookmarks) {
+		resolved := make([]resolvedBookmark, len(group.bookmarks))
+		urls := make([]string, len(group.bookmarks))
+		for i, bm := range group.bookmarks {
+			resolved[i] = resolvedBookmark{Name: bm.Name, URL: bm.URL, Resolution: resolutions[bm.Name]}
+			urls[i] = bm.URL
+		}
+
+		var browser bookmark.Browser
+		var argvs [][]string
+		if group.browserName == "" {
+			if argvs, err = launch.DefaultCommands(urls); err != nil {
+				return nil, err
+			}
+		} else {
+			if browser, err = ctx.Repository.GetBrowser(ctx, group.browserName); err != nil {
+				return nil, err
+			}
+			for _, args := range browser.Commands(group.bookmarks) {
+				argvs = append(argvs, append([]string{browser.Path}, args...))
+			}
+		}
+
+		for i, argv := range argvs {
+			// Either every bookmark has a command of its own or one
+			// command opens them all.
+			opened := resolved
+			if len(argvs) == len(resolved) && len(argvs) > 1 {
+				opened = resolved[i : i+1]
+			}
+			commands = append(commands, launchCommand{
+				Browser:   browser.Name,
+				Bookmarks: opened,
+				Argv:      argv,
+				Env:       browser.Env,
+				Dir:       browser.Dir,
+			})
+		}
+	}
+	return commands, nil
+}
+
+// printLaunchCommands writes commands to w, as a shell script or as JSON
+// with Env and Dir expanded.
+func printLaunchCommands(w io.Writer, commands []launchCommand, format string) error {
+	if format == "json" {
+		expanded := make([]launchCommand, len(commands))
+		for i, command := range commands {
+			command.Env = launch.ExpandEnv(command.Env)
+			command.Dir = os.ExpandEnv(command.Dir)
+			expanded[i] = command
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(expanded)
+	}
+
+	for _, command := range commands {
+		for _, bm := range command.Bookmarks {
+			fmt.Fprintf(w, "# %s: %s\n", bm.Name, strings.Join(bm.Resolution, " -> "))
+		}
+		line := shellJoin(command.Argv)
+		if len(command.Env) > 0 {
+			line = "env " + shellJoin(launch.ExpandEnv(command.Env)) + " " + line
+		}
+		if command.Dir != "" {
+			line = "(cd " + shellQuote(os.ExpandEnv(command.Dir)) + " && " + line + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// shellJoin quotes args for a POSIX shell and joins them with spaces.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for a POSIX shell unless it only has characters that
+// need no quoting.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (c *OpenCmd) launchOptions() launch.Options {
+	return launch.Options{Wait: c.Wait, Log: c.Log}
+}
+
+// confirm asks a yes/no question on stderr. It gives up when ctx is done
+// since a pending read on stdin cannot be interrupted.
+func confirm(ctx context.Context, question string) (bool, error) {
+	answer, err := prompt(ctx, question+" [y/N]")
+	if err != nil {
+		return false, err
+	}
+	return answer == "y" || answer == "yes", nil
+}
+
+// stdin is shared by all prompts so input buffered for one answer is not
+// lost for the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt asks question on stderr and returns the lowercased answer. It
+// returns an empty answer at the end of the input.
+func prompt(ctx context.Context, question string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s ", question)
+	type result struct {
+		answer string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		answer, err := stdin.ReadString('\n')
+		done <- result{answer, err}
+	}()
 
-	args := append(browser.Args, bm.URL)
-	return runBrowserCommand(browser.Path, args, c.Wait, c.Log)
+	var res result
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return "", ctx.Err()
+	case res = <-done:
+	}
+	if res.err != nil && !errors.Is(res.err, io.EOF) {
+		return "", res.err
+	}
+	return strings.ToLower(strings.TrimSpace(res.answer)), nil
 }
 
 func (c *BrowserAddCmd) Run(ctx *Context) error {
-	return ctx.Repository.AddBrowser(Browser{Name: c.Name, Path: c.Binary, Args: c.Args})
+	path, err := checkBinary(c.Binary, c.Resolve)
+	if err != nil {
+		return err
+	}
+	return ctx.Repository.AddBrowser(ctx, bookmark.Browser{
+		Name:    c.Name,
+		Path:    path,
+		Args:    c.Args,
+		Env:     c.Env,
+		Dir:     c.Dir,
+		Default: c.Default,
+	})
+}
+
+func (c *BrowserUpdCmd) Validate() error {
+	return c.patch().Validate()
+}
+
+func (c *BrowserUpdCmd) patch() bookmark.BrowserPatch {
+	p := bookmark.BrowserPatch{Path: c.Binary, Dir: c.Dir}
+	if len(c.Args) > 0 {
+		p.Args = &c.Args
+	} else if c.ClearArgs {
+		p.Args = &[]string{}
+	}
+	if len(c.Env) > 0 {
+		p.Env = &c.Env
+	} else if c.ClearEnv {
+		p.Env = &[]string{}
+	}
+	return p
+}
+
+func (c *BrowserUpdCmd) Run(ctx *Context) error {
+	p := c.patch()
+	if p.Path != nil {
+		path, err := checkBinary(*p.Path, c.Resolve)
+		if err != nil {
+			return err
+		}
+		p.Path = &path
+	}
+	return ctx.Repository.UpdateBrowser(ctx, c.Name, p)
+}
+
+// checkBinary verifies a --binary, looking it up in $PATH with resolve, and
+// returns its absolute path.
+func checkBinary(binary string, resolve bool) (string, error) {
+	if resolve {
+		return launch.ResolveBinary(binary)
+	}
+	if err := launch.CheckBinary(binary); err != nil {
+		if !filepath.IsAbs(binary) {
+			return "", fmt.Errorf("%w, use --resolve to look it up in $PATH", err)
+		}
+		return "", err
+	}
+	return binary, nil
+}
+
+func (c *BrowserDefaultCmd) Run(ctx *Context) error {
+	return ctx.Repository.SetDefaultBrowser(ctx, c.Name)
 }
 
 func (c *BrowserDelCmd) Run(ctx *Context) error {
-	return ctx.Repository.DelBrowser(c.Name)
+	return ctx.Repository.DelBrowser(ctx, c.Name)
 }
 
 func (c *BrowserLsCmd) Run(ctx *Context) error {
-	browsers, err := ctx.Repository.LsBrowsers()
+	browsers, err := ctx.Repository.LsBrowsers(ctx)
 	if err != nil {
 		return err
 	}
 	for _, b := range browsers {
-		if len(b.Args) > 0 {
-			fmt.Printf("%s\t%s %s\n", b.Name, b.Path, strings.Join(b.Args, " "))
-		} else {
-			fmt.Printf("%s\t%s\n", b.Name, b.Path)
+		line := b.Name + "\t" + strings.Join(append([]string{b.Path}, b.Args...), " ")
+		if len(b.Env) > 0 {
+			line += "\tenv: " + strings.Join(b.Env, " ")
 		}
+		if b.Dir != "" {
+			line += "\tdir: " + b.Dir
+		}
+		if b.Default {
+			line += "\t(default)"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func (c *TagLsCmd) Run(ctx *Context) error {
+	bookmarks, err := ctx.Repository.Ls(ctx, c.IncludeArchived)
+	if err != nil {
+		return err
+	}
+	if c.Tree {
+		printTagTree(bookmark.BuildTagTree(bookmarks), 0)
+		return nil
+	}
+
+	counts := map[string]int{}
+	for _, bm := range bookmarks {
+		for _, tag := range bm.Tags {
+			counts[tag]++
+		}
+	}
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		fmt.Printf("%s\t%d\n", tag, counts[tag])
 	}
 	return nil
 }
 
-// openDefault opens a URL using the OS default browser.
-func openDefault(url string, wait bool, logPath string) error {
-	switch runtime.GOOS {
-	case "darwin":
-		return runBrowserCommand("open", []string{url}, wait, logPath)
-	case "linux":
-		return runBrowserCommand("xdg-open", []string{url}, wait, logPath)
-	default:
-		return fmt.Errorf("unsupported platform %s: assign a browser profile to this bookmark", runtime.GOOS)
+func printTagTree(nodes []*bookmark.TagNode, depth int) {
+	for _, n := range nodes {
+		fmt.Printf("%s%s (%d)\n", strings.Repeat("  ", depth), n.Name, n.Count)
+		printTagTree(n.Children, depth+1)
 	}
 }
 
-func runBrowserCommand(path string, args []string, wait bool, logPath string) error {
-	cmd := exec.Command(path, args...)
+func (c *TagRenameCmd) Run(ctx *Context) error {
+	return ctx.Repository.RenameTag(ctx, c.From, c.To)
+}
+
+func (c *TagBrowserSetCmd) Run(ctx *Context) error {
+	return ctx.Repository.SetTagBrowser(ctx, c.Tag, c.Browser)
+}
 
-	logf, err := openLogFile(logPath)
+func (c *TagBrowserUnsetCmd) Run(ctx *Context) error {
+	return ctx.Repository.SetTagBrowser(ctx, c.Tag, "")
+}
+
+func (c *TagBrowserLsCmd) Run(ctx *Context) error {
+	tagBrowsers, err := ctx.Repository.LsTagBrowsers(ctx)
 	if err != nil {
 		return err
 	}
-	if logf != nil {
-		defer func() { _ = logf.Close() }()
-		_, _ = fmt.Fprintf(logf, "command: %q\n", append([]string{path}, args...))
-		_, _ = fmt.Fprintf(logf, "wait: %t\n", wait)
+	tags := make([]string, 0, len(tagBrowsers))
+	for tag := range tagBrowsers {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		fmt.Printf("%s\t%s\n", tag, tagBrowsers[tag])
 	}
+	return nil
+}
 
-	if wait {
-		// executes cmd and waits for it to finish
-		output, err := cmd.CombinedOutput()
-		if logf != nil {
-			if len(output) > 0 {
-				_, _ = fmt.Fprintf(logf, "output:\n%s\n", output)
-			}
-			_, _ = fmt.Fprintf(logf, "exit error: %v\n\n", err)
+func (c *CollectionCreateCmd) Run(ctx *Context) error {
+	return ctx.Repository.AddCollection(ctx, c.Name)
+}
+
+func (c *CollectionDelCmd) Run(ctx *Context) error {
+	return ctx.Repository.DelCollection(ctx, c.Name)
+}
+
+func (c *CollectionLsCmd) Run(ctx *Context) error {
+	if c.Name != "" {
+		collection, err := ctx.Repository.GetCollection(ctx, c.Name)
+		if err != nil {
+			return err
 		}
+		for i, name := range collection.Bookmarks {
+			fmt.Printf("%d\t%s\n", i+1, name)
+		}
+		return nil
+	}
+
+	collections, err := ctx.Repository.LsCollections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		fmt.Printf("%s\t%d\n", collection.Name, len(collection.Bookmarks))
+	}
+	return nil
+}
+
+func (c *CollectionAddCmd) Run(ctx *Context) error {
+	return ctx.Repository.AddToCollection(ctx, c.Name, c.Bookmark, c.Position)
+}
+
+func (c *CollectionRmCmd) Run(ctx *Context) error {
+	return ctx.Repository.RemoveFromCollection(ctx, c.Name, c.Bookmark)
+}
+
+func (c *CollectionMvCmd) Run(ctx *Context) error {
+	return ctx.Repository.MoveInCollection(ctx, c.Name, c.Bookmark, c.Position)
+}
+
+func (c *BrowserRuleAddCmd) Run(ctx *Context) error {
+	rule := bookmark.Rule{Host: c.Host, Tag: c.Tag, BrowserName: c.Browser}
+	if c.Regex != "" {
+		rule.Host, rule.Regex = c.Regex, true
+	}
+	id, err := ctx.Repository.AddRule(ctx, rule, c.Position)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added rule %d\n", id)
+	return nil
+}
+
+func (c *BrowserRuleDelCmd) Run(ctx *Context) error {
+	return ctx.Repository.DelRule(ctx, c.ID)
+}
+
+func (c *BrowserRuleLsCmd) Run(ctx *Context) error {
+	rules, err := ctx.Repository.LsRules(ctx)
+	if err != nil {
+		return err
+	}
+	for i, rule := range rules {
+		fmt.Printf("%d\t#%d\t%s\t%s\n", i+1, rule.ID, rule, rule.BrowserName)
+	}
+	return nil
+}
+
+func (c *BrowserDiscoverCmd) Run(ctx *Context) error {
+	found, err := discover.Browsers(discover.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.Repository.LsBrowsers(ctx)
+	if err != nil {
 		return err
 	}
+	suggestions := discover.Suggest(found)
+	if len(suggestions) == 0 {
+		fmt.Fprintln(os.Stderr, "no browsers found")
+		return nil
+	}
+
+	for _, b := range suggestions {
+		command := strings.Join(append([]string{b.Path}, b.Args...), " ")
+		if slices.ContainsFunc(existing, func(e bookmark.Browser) bool {
+			return e.Name == b.Name || (e.Path == b.Path && slices.Equal(e.Args, b.Args))
+		}) {
+			fmt.Printf("%s\t%s\t(exists)\n", b.Name, command)
+			continue
+		}
+		if c.List {
+			fmt.Printf("%s\t%s\n", b.Name, command)
+			continue
+		}
+		if !c.Yes {
+			ok, err := confirm(ctx, fmt.Sprintf("Add browser profile %s (%s)?", b.Name, command))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if err := ctx.Repository.AddBrowser(ctx, b); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\t(added)\n", b.Name, command)
+	}
+	return nil
+}
 
-	// executes cmd and return immediately
-	if err := cmd.Start(); err != nil {
-		if logf != nil {
-			_, _ = fmt.Fprintf(logf, "start error: %v\n\n", err)
+func (c *BrowserTestCmd) Run(ctx *Context) error {
+	browser, err := ctx.Repository.GetBrowser(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	// Without --run the page is never written, so show where it would go.
+	page := filepath.Join(os.TempDir(), testPagePattern)
+	if c.Launch {
+		html := fmt.Sprintf("<!DOCTYPE html>\n<title>bm</title>\n<p>Opened by bm with browser profile %s.</p>\n", template.HTMLEscapeString(browser.Name))
+		page, err = writeTestPage(html)
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if err := os.Remove(page); err != nil {
+				log.Printf("error removing test page: %v", err)
+			}
+		}()
+	}
+	url := "file://" + filepath.ToSlash(page)
+	args := browser.Commands([]bookmark.Bookmark{{Name: "bm-test", URL: url}})[0]
+	fmt.Printf("argv: %q\n", append([]string{browser.Path}, args...))
+	if len(browser.Env) > 0 {
+		fmt.Printf("env: %q\n", launch.ExpandEnv(browser.Env))
+	}
+	if browser.Dir != "" {
+		fmt.Printf("dir: %s\n", os.ExpandEnv(browser.Dir))
+	}
+	if err := launch.CheckBinary(browser.Path); err != nil {
+		return err
+	}
+	fmt.Println("binary: ok")
+	if !c.Launch {
+		return nil
+	}
+	if err := launch.Run(browser.Path, args, launch.Options{Env: browser.Env, Dir: browser.Dir}); err != nil {
+		return err
+	}
+	// The browser starts in the background; give it time to load the page
+	// before it is removed.
+	select {
+	case <-time.After(testPageLifetime):
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+const (
+	testPagePattern  = "bm-browser-test-*.html"
+	testPageLifetime = 5 * time.Second
+)
+
+// writeTestPage writes html to a new file in the temporary directory and
+// returns its path. The name is random, so other users cannot plant or
+// replace the page.
+func writeTestPage(html string) (string, error) {
+	f, err := os.CreateTemp("", testPagePattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(html)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (c *BrowserDoctorCmd) Run(ctx *Context) error {
+	browsers, err := ctx.Repository.LsBrowsers(ctx)
+	if err != nil {
 		return err
 	}
-	if logf != nil {
-		_, _ = fmt.Fprintf(logf, "pid: %d\n\n", cmd.Process.Pid)
+	failed := 0
+	for _, b := range browsers {
+		if err := launch.CheckBinary(b.Path); err != nil {
+			fmt.Printf("%s\t%v\n", b.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s\tok\n", b.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w in %d of %d browser profiles", launch.ErrInvalidBinary, failed, len(browsers))
 	}
 	return nil
 }
 
-func openLogFile(path string) (*os.File, error) {
-	if path == "" {
-		return nil, nil
+func (c *BrowserWhichCmd) Run(ctx *Context) error {
+	resolver, err := bookmark.NewBrowserResolver(ctx, ctx.Repository)
+	if err != nil {
+		return err
 	}
-	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	_, steps, err := resolver.Resolve(bookmark.Bookmark{URL: c.URL, Tags: bookmark.NormalizeTags(c.Tags)})
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		fmt.Println(step)
+	}
+	return nil
 }
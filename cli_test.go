@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/launch"
+	"github.com/allaman/bm/store/memory"
+)
+
+func TestGroupByBrowser(t *testing.T) {
+	bookmarks := []bookmark.Bookmark{
+		{Name: "a", URL: "https://a.com", BrowserName: "work"},
+		{Name: "b", URL: "https://b.com"},
+		{Name: "c", URL: "https://c.com", BrowserName: "work"},
+		{Name: "d", URL: "https://d.com", BrowserName: "home"},
+	}
+
+	got := groupByBrowser(bookmarks)
+	want := []browserGroup{
+		{browserName: "work", bookmarks: []bookmark.Bookmark{bookmarks[0], bookmarks[2]}},
+		{browserName: "", bookmarks: []bookmark.Bookmark{bookmarks[1]}},
+		{browserName: "home", bookmarks: []bookmark.Bookmark{bookmarks[3]}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"0s":  0,
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	}
+	for in, want := range tests {
+		got, err := parseAge(in)
+		if err != nil || got != want {
+			t.Errorf("parseAge(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "d", "-1d", "1.5d", "-2h"} {
+		if _, err := parseAge(in); err == nil {
+			t.Errorf("parseAge(%q): expected error", in)
+		}
+	}
+}
+
+func TestOpenPlan(t *testing.T) {
+	ctx := &Context{Context: context.Background(), Repository: memory.New()}
+	for _, b := range []bookmark.Browser{
+		{Name: "work", Path: "/usr/bin/firefox", Args: []string{"-P", "work"}, Env: []string{"MOZ_ENABLE_WAYLAND=1"}, Dir: "/srv"},
+		{Name: "app", Path: "/usr/bin/chromium", Args: []string{"--app={url}"}},
+	} {
+		if err := ctx.Repository.AddBrowser(ctx, b); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	}
+	if _, err := ctx.Repository.AddRule(ctx, bookmark.Rule{Host: "*.corp.example.com", BrowserName: "work"}, 0); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	for _, bm := range []bookmark.Bookmark{
+		{Name: "wiki", URL: "https://wiki.corp.example.com"},
+		{Name: "chat", URL: "https://chat.example.com", BrowserName: "app"},
+		{Name: "ci", URL: "https://ci.corp.example.com"},
+		{Name: "mail", URL: "https://mail.example.com", BrowserName: "app"},
+	} {
+		if err := ctx.Repository.Add(ctx, bm); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	c := &OpenCmd{Name: []string{"wiki", "chat", "ci", "mail"}, Max: 20}
+	bookmarks, err := c.bookmarks(ctx)
+	if err != nil {
+		t.Fatalf("bookmarks() error = %v", err)
+	}
+	got, err := c.plan(ctx, bookmarks)
+	if err != nil {
+		t.Fatalf("plan() error = %v", err)
+	}
+
+	rule := []string{"bookmark profile: none", "routing rule #1 (host *.corp.example.com): work"}
+	want := []launchCommand{
+		{
+			Browser: "work",
+			Bookmarks: []resolvedBookmark{
+				{Name: "wiki", URL: "https://wiki.corp.example.com", Resolution: rule},
+				{Name: "ci", URL: "https://ci.corp.example.com", Resolution: rule},
+			},
+			Argv: []string{"/usr/bin/firefox", "-P", "work", "https://wiki.corp.example.com", "https://ci.corp.example.com"},
+			Env:  []string{"MOZ_ENABLE_WAYLAND=1"},
+			Dir:  "/srv",
+		},
+		{
+			Browser:   "app",
+			Bookmarks: []resolvedBookmark{{Name: "chat", URL: "https://chat.example.com", Resolution: []string{"bookmark profile: app"}}},
+			Argv:      []string{"/usr/bin/chromium", "--app=https://chat.example.com"},
+		},
+		{
+			Browser:   "app",
+			Bookmarks: []resolvedBookmark{{Name: "mail", URL: "https://mail.example.com", Resolution: []string{"bookmark profile: app"}}},
+			Argv:      []string{"/usr/bin/chromium", "--app=https://mail.example.com"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plan() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	var out bytes.Buffer
+	if err := printLaunchCommands(&out, got[:2], "shell"); err != nil {
+		t.Fatalf("printLaunchCommands() error = %v", err)
+	}
+	wantOut := `# wiki: bookmark profile: none -> routing rule #1 (host *.corp.example.com): work
+# ci: bookmark profile: none -> routing rule #1 (host *.corp.example.com): work
+(cd /srv && env MOZ_ENABLE_WAYLAND=1 /usr/bin/firefox -P work https://wiki.corp.example.com https://ci.corp.example.com)
+# chat: bookmark profile: app
+/usr/bin/chromium --app=https://chat.example.com
+`
+	if out.String() != wantOut {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), wantOut)
+	}
+}
+
+func TestOpenPlanDefaultBrowser(t *testing.T) {
+	ctx := &Context{Context: context.Background(), Repository: memory.New()}
+	for _, bm := range []bookmark.Bookmark{{Name: "a", URL: "https://a.com"}, {Name: "b", URL: "https://b.com"}} {
+		if err := ctx.Repository.Add(ctx, bm); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	want, err := launch.DefaultCommands([]string{"https://a.com", "https://b.com"})
+	if err != nil {
+		t.Skip(err)
+	}
+
+	c := &OpenCmd{Name: []string{"a", "b"}, Max: 20}
+	bookmarks, err := c.bookmarks(ctx)
+	if err != nil {
+		t.Fatalf("bookmarks() error = %v", err)
+	}
+	commands, err := c.plan(ctx, bookmarks)
+	if err != nil {
+		t.Fatalf("plan() error = %v", err)
+	}
+	var got [][]string
+	for _, command := range commands {
+		if command.Browser != "" || len(command.Bookmarks) == 0 {
+			t.Errorf("got %+v, want the OS default browser", command)
+		}
+		if last := command.Bookmarks[0].Resolution; last[len(last)-1] != "OS default browser" {
+			t.Errorf("got resolution %q", last)
+		}
+		got = append(got, command.Argv)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/usr/bin/firefox":       "/usr/bin/firefox",
+		"--app=https://a.com/x":  "--app=https://a.com/x",
+		"":                       "''",
+		"Profile 1":              "'Profile 1'",
+		"https://a.com/?q=1&r=2": "'https://a.com/?q=1&r=2'",
+		"it's":                   `'it'\''s'`,
+		"$HOME":                  "'$HOME'",
+	}
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package discover
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// desktopEntry holds the keys of a .desktop file that matter for finding
+// browsers.
+type desktopEntry struct {
+	Name       string
+	Exec       string
+	Categories []string
+	Hidden     bool
+}
+
+// readDesktopEntry parses the [Desktop Entry] group of the .desktop file at
+// path. Localized keys and other groups are ignored.
+func readDesktopEntry(path string) (desktopEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return desktopEntry{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var entry desktopEntry
+	inEntry := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inEntry = line == "[Desktop Entry]"
+			continue
+		}
+		if !inEntry {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Name":
+			entry.Name = unescapeValue(value)
+		case "Exec":
+			entry.Exec = unescapeValue(value)
+		case "Categories":
+			for _, c := range strings.Split(value, ";") {
+				if c != "" {
+					entry.Categories = append(entry.Categories, c)
+				}
+			}
+		case "Hidden":
+			entry.Hidden = value == "true"
+		}
+	}
+	return entry, scanner.Err()
+}
+
+// unescapeValue resolves the escape sequences of string values: \s, \n, \t,
+// \r and \\. Other backslashes are kept for the Exec quoting rules.
+func unescapeValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parseExec splits an Exec value into the program and its arguments. Field
+// codes such as %u are dropped since bm appends the URLs itself, and a
+// leading env with its VAR=value assignments is skipped.
+func parseExec(exec string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		inQuote bool
+	)
+	for i := 0; i < len(exec); i++ {
+		c := exec[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(exec):
+			i++
+			cur.WriteByte(exec[i])
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+
+	var out []string
+	for _, arg := range args {
+		arg, keep := expandFieldCodes(arg)
+		if keep {
+			out = append(out, arg)
+		}
+	}
+	if len(out) > 0 && (out[0] == "env" || strings.HasSuffix(out[0], "/env")) {
+		out = out[1:]
+		for len(out) > 0 && strings.Contains(out[0], "=") && !strings.HasPrefix(out[0], "-") {
+			out = out[1:]
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no program in %q", exec)
+	}
+	return out, nil
+}
+
+// expandFieldCodes removes field codes from arg. It reports false when arg
+// consisted only of field codes and should be dropped.
+func expandFieldCodes(arg string) (string, bool) {
+	if !strings.Contains(arg, "%") {
+		return arg, true
+	}
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '%' || i+1 == len(arg) {
+			b.WriteByte(arg[i])
+			continue
+		}
+		i++
+		if arg[i] == '%' {
+			b.WriteByte('%')
+		}
+	}
+	return b.String(), b.Len() > 0
+}
@@ -0,0 +1,250 @@
+// Package discover finds web browsers installed on Linux and other XDG
+// desktops, together with their profiles.
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// Family is a group of browsers sharing how profiles are stored and
+// selected.
+type Family string
+
+const (
+	// FamilyFirefox browsers list profiles in profiles.ini and select them
+	// with -P <name>.
+	FamilyFirefox Family = "firefox"
+	// FamilyChromium browsers list profiles in Local State and select them
+	// with --profile-directory=<dir>.
+	FamilyChromium Family = "chromium"
+)
+
+// Browser is a browser found through its .desktop entry.
+type Browser struct {
+	// ID is the desktop file ID, e.g. firefox.desktop.
+	ID   string
+	Name string
+	// Path is the absolute path of the program in the Exec line.
+	Path string
+	// Args are the arguments of the Exec line, without field codes.
+	Args     []string
+	Family   Family
+	Profiles []Profile
+}
+
+// Profile is a browser profile selected by extra arguments.
+type Profile struct {
+	Name    string
+	Args    []string
+	Default bool
+}
+
+// Options tell where to look for browsers and profiles.
+type Options struct {
+	// DataDirs are searched for applications/*.desktop, most important
+	// first.
+	DataDirs []string
+	// Home holds Firefox-family profiles, e.g. ~/.mozilla/firefox.
+	Home string
+	// ConfigHome holds Chromium-family profiles, e.g. ~/.config/chromium.
+	ConfigHome string
+	// LookPath resolves programs of Exec lines without a path.
+	LookPath func(file string) (string, error)
+}
+
+// DefaultOptions returns the directories of the XDG base directory
+// specification for the current user.
+func DefaultOptions() Options {
+	home, _ := os.UserHomeDir()
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	return Options{
+		DataDirs:   append([]string{dataHome}, filepath.SplitList(dataDirs)...),
+		Home:       home,
+		ConfigHome: configHome,
+		LookPath:   exec.LookPath,
+	}
+}
+
+// known maps program names to their family and profile directory, relative
+// to Options.Home for Firefox and to Options.ConfigHome for Chromium.
+var known = []struct {
+	programs []string
+	family   Family
+	dir      string
+}{
+	{[]string{"firefox", "firefox-esr", "firefox-bin"}, FamilyFirefox, ".mozilla/firefox"},
+	{[]string{"librewolf"}, FamilyFirefox, ".librewolf"},
+	{[]string{"zen", "zen-browser"}, FamilyFirefox, ".zen"},
+	{[]string{"waterfox"}, FamilyFirefox, ".waterfox"},
+	{[]string{"chromium", "chromium-browser"}, FamilyChromium, "chromium"},
+	{[]string{"google-chrome", "google-chrome-stable"}, FamilyChromium, "google-chrome"},
+	{[]string{"brave", "brave-browser"}, FamilyChromium, "BraveSoftware/Brave-Browser"},
+	{[]string{"vivaldi", "vivaldi-stable"}, FamilyChromium, "vivaldi"},
+	{[]string{"microsoft-edge", "microsoft-edge-stable"}, FamilyChromium, "microsoft-edge"},
+}
+
+// Browsers returns the browsers with a .desktop entry in the WebBrowser
+// category, sorted by desktop file ID. Entries whose program cannot be found
+// are skipped.
+func Browsers(opts Options) ([]Browser, error) {
+	entries, err := desktopFiles(opts.DataDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	var browsers []Browser
+	for _, id := range slices.Sorted(maps.Keys(entries)) {
+		entry, err := readDesktopEntry(entries[id])
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entries[id], err)
+		}
+		if entry.Hidden || entry.Exec == "" || !slices.Contains(entry.Categories, "WebBrowser") {
+			continue
+		}
+		args, err := parseExec(entry.Exec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: Exec: %w", entries[id], err)
+		}
+		path := args[0]
+		if !filepath.IsAbs(path) {
+			if opts.LookPath == nil {
+				continue
+			}
+			if path, err = opts.LookPath(path); err != nil {
+				continue
+			}
+		}
+
+		b := Browser{ID: id, Name: entry.Name, Path: path, Args: args[1:]}
+		if err := b.findProfiles(opts); err != nil {
+			return nil, err
+		}
+		browsers = append(browsers, b)
+	}
+	return browsers, nil
+}
+
+// findProfiles sets the family and profiles of a known browser.
+func (b *Browser) findProfiles(opts Options) error {
+	program := filepath.Base(b.Path)
+	for _, k := range known {
+		if !slices.Contains(k.programs, program) {
+			continue
+		}
+		b.Family = k.family
+		var err error
+		switch k.family {
+		case FamilyFirefox:
+			b.Profiles, err = firefoxProfiles(filepath.Join(opts.Home, k.dir))
+		case FamilyChromium:
+			b.Profiles, err = chromiumProfiles(filepath.Join(opts.ConfigHome, k.dir))
+		}
+		if err != nil {
+			return fmt.Errorf("reading profiles of %s: %w", b.ID, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// desktopFiles maps desktop file IDs to the paths of their files. An ID
+// found in several data dirs resolves to the most important one.
+func desktopFiles(dataDirs []string) (map[string]string, error) {
+	files := map[string]string{}
+	for _, dataDir := range dataDirs {
+		dir := filepath.Join(dataDir, "applications")
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".desktop") {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			// Subdirectories are part of the ID: kde/foo.desktop is kde-foo.desktop.
+			id := strings.ReplaceAll(filepath.ToSlash(rel), "/", "-")
+			if _, ok := files[id]; !ok {
+				files[id] = path
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Suggest returns a browser profile for every profile of browsers, and one
+// without profile arguments for browsers without known profiles. Names are
+// derived from the program and profile name and made unique.
+func Suggest(browsers []Browser) []bookmark.Browser {
+	var suggestions []bookmark.Browser
+	seen := map[string]int{}
+	add := func(name, path string, args []string) {
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			name = fmt.Sprintf("%s-%d", name, n)
+		}
+		suggestions = append(suggestions, bookmark.Browser{Name: name, Path: path, Args: args})
+	}
+	for _, b := range browsers {
+		// Reverse DNS IDs such as org.mozilla.firefox name the browser last.
+		id := strings.TrimSuffix(b.ID, ".desktop")
+		program := slug(id[strings.LastIndex(id, ".")+1:])
+		if len(b.Profiles) == 0 {
+			add(program, b.Path, slices.Clone(b.Args))
+			continue
+		}
+		for _, p := range b.Profiles {
+			add(program+"-"+slug(p.Name), b.Path, append(slices.Clone(b.Args), p.Args...))
+		}
+	}
+	return suggestions
+}
+
+// slug lowercases s and replaces runs of other characters than letters and
+// digits with a dash.
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
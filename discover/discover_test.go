@@ -0,0 +1,110 @@
+package discover
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+func fixtureOptions() Options {
+	return Options{
+		DataDirs:   []string{"testdata/data-home", "testdata/data-dirs", "testdata/does-not-exist"},
+		Home:       "testdata/home",
+		ConfigHome: "testdata/config",
+		LookPath: func(file string) (string, error) {
+			if file == "chromium" {
+				return "/usr/bin/chromium", nil
+			}
+			return "", exec.ErrNotFound
+		},
+	}
+}
+
+func TestBrowsers(t *testing.T) {
+	got, err := Browsers(fixtureOptions())
+	if err != nil {
+		t.Fatalf("Browsers() error = %v", err)
+	}
+	want := []Browser{
+		{
+			ID: "chromium.desktop", Name: "Chromium", Path: "/usr/bin/chromium",
+			Args: []string{"--ozone-platform-hint=auto"}, Family: FamilyChromium,
+			Profiles: []Profile{
+				{Name: "Person 1", Args: []string{"--profile-directory=Default"}},
+				{Name: "Work Stuff", Args: []string{"--profile-directory=Profile 2"}, Default: true},
+			},
+		},
+		{
+			// The entry in the data home shadows the system one.
+			ID: "firefox.desktop", Name: "Firefox", Path: "/opt/firefox/firefox",
+			Args: []string{}, Family: FamilyFirefox,
+			Profiles: []Profile{
+				{Name: "work", Args: []string{"-P", "work"}},
+				{Name: "default-release", Args: []string{"-P", "default-release"}, Default: true},
+			},
+		},
+		{
+			ID: "kde-falkon.desktop", Name: "Falkon", Path: "/opt/falkon browser/falkon",
+			Args: []string{"--name", `my "profile"`},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	browsers, err := Browsers(fixtureOptions())
+	if err != nil {
+		t.Fatalf("Browsers() error = %v", err)
+	}
+	browsers = append(browsers, Browser{ID: "org.mozilla.firefox.desktop", Path: "/usr/bin/flatpak", Args: []string{"run", "org.mozilla.firefox"}})
+
+	got := Suggest(browsers)
+	want := []bookmark.Browser{
+		{Name: "chromium-person-1", Path: "/usr/bin/chromium", Args: []string{"--ozone-platform-hint=auto", "--profile-directory=Default"}},
+		{Name: "chromium-work-stuff", Path: "/usr/bin/chromium", Args: []string{"--ozone-platform-hint=auto", "--profile-directory=Profile 2"}},
+		{Name: "firefox-work", Path: "/opt/firefox/firefox", Args: []string{"-P", "work"}},
+		{Name: "firefox-default-release", Path: "/opt/firefox/firefox", Args: []string{"-P", "default-release"}},
+		{Name: "kde-falkon", Path: "/opt/falkon browser/falkon", Args: []string{"--name", `my "profile"`}},
+		{Name: "firefox", Path: "/usr/bin/flatpak", Args: []string{"run", "org.mozilla.firefox"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseExec(t *testing.T) {
+	tests := map[string][]string{
+		"firefox %u":                          {"firefox"},
+		"/usr/bin/firefox --new-window %U":    {"/usr/bin/firefox", "--new-window"},
+		`"/opt/my app/bin" --arg "a \"b\""`:   {"/opt/my app/bin", "--arg", `a "b"`},
+		"env A=1 B=2 brave --incognito %U":    {"brave", "--incognito"},
+		"/usr/bin/env MOZ_X=1 firefox --p=%%": {"firefox", "--p=%"},
+		"app --file=%f":                       {"app", "--file="},
+	}
+	for in, want := range tests {
+		got, err := parseExec(in)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseExec(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "%u", `"/opt/unterminated`, "env A=1"} {
+		if _, err := parseExec(in); err == nil {
+			t.Errorf("parseExec(%q): expected error", in)
+		}
+	}
+}
+
+func TestMissingProfiles(t *testing.T) {
+	profiles, err := firefoxProfiles(t.TempDir())
+	if err != nil || profiles != nil {
+		t.Errorf("firefoxProfiles() = %v, %v; want none", profiles, err)
+	}
+	profiles, err = chromiumProfiles(t.TempDir())
+	if err != nil || profiles != nil {
+		t.Errorf("chromiumProfiles() = %v, %v; want none", profiles, err)
+	}
+}
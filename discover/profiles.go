@@ -0,0 +1,110 @@
+package discover
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// firefoxProfiles reads the profiles listed in the profiles.ini in dir.
+// A missing file means no profiles.
+func firefoxProfiles(dir string) ([]Profile, error) {
+	f, err := os.Open(filepath.Join(dir, "profiles.ini"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		profiles []Profile
+		current  *Profile
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			current = nil
+			if strings.HasPrefix(line, "[Profile") {
+				profiles = append(profiles, Profile{})
+				current = &profiles[len(profiles)-1]
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if current == nil || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Name":
+			current.Name = strings.TrimSpace(value)
+		case "Default":
+			current.Default = strings.TrimSpace(value) == "1"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var named []Profile
+	for _, p := range profiles {
+		if p.Name == "" {
+			continue
+		}
+		p.Args = []string{"-P", p.Name}
+		named = append(named, p)
+	}
+	return named, nil
+}
+
+// chromiumProfiles reads the profiles listed in the Local State file in
+// dir. A missing file means no profiles.
+func chromiumProfiles(dir string) ([]Profile, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "Local State"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state struct {
+		Profile struct {
+			InfoCache map[string]struct {
+				Name string `json:"name"`
+			} `json:"info_cache"`
+			LastUsed string `json:"last_used"`
+		} `json:"profile"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0, len(state.Profile.InfoCache))
+	for d := range state.Profile.InfoCache {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	profiles := make([]Profile, 0, len(dirs))
+	for _, d := range dirs {
+		name := state.Profile.InfoCache[d].Name
+		if name == "" {
+			name = d
+		}
+		profiles = append(profiles, Profile{
+			Name:    name,
+			Args:    []string{"--profile-directory=" + d},
+			Default: d == state.Profile.LastUsed,
+		})
+	}
+	return profiles, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/launch"
+	"github.com/allaman/bm/store/sqlite"
+)
+
+// Exit codes, one per class of error, so scripts can react to failures
+// without parsing messages.
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitUsage          = 2
+	exitNotFound       = 3
+	exitExists         = 4
+	exitUnknownBrowser = 5
+	exitConflict       = 6
+	exitLocked         = 7
+	exitLaunch         = 8
+	exitTimeout        = 124
+	exitInterrupted    = 130
+)
+
+// exitCode maps err to the exit code of its class.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, bookmark.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, bookmark.ErrDuplicateName),
+		errors.Is(err, bookmark.ErrDuplicateBrowser),
+		errors.Is(err, bookmark.ErrDuplicateCollection):
+		return exitExists
+	case errors.Is(err, bookmark.ErrUnknownBrowser):
+		return exitUnknownBrowser
+	case errors.Is(err, bookmark.ErrUndoConflict),
+		errors.Is(err, bookmark.ErrSyncChanged):
+		return exitConflict
+	case errors.Is(err, sqlite.ErrBusy):
+		return exitLocked
+	case errors.Is(err, launch.ErrFailed), errors.Is(err, launch.ErrInvalidBinary):
+		return exitLaunch
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	default:
+		return exitError
+	}
+}
+
+// errorCodes names the exit codes in --json-errors output.
+var errorCodes = map[int]string{
+	exitError:          "error",
+	exitUsage:          "usage",
+	exitNotFound:       "not_found",
+	exitExists:         "exists",
+	exitUnknownBrowser: "unknown_browser",
+	exitConflict:       "conflict",
+	exitLocked:         "locked",
+	exitLaunch:         "launch_failed",
+	exitTimeout:        "timeout",
+	exitInterrupted:    "interrupted",
+}
+
+// jsonError is an error as printed by --json-errors.
+type jsonError struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Details jsonErrorDetails `json:"details"`
+}
+
+type jsonErrorDetails struct {
+	ExitCode int `json:"exit_code"`
+}
+
+// writeError prints err to w, as a single line of JSON with asJSON, and
+// returns exit.
+func writeError(w io.Writer, err error, exit int, asJSON bool) int {
+	if !asJSON {
+		fmt.Fprintf(w, "bm: error: %v\n", err)
+		return exit
+	}
+	out, _ := json.Marshal(jsonError{
+		Code:    errorCodes[exit],
+		Message: err.Error(),
+		Details: jsonErrorDetails{ExitCode: exit},
+	})
+	fmt.Fprintf(w, "%s\n", out)
+	return exit
+}
+
+// hasFlag reports whether the boolean flag is set among args, before any
+// "--", either bare or with a value kong reads as true. Like kong, the last
+// occurrence wins.
+func hasFlag(args []string, flag string) bool {
+	set := false
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == flag {
+			set = true
+		} else if value, ok := strings.CutPrefix(arg, flag+"="); ok {
+			switch strings.ToLower(value) {
+			case "true", "1", "yes":
+				set = true
+			default:
+				set = false
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/launch"
+	"github.com/allaman/bm/store/sqlite"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{errors.New("boom"), exitError},
+		{fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, "x"), exitNotFound},
+		{fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, "x"), exitNotFound},
+		{fmt.Errorf("tag %w: %q", bookmark.ErrNotFound, "x"), exitNotFound},
+		{bookmark.ErrNameInTrash, exitExists},
+		{bookmark.ErrDuplicateBrowser, exitExists},
+		{fmt.Errorf("bookmark %q: %w: %q", "x", bookmark.ErrUnknownBrowser, "y"), exitUnknownBrowser},
+		{fmt.Errorf("undo: %w", bookmark.ErrUndoConflict), exitConflict},
+		{bookmark.ErrSyncChanged, exitConflict},
+		{fmt.Errorf("%w: %w", sqlite.ErrBusy, errors.New("database is locked")), exitLocked},
+		{fmt.Errorf("%w: %s: %w", launch.ErrFailed, "firefox", errors.New("exit status 1")), exitLaunch},
+		{fmt.Errorf("%w %q: does not exist", launch.ErrInvalidBinary, "/usr/bin/x"), exitLaunch},
+		{context.DeadlineExceeded, exitTimeout},
+		{fmt.Errorf("listing: %w", context.Canceled), exitInterrupted},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	err := fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, "x")
+
+	var text bytes.Buffer
+	if got := writeError(&text, err, exitNotFound, false); got != exitNotFound {
+		t.Errorf("writeError() = %d, want %d", got, exitNotFound)
+	}
+	if want := "bm: error: bookmark not found: \"x\"\n"; text.String() != want {
+		t.Errorf("got %q, want %q", text.String(), want)
+	}
+
+	var out bytes.Buffer
+	writeError(&out, err, exitNotFound, true)
+	var got jsonError
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out.String(), err)
+	}
+	want := jsonError{Code: "not_found", Message: `bookmark not found: "x"`, Details: jsonErrorDetails{ExitCode: exitNotFound}}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHasFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"ls", "--json-errors"}, true},
+		{[]string{"ls", "--json-errors=true"}, true},
+		{[]string{"ls", "--json-errors=YES"}, true},
+		{[]string{"ls", "--json-errors=1"}, true},
+		{[]string{"ls", "--json-errors=false"}, false},
+		{[]string{"ls", "--json-errors", "--json-errors=0"}, false},
+		{[]string{"ls", "--json-errors-x"}, false},
+		{[]string{"add", "--", "--json-errors"}, false},
+		{[]string{"ls"}, false},
+	}
+	for _, tt := range tests {
+		if got := hasFlag(tt.args, "--json-errors"); got != tt.want {
+			t.Errorf("hasFlag(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// Store loads and saves a State. View must not let fn's changes leak into
+// the stored state; Update stores the state fn leaves behind unless fn
+// fails. op describes the change, e.g. for a commit message.
+type Store interface {
+	View(ctx context.Context, fn func(*State) error) error
+	Update(ctx context.Context, op string, fn func(*State) error) error
+}
+
+// Repository implements bookmark.Repository on top of a Store. It keeps no
+// change log: Changes and Undo fail with bookmark.ErrNoChangeLog, and the
+// file backend leaves history to git instead.
+type Repository struct {
+	store Store
+}
+
+// NewRepository returns a Repository keeping its data in store.
+func NewRepository(store Store) Repository {
+	return Repository{store: store}
+}
+
+func (r Repository) Add(ctx context.Context, b bookmark.Bookmark) error {
+	return r.store.Update(ctx, fmt.Sprintf("add bookmark %q", b.Name), func(s *State) error {
+		return s.add(b)
+	})
+}
+
+func (r Repository) Del(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("delete bookmark %q", name), func(s *State) error {
+		return s.del(name, time.Now())
+	})
+}
+
+func (r Repository) Update(ctx context.Context, name string, p bookmark.BookmarkPatch) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return r.store.Update(ctx, fmt.Sprintf("update bookmark %q", name), func(s *State) error {
+		return s.update(name, p)
+	})
+}
+
+func (r Repository) UpdateWhere(ctx context.Context, f bookmark.Filter, p bookmark.BookmarkPatch, dryRun bool) ([]bookmark.Bookmark, error) {
+	var matched []bookmark.Bookmark
+	fn := func(s *State) error {
+		var err error
+		matched, err = s.updateWhere(f, p, dryRun)
+		return err
+	}
+	var err error
+	if dryRun {
+		err = r.store.View(ctx, fn)
+	} else {
+		err = r.store.Update(ctx, "update bookmarks", fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+func (r Repository) Ls(ctx context.Context, includeArchived bool) ([]bookmark.Bookmark, error) {
+	var bookmarks []bookmark.Bookmark
+	err := r.store.View(ctx, func(s *State) error {
+		var err error
+		bookmarks, err = s.list(includeArchived, bookmark.Filter{})
+		return err
+	})
+	return bookmarks, err
+}
+
+func (r Repository) LsByTag(ctx context.Context, tag string, includeArchived bool) ([]bookmark.Bookmark, error) {
+	tag = bookmark.NormalizeTag(tag)
+	if tag == "" {
+		return nil, fmt.Errorf("tag must not be empty")
+	}
+	var bookmarks []bookmark.Bookmark
+	err := r.store.View(ctx, func(s *State) error {
+		var err error
+		bookmarks, err = s.list(includeArchived, bookmark.Filter{Tag: tag})
+		return err
+	})
+	return bookmarks, err
+}
+
+func (r Repository) RenameTag(ctx context.Context, from, to string) error {
+	return r.store.Update(ctx, fmt.Sprintf("rename tag %q to %q", from, to), func(s *State) error {
+		return s.renameTag(from, to)
+	})
+}
+
+func (r Repository) Get(ctx context.Context, name string) (bookmark.Bookmark, error) {
+	var b bookmark.Bookmark
+	err := r.store.View(ctx, func(s *State) error {
+		var err error
+		b, err = s.get(name)
+		return err
+	})
+	return b, err
+}
+
+func (r Repository) Trash(ctx context.Context) ([]bookmark.Bookmark, error) {
+	var bookmarks []bookmark.Bookmark
+	err := r.store.View(ctx, func(s *State) error {
+		bookmarks = s.trash()
+		return nil
+	})
+	return bookmarks, err
+}
+
+func (r Repository) Restore(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("restore bookmark %q", name), func(s *State) error {
+		return s.restore(name)
+	})
+}
+
+func (r Repository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := r.store.Update(ctx, "purge trash", func(s *State) error {
+		purged = s.purge(before)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (r Repository) AddBrowser(ctx context.Context, b bookmark.Browser) error {
+	return r.store.Update(ctx, fmt.Sprintf("add browser profile %q", b.Name), func(s *State) error {
+		return s.addBrowser(b)
+	})
+}
+
+func (r Repository) DelBrowser(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("delete browser profile %q", name), func(s *State) error {
+		return s.delBrowser(name)
+	})
+}
+
+func (r Repository) LsBrowsers(ctx context.Context) ([]bookmark.Browser, error) {
+	var browsers []bookmark.Browser
+	err := r.store.View(ctx, func(s *State) error {
+		browsers = s.lsBrowsers()
+		return nil
+	})
+	return browsers, err
+}
+
+func (r Repository) GetBrowser(ctx context.Context, name string) (bookmark.Browser, error) {
+	var b bookmark.Browser
+	err := r.store.View(ctx, func(s *State) error {
+		var err error
+		b, err = s.getBrowser(name)
+		return err
+	})
+	return b, err
+}
+
+func (r Repository) UpdateBrowser(ctx context.Context, name string, p bookmark.BrowserPatch) error {
+	return r.store.Update(ctx, fmt.Sprintf("update browser profile %q", name), func(s *State) error {
+		return s.updateBrowser(name, p)
+	})
+}
+
+func (r Repository) SetDefaultBrowser(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("set default browser profile %q", name), func(s *State) error {
+		return s.setDefaultBrowser(name)
+	})
+}
+
+func (r Repository) SetTagBrowser(ctx context.Context, tag, browser string) error {
+	return r.store.Update(ctx, fmt.Sprintf("set browser profile of tag %q", tag), func(s *State) error {
+		return s.setTagBrowser(tag, browser)
+	})
+}
+
+func (r Repository) LsTagBrowsers(ctx context.Context) (map[string]string, error) {
+	var tagBrowsers map[string]string
+	err := r.store.View(ctx, func(s *State) error {
+		tagBrowsers = s.lsTagBrowsers()
+		return nil
+	})
+	return tagBrowsers, err
+}
+
+func (r Repository) AddCollection(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("add collection %q", name), func(s *State) error {
+		return s.addCollection(name)
+	})
+}
+
+func (r Repository) DelCollection(ctx context.Context, name string) error {
+	return r.store.Update(ctx, fmt.Sprintf("delete collection %q", name), func(s *State) error {
+		return s.delCollection(name)
+	})
+}
+
+func (r Repository) LsCollections(ctx context.Context) ([]bookmark.Collection, error) {
+	var collections []bookmark.Collection
+	err := r.store.View(ctx, func(s *State) error {
+		collections = s.lsCollections()
+		return nil
+	})
+	return collections, err
+}
+
+func (r Repository) GetCollection(ctx context.Context, name string) (bookmark.Collection, error) {
+	var c bookmark.Collection
+	err := r.store.View(ctx, func(s *State) error {
+		var err error
+		c, err = s.getCollection(name)
+		return err
+	})
+	return c, err
+}
+
+func (r Repository) AddToCollection(ctx context.Context, collection, member string, position int) error {
+	return r.editCollection(ctx, collection, func(c *bookmark.Collection) error { return c.Insert(member, position) })
+}
+
+func (r Repository) RemoveFromCollection(ctx context.Context, collection, member string) error {
+	return r.editCollection(ctx, collection, func(c *bookmark.Collection) error { return c.Remove(member) })
+}
+
+func (r Repository) MoveInCollection(ctx context.Context, collection, member string, position int) error {
+	return r.editCollection(ctx, collection, func(c *bookmark.Collection) error { return c.Move(member, position) })
+}
+
+func (r Repository) editCollection(ctx context.Context, collection string, edit func(*bookmark.Collection) error) error {
+	return r.store.Update(ctx, fmt.Sprintf("edit collection %q", collection), func(s *State) error {
+		return s.editCollection(collection, edit)
+	})
+}
+
+func (r Repository) AddRule(ctx context.Context, rule bookmark.Rule, position int) (int64, error) {
+	var id int64
+	err := r.store.Update(ctx, fmt.Sprintf("add rule %s", rule), func(s *State) error {
+		var err error
+		id, err = s.addRule(rule, position)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r Repository) DelRule(ctx context.Context, id int64) error {
+	return r.store.Update(ctx, fmt.Sprintf("delete rule %d", id), func(s *State) error {
+		return s.delRule(id)
+	})
+}
+
+func (r Repository) LsRules(ctx context.Context) ([]bookmark.Rule, error) {
+	var rules []bookmark.Rule
+	err := r.store.View(ctx, func(s *State) error {
+		rules = s.lsRules()
+		return nil
+	})
+	return rules, err
+}
+
+func (r Repository) Changes(ctx context.Context, name string, limit int) ([]bookmark.Change, error) {
+	return nil, bookmark.ErrNoChangeLog
+}
+
+func (r Repository) Undo(ctx context.Context, steps int) ([]bookmark.Change, error) {
+	return nil, bookmark.ErrNoChangeLog
+}
+
+func (r Repository) Export(ctx context.Context) (bookmark.Dump, error) {
+	var d bookmark.Dump
+	err := r.store.View(ctx, func(s *State) error {
+		d = s.dump()
+		return nil
+	})
+	return d, err
+}
+
+func (r Repository) Import(ctx context.Context, d bookmark.Dump, mode bookmark.ImportMode) (bookmark.ImportResult, error) {
+	switch mode {
+	case bookmark.ImportMerge, bookmark.ImportReplace, bookmark.ImportSkipExisting:
+	default:
+		return bookmark.ImportResult{}, fmt.Errorf("unknown import mode %q", mode)
+	}
+	// Validate normalizes in place; keep the caller's dump untouched.
+	d.Bookmarks = slices.Clone(d.Bookmarks)
+	d.Rules = slices.Clone(d.Rules)
+	if err := d.Validate(); err != nil {
+		return bookmark.ImportResult{}, err
+	}
+
+	var result bookmark.ImportResult
+	err := r.store.Update(ctx, "import", func(s *State) error {
+		var err error
+		result, err = s.importDump(d, mode)
+		return err
+	})
+	if err != nil {
+		return bookmark.ImportResult{}, err
+	}
+	return result, nil
+}
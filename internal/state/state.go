@@ -0,0 +1,676 @@
+// Package state implements the repository operations on data held in
+// memory, for the backends that are not backed by a database.
+package state
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// State holds all data of a repository that is not backed by a database
+// and implements the repository operations on it. It is laid out like a
+// Dump, plus the IDs of the routing rules. Bookmarks, browser profiles,
+// collections and tags are kept sorted so equal states encode equally.
+type State struct {
+	Version     int                   `json:"version"`
+	Browsers    []bookmark.Browser    `json:"browsers,omitempty"`
+	Bookmarks   []bookmark.Bookmark   `json:"bookmarks,omitempty"`
+	Collections []bookmark.Collection `json:"collections,omitempty"`
+	Rules       []storedRule          `json:"rules,omitempty"`
+	TagBrowsers map[string]string     `json:"tag_browsers,omitempty"`
+}
+
+// storedRule keeps the ID of a rule, which Dump leaves out.
+type storedRule struct {
+	ID int64 `json:"id"`
+	bookmark.Rule
+}
+
+// New returns an empty state.
+func New() *State {
+	return &State{Version: bookmark.DumpVersion}
+}
+
+// Check validates a state that was read from outside, e.g. a file edited by
+// hand, and brings it into normalized form.
+func (s *State) Check() error {
+	d := s.dump()
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	s.Bookmarks = d.Bookmarks
+	s.TagBrowsers = d.TagBrowsers
+	for i := range s.Rules {
+		s.Rules[i].Tag = d.Rules[i].Tag
+	}
+	s.Sort()
+	return nil
+}
+
+// Sort brings the state into its canonical order.
+func (s *State) Sort() {
+	slices.SortFunc(s.Browsers, func(a, b bookmark.Browser) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(s.Bookmarks, func(a, b bookmark.Bookmark) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(s.Collections, func(a, b bookmark.Collection) int { return strings.Compare(a.Name, b.Name) })
+	for i := range s.Bookmarks {
+		slices.Sort(s.Bookmarks[i].Tags)
+	}
+}
+
+// Clone returns a deep copy, so a failed operation can be discarded.
+func (s *State) Clone() *State {
+	c := &State{
+		Version:     s.Version,
+		Browsers:    make([]bookmark.Browser, len(s.Browsers)),
+		Bookmarks:   make([]bookmark.Bookmark, len(s.Bookmarks)),
+		Collections: make([]bookmark.Collection, len(s.Collections)),
+		Rules:       slices.Clone(s.Rules),
+		TagBrowsers: make(map[string]string, len(s.TagBrowsers)),
+	}
+	for i, b := range s.Browsers {
+		c.Browsers[i] = cloneBrowser(b)
+	}
+	for i, b := range s.Bookmarks {
+		c.Bookmarks[i] = cloneBookmark(b)
+	}
+	for i, col := range s.Collections {
+		c.Collections[i] = bookmark.Collection{Name: col.Name, Bookmarks: slices.Clone(col.Bookmarks)}
+	}
+	for tag, browser := range s.TagBrowsers {
+		c.TagBrowsers[tag] = browser
+	}
+	return c
+}
+
+func cloneBookmark(b bookmark.Bookmark) bookmark.Bookmark {
+	b.Tags = slices.Clone(b.Tags)
+	if b.DeletedAt != nil {
+		deleted := *b.DeletedAt
+		b.DeletedAt = &deleted
+	}
+	return b
+}
+
+func cloneBrowser(b bookmark.Browser) bookmark.Browser {
+	b.Args = slices.Clone(b.Args)
+	b.Env = slices.Clone(b.Env)
+	return b
+}
+
+func (s *State) bookmark(name string) int {
+	return slices.IndexFunc(s.Bookmarks, func(b bookmark.Bookmark) bool { return b.Name == name })
+}
+
+// liveBookmark returns the index of a bookmark outside the trash, or -1.
+func (s *State) liveBookmark(name string) int {
+	i := s.bookmark(name)
+	if i >= 0 && s.Bookmarks[i].DeletedAt != nil {
+		return -1
+	}
+	return i
+}
+
+func (s *State) browser(name string) int {
+	return slices.IndexFunc(s.Browsers, func(b bookmark.Browser) bool { return b.Name == name })
+}
+
+func (s *State) collection(name string) int {
+	return slices.IndexFunc(s.Collections, func(c bookmark.Collection) bool { return c.Name == name })
+}
+
+func (s *State) add(b bookmark.Bookmark) error {
+	if i := s.bookmark(b.Name); i >= 0 {
+		if s.Bookmarks[i].DeletedAt != nil {
+			return bookmark.ErrNameInTrash
+		}
+		return bookmark.ErrDuplicateName
+	}
+	if b.BrowserName != "" && s.browser(b.BrowserName) < 0 {
+		return fmt.Errorf("bookmark %q: %w: %q", b.Name, bookmark.ErrUnknownBrowser, b.BrowserName)
+	}
+	b = cloneBookmark(b)
+	b.Tags = bookmark.NormalizeTags(b.Tags)
+	b.DeletedAt = nil
+	s.Bookmarks = append(s.Bookmarks, b)
+	s.Sort()
+	return nil
+}
+
+func (s *State) del(name string, now time.Time) error {
+	i := s.liveBookmark(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+	}
+	deleted := now.UTC().Truncate(time.Second)
+	s.Bookmarks[i].DeletedAt = &deleted
+	for j := range s.Collections {
+		c := &s.Collections[j]
+		c.Bookmarks = slices.DeleteFunc(c.Bookmarks, func(member string) bool { return member == name })
+	}
+	return nil
+}
+
+func (s *State) update(name string, p bookmark.BookmarkPatch) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	i := s.liveBookmark(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+	}
+	return s.applyPatch(i, p)
+}
+
+func (s *State) updateWhere(f bookmark.Filter, p bookmark.BookmarkPatch, dryRun bool) ([]bookmark.Bookmark, error) {
+	if f == (bookmark.Filter{}) {
+		return nil, fmt.Errorf("at least one filter is required")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if f.URLGlob != "" {
+		if _, err := path.Match(f.URLGlob, ""); err != nil {
+			return nil, fmt.Errorf("invalid URL glob %q: %w", f.URLGlob, err)
+		}
+	}
+
+	matched, err := s.list(true, f)
+	if err != nil {
+		return nil, err
+	}
+	// A dry run patches a copy, so it fails exactly where the update would.
+	target := s
+	if dryRun {
+		target = s.Clone()
+	}
+	for _, b := range matched {
+		if err := target.applyPatch(target.bookmark(b.Name), p); err != nil {
+			return nil, err
+		}
+	}
+	return matched, nil
+}
+
+// applyPatch edits tags in the same order as the SQLite repository: Tags
+// replaces them, then RemoveTags and AddTags are applied.
+func (s *State) applyPatch(i int, p bookmark.BookmarkPatch) error {
+	b := &s.Bookmarks[i]
+	if p.BrowserName != nil && *p.BrowserName != "" && s.browser(*p.BrowserName) < 0 {
+		return fmt.Errorf("bookmark %q: %w: %q", b.Name, bookmark.ErrUnknownBrowser, *p.BrowserName)
+	}
+	if p.URL != nil {
+		b.URL = *p.URL
+	}
+	if p.Archived != nil {
+		b.Archived = *p.Archived
+	}
+	if p.BrowserName != nil {
+		b.BrowserName = *p.BrowserName
+	}
+	if p.Tags != nil {
+		b.Tags = bookmark.NormalizeTags(*p.Tags)
+	}
+	remove := bookmark.NormalizeTags(p.RemoveTags)
+	b.Tags = slices.DeleteFunc(b.Tags, func(tag string) bool { return slices.Contains(remove, tag) })
+	b.Tags = bookmark.NormalizeTags(append(b.Tags, p.AddTags...))
+	slices.Sort(b.Tags)
+	return nil
+}
+
+// list returns copies of the bookmarks outside the trash that match the
+// filter, sorted by name.
+func (s *State) list(includeArchived bool, f bookmark.Filter) ([]bookmark.Bookmark, error) {
+	tag := bookmark.NormalizeTag(f.Tag)
+	var bookmarks []bookmark.Bookmark
+	for _, b := range s.Bookmarks {
+		if b.DeletedAt != nil || (b.Archived && !includeArchived) {
+			continue
+		}
+		if tag != "" && !bookmark.HasTag(b.Tags, tag) {
+			continue
+		}
+		if f.BrowserName != "" && b.BrowserName != f.BrowserName {
+			continue
+		}
+		if f.URLGlob != "" {
+			ok, err := bookmark.MatchURLGlob(b.URL, f.URLGlob)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		bookmarks = append(bookmarks, cloneBookmark(b))
+	}
+	return bookmarks, nil
+}
+
+// renameTag renames a tag together with its subtree in every bookmark,
+// including the ones in the trash.
+func (s *State) renameTag(from, to string) error {
+	from, to = bookmark.NormalizeTag(from), bookmark.NormalizeTag(to)
+	if from == "" || to == "" {
+		return fmt.Errorf("tag must not be empty")
+	}
+	found := false
+	for i := range s.Bookmarks {
+		b := &s.Bookmarks[i]
+		var renamed []string
+		b.Tags = slices.DeleteFunc(b.Tags, func(tag string) bool {
+			if !bookmark.TagMatches(tag, from) {
+				return false
+			}
+			renamed = append(renamed, to+strings.TrimPrefix(tag, from))
+			return true
+		})
+		if len(renamed) == 0 {
+			continue
+		}
+		found = true
+		b.Tags = bookmark.NormalizeTags(append(b.Tags, renamed...))
+		slices.Sort(b.Tags)
+	}
+	// A tag that already has a default keeps it.
+	renamedDefaults := map[string]string{}
+	for tag := range s.TagBrowsers {
+		if bookmark.TagMatches(tag, from) {
+			renamedDefaults[to+strings.TrimPrefix(tag, from)] = s.TagBrowsers[tag]
+			delete(s.TagBrowsers, tag)
+			found = true
+		}
+	}
+	for tag, browser := range renamedDefaults {
+		if _, ok := s.TagBrowsers[tag]; !ok {
+			s.TagBrowsers[tag] = browser
+		}
+	}
+	for i := range s.Rules {
+		if tag := s.Rules[i].Tag; tag != "" && bookmark.TagMatches(tag, from) {
+			s.Rules[i].Tag = to + strings.TrimPrefix(tag, from)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("tag %w: %q", bookmark.ErrNotFound, from)
+	}
+	return nil
+}
+
+func (s *State) get(name string) (bookmark.Bookmark, error) {
+	i := s.liveBookmark(name)
+	if i < 0 {
+		return bookmark.Bookmark{}, fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+	}
+	return cloneBookmark(s.Bookmarks[i]), nil
+}
+
+// trash lists the deleted bookmarks, most recently deleted first.
+func (s *State) trash() []bookmark.Bookmark {
+	var bookmarks []bookmark.Bookmark
+	for _, b := range s.Bookmarks {
+		if b.DeletedAt != nil {
+			bookmarks = append(bookmarks, cloneBookmark(b))
+		}
+	}
+	slices.SortStableFunc(bookmarks, func(a, b bookmark.Bookmark) int { return b.DeletedAt.Compare(*a.DeletedAt) })
+	return bookmarks
+}
+
+func (s *State) restore(name string) error {
+	i := s.bookmark(name)
+	if i < 0 || s.Bookmarks[i].DeletedAt == nil {
+		return fmt.Errorf("%w in the trash: %q", bookmark.ErrBookmarkNotFound, name)
+	}
+	s.Bookmarks[i].DeletedAt = nil
+	return nil
+}
+
+func (s *State) purge(before time.Time) int64 {
+	var purged int64
+	s.Bookmarks = slices.DeleteFunc(s.Bookmarks, func(b bookmark.Bookmark) bool {
+		if b.DeletedAt == nil || b.DeletedAt.Unix() > before.Unix() {
+			return false
+		}
+		purged++
+		return true
+	})
+	return purged
+}
+
+func (s *State) addBrowser(b bookmark.Browser) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	if s.browser(b.Name) >= 0 {
+		return bookmark.ErrDuplicateBrowser
+	}
+	if b.Default {
+		s.setDefaultBrowser("")
+	}
+	s.Browsers = append(s.Browsers, cloneBrowser(b))
+	s.Sort()
+	return nil
+}
+
+// setDefaultBrowser marks a browser profile as the default. An empty name
+// clears the default.
+func (s *State) setDefaultBrowser(name string) error {
+	if name != "" && s.browser(name) < 0 {
+		return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+	}
+	for i := range s.Browsers {
+		s.Browsers[i].Default = s.Browsers[i].Name == name
+	}
+	return nil
+}
+
+// delBrowser removes a browser profile like the foreign keys of the SQLite
+// schema do: bookmarks lose their association, rules and tag defaults go.
+func (s *State) delBrowser(name string) error {
+	i := s.browser(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+	}
+	s.Browsers = slices.Delete(s.Browsers, i, i+1)
+	for j := range s.Bookmarks {
+		if s.Bookmarks[j].BrowserName == name {
+			s.Bookmarks[j].BrowserName = ""
+		}
+	}
+	s.Rules = slices.DeleteFunc(s.Rules, func(r storedRule) bool { return r.BrowserName == name })
+	for tag, browser := range s.TagBrowsers {
+		if browser == name {
+			delete(s.TagBrowsers, tag)
+		}
+	}
+	return nil
+}
+
+func (s *State) lsBrowsers() []bookmark.Browser {
+	var browsers []bookmark.Browser
+	for _, b := range s.Browsers {
+		browsers = append(browsers, cloneBrowser(b))
+	}
+	return browsers
+}
+
+func (s *State) getBrowser(name string) (bookmark.Browser, error) {
+	i := s.browser(name)
+	if i < 0 {
+		return bookmark.Browser{}, fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+	}
+	return cloneBrowser(s.Browsers[i]), nil
+}
+
+func (s *State) updateBrowser(name string, p bookmark.BrowserPatch) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	i := s.browser(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+	}
+	s.Browsers[i] = p.Apply(s.Browsers[i])
+	return nil
+}
+
+func (s *State) setTagBrowser(tag, browser string) error {
+	tag = bookmark.NormalizeTag(tag)
+	if tag == "" {
+		return fmt.Errorf("tag must not be empty")
+	}
+	if browser == "" {
+		if _, ok := s.TagBrowsers[tag]; !ok {
+			return fmt.Errorf("tag %q has no default browser profile", tag)
+		}
+		delete(s.TagBrowsers, tag)
+		return nil
+	}
+	if s.browser(browser) < 0 {
+		return fmt.Errorf("tag %q: %w: %q", tag, bookmark.ErrUnknownBrowser, browser)
+	}
+	if s.TagBrowsers == nil {
+		s.TagBrowsers = map[string]string{}
+	}
+	s.TagBrowsers[tag] = browser
+	return nil
+}
+
+func (s *State) lsTagBrowsers() map[string]string {
+	tagBrowsers := make(map[string]string, len(s.TagBrowsers))
+	for tag, browser := range s.TagBrowsers {
+		tagBrowsers[tag] = browser
+	}
+	return tagBrowsers
+}
+
+func (s *State) addCollection(name string) error {
+	if s.collection(name) >= 0 {
+		return bookmark.ErrDuplicateCollection
+	}
+	s.Collections = append(s.Collections, bookmark.Collection{Name: name})
+	s.Sort()
+	return nil
+}
+
+func (s *State) delCollection(name string) error {
+	i := s.collection(name)
+	if i < 0 {
+		return fmt.Errorf("collection %w: %q", bookmark.ErrNotFound, name)
+	}
+	s.Collections = slices.Delete(s.Collections, i, i+1)
+	return nil
+}
+
+func (s *State) lsCollections() []bookmark.Collection {
+	var collections []bookmark.Collection
+	for _, c := range s.Collections {
+		collections = append(collections, bookmark.Collection{Name: c.Name, Bookmarks: slices.Clone(c.Bookmarks)})
+	}
+	return collections
+}
+
+func (s *State) getCollection(name string) (bookmark.Collection, error) {
+	i := s.collection(name)
+	if i < 0 {
+		return bookmark.Collection{}, fmt.Errorf("collection %w: %q", bookmark.ErrNotFound, name)
+	}
+	return bookmark.Collection{Name: name, Bookmarks: slices.Clone(s.Collections[i].Bookmarks)}, nil
+}
+
+// editCollection rewrites the ordered membership of a collection. Members
+// must be bookmarks outside the trash.
+func (s *State) editCollection(name string, edit func(*bookmark.Collection) error) error {
+	i := s.collection(name)
+	if i < 0 {
+		return fmt.Errorf("collection %w: %q", bookmark.ErrNotFound, name)
+	}
+	c := bookmark.Collection{Name: name, Bookmarks: slices.Clone(s.Collections[i].Bookmarks)}
+	if err := edit(&c); err != nil {
+		return err
+	}
+	for _, member := range c.Bookmarks {
+		if s.liveBookmark(member) < 0 {
+			return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, member)
+		}
+	}
+	s.Collections[i].Bookmarks = c.Bookmarks
+	return nil
+}
+
+// addRule inserts a routing rule at the given 1-based position and returns
+// its ID. IDs are never reused while the rule with the highest one exists.
+func (s *State) addRule(rule bookmark.Rule, position int) (int64, error) {
+	rule.Tag = bookmark.NormalizeTag(rule.Tag)
+	if err := rule.Validate(); err != nil {
+		return 0, err
+	}
+	if s.browser(rule.BrowserName) < 0 {
+		return 0, fmt.Errorf("rule %s: %w: %q", rule, bookmark.ErrUnknownBrowser, rule.BrowserName)
+	}
+	var id int64
+	for _, r := range s.Rules {
+		id = max(id, r.ID)
+	}
+	id++
+	rule.ID = 0
+	stored := storedRule{ID: id, Rule: rule}
+	if position <= 0 || position > len(s.Rules) {
+		s.Rules = append(s.Rules, stored)
+	} else {
+		s.Rules = slices.Insert(s.Rules, position-1, stored)
+	}
+	return id, nil
+}
+
+func (s *State) delRule(id int64) error {
+	i := slices.IndexFunc(s.Rules, func(r storedRule) bool { return r.ID == id })
+	if i < 0 {
+		return fmt.Errorf("rule %w: %d", bookmark.ErrNotFound, id)
+	}
+	s.Rules = slices.Delete(s.Rules, i, i+1)
+	return nil
+}
+
+func (s *State) lsRules() []bookmark.Rule {
+	var rules []bookmark.Rule
+	for _, r := range s.Rules {
+		rule := r.Rule
+		rule.ID = r.ID
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// dump returns a copy of the state as a Dump.
+func (s *State) dump() bookmark.Dump {
+	c := s.Clone()
+	d := bookmark.Dump{
+		Version:     bookmark.DumpVersion,
+		Browsers:    c.Browsers,
+		Bookmarks:   c.Bookmarks,
+		Collections: c.Collections,
+		TagBrowsers: c.TagBrowsers,
+	}
+	for _, r := range c.Rules {
+		rule := r.Rule
+		rule.ID = 0
+		d.Rules = append(d.Rules, rule)
+	}
+	return d
+}
+
+// importDump imports a validated dump with the same semantics as the
+// SQLite repository. On error the state is left half-written, so callers
+// work on a clone.
+func (s *State) importDump(d bookmark.Dump, mode bookmark.ImportMode) (bookmark.ImportResult, error) {
+	var result bookmark.ImportResult
+	if mode == bookmark.ImportReplace {
+		*s = *New()
+	}
+
+	defaultBrowser := ""
+	for _, b := range d.Browsers {
+		i := s.browser(b.Name)
+		var local bookmark.Browser
+		if i >= 0 {
+			local = s.Browsers[i]
+		}
+		if !result.Reconcile(mode, "browser profile", b.Name, i >= 0, bookmark.SameJSON(local, b)) {
+			continue
+		}
+		if i >= 0 {
+			s.Browsers[i] = cloneBrowser(b)
+		} else {
+			s.Browsers = append(s.Browsers, cloneBrowser(b))
+		}
+		if b.Default {
+			defaultBrowser = b.Name
+		}
+	}
+	s.Sort()
+	if defaultBrowser != "" {
+		if err := s.setDefaultBrowser(defaultBrowser); err != nil {
+			return result, err
+		}
+	}
+
+	for _, b := range d.Bookmarks {
+		i := s.bookmark(b.Name)
+		var local bookmark.Bookmark
+		if i >= 0 {
+			local = s.Bookmarks[i]
+		}
+		if !result.Reconcile(mode, "bookmark", b.Name, i >= 0, bookmark.SameJSON(local, b)) {
+			continue
+		}
+		if b.BrowserName != "" && s.browser(b.BrowserName) < 0 {
+			return result, fmt.Errorf("bookmark %q: %w: %q", b.Name, bookmark.ErrUnknownBrowser, b.BrowserName)
+		}
+		if i >= 0 {
+			s.Bookmarks[i] = cloneBookmark(b)
+		} else {
+			s.Bookmarks = append(s.Bookmarks, cloneBookmark(b))
+		}
+	}
+	s.Sort()
+
+	for _, c := range d.Collections {
+		i := s.collection(c.Name)
+		var local []string
+		if i >= 0 {
+			local = s.Collections[i].Bookmarks
+		}
+		if !result.Reconcile(mode, "collection", c.Name, i >= 0, slices.Equal(local, c.Bookmarks)) {
+			continue
+		}
+		for _, member := range c.Bookmarks {
+			if s.liveBookmark(member) < 0 {
+				return result, fmt.Errorf("collection %q: %w: %q", c.Name, bookmark.ErrBookmarkNotFound, member)
+			}
+		}
+		if i < 0 {
+			s.Collections = append(s.Collections, bookmark.Collection{Name: c.Name})
+			s.Sort()
+			i = s.collection(c.Name)
+		}
+		s.Collections[i].Bookmarks = slices.Clone(c.Bookmarks)
+	}
+
+	for _, rule := range d.Rules {
+		if slices.ContainsFunc(s.Rules, func(local storedRule) bool {
+			return local.Host == rule.Host && local.Regex == rule.Regex &&
+				local.Tag == rule.Tag && local.BrowserName == rule.BrowserName
+		}) {
+			result.Unchanged++
+			continue
+		}
+		result.Added++
+		if _, err := s.addRule(rule, 0); err != nil {
+			return result, fmt.Errorf("rule %s: %w", rule, err)
+		}
+	}
+
+	tags := make([]string, 0, len(d.TagBrowsers))
+	for tag := range d.TagBrowsers {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		browser := d.TagBrowsers[tag]
+		local, exists := s.TagBrowsers[tag]
+		if !result.Reconcile(mode, "tag default", tag, exists, local == browser) {
+			continue
+		}
+		if err := s.setTagBrowser(tag, browser); err != nil {
+			return result, fmt.Errorf("tag default %q: %w", tag, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,47 @@
+package launch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrInvalidBinary is returned when a browser binary cannot be run.
+var ErrInvalidBinary = errors.New("invalid browser binary")
+
+// CheckBinary verifies that path is an absolute path to an executable file.
+func CheckBinary(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%w %q: not an absolute path", ErrInvalidBinary, path)
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w %q: does not exist", ErrInvalidBinary, path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w %q: %w", ErrInvalidBinary, path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w %q: is a directory", ErrInvalidBinary, path)
+	}
+	if info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("%w %q: not executable", ErrInvalidBinary, path)
+	}
+	return nil
+}
+
+// ResolveBinary returns the absolute path of name, looking it up in $PATH
+// unless it contains a path separator.
+func ResolveBinary(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidBinary, err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", fmt.Errorf("%w %q: %w", ErrInvalidBinary, name, err)
+	}
+	return path, CheckBinary(path)
+}
@@ -0,0 +1,45 @@
+package launch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBinary(t *testing.T) {
+	dir := t.TempDir()
+	browser := filepath.Join(dir, "browser")
+	if err := os.WriteFile(browser, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckBinary(browser); err != nil {
+		t.Errorf("CheckBinary(%q) error = %v", browser, err)
+	}
+	for _, path := range []string{"browser", plain, dir, filepath.Join(dir, "missing")} {
+		if err := CheckBinary(path); !errors.Is(err, ErrInvalidBinary) {
+			t.Errorf("CheckBinary(%q) error = %v, want ErrInvalidBinary", path, err)
+		}
+	}
+}
+
+func TestResolveBinary(t *testing.T) {
+	dir := t.TempDir()
+	browser := filepath.Join(dir, "my-browser")
+	if err := os.WriteFile(browser, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	if got, err := ResolveBinary("my-browser"); err != nil || got != browser {
+		t.Errorf("ResolveBinary() = %q, %v; want %q", got, err, browser)
+	}
+	if _, err := ResolveBinary("no-such-browser"); !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("ResolveBinary() error = %v, want ErrInvalidBinary", err)
+	}
+}
@@ -0,0 +1,154 @@
+// Package launch opens URLs in browsers.
+package launch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrFailed is returned when a browser command could not be started or, with
+// Options.Wait, exited unsuccessfully.
+var ErrFailed = errors.New("browser command failed")
+
+// Options control how a browser is started.
+type Options struct {
+	// Wait waits for the browser command to exit and reports its exit
+	// status, instead of returning once it started.
+	Wait bool
+	// Log is the path of a file that diagnostics are appended to. Empty
+	// disables logging.
+	Log string
+	// Env holds KEY=VALUE pairs added to the inherited environment, see
+	// ExpandEnv.
+	Env []string
+	// Dir is the working directory; empty inherits it. $VAR is expanded.
+	Dir string
+}
+
+// Default opens URLs with the default browser of the OS.
+func Default(urls []string, opts Options) error {
+	commands, err := DefaultCommands(urls)
+	if err != nil {
+		return err
+	}
+	for _, argv := range commands {
+		if err := Run(argv[0], argv[1:], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultCommands returns the command lines Default runs to open URLs.
+// xdg-open only accepts a single URL, so it is invoked once per URL.
+func DefaultCommands(urls []string) ([][]string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{append([]string{"open"}, urls...)}, nil
+	case "linux":
+		commands := make([][]string, 0, len(urls))
+		for _, url := range urls {
+			commands = append(commands, []string{"xdg-open", url})
+		}
+		return commands, nil
+	default:
+		return nil, fmt.Errorf("unsupported platform %s: assign a browser profile to this bookmark", runtime.GOOS)
+	}
+}
+
+// Run starts the browser binary at path with args.
+func Run(path string, args []string, opts Options) error {
+	cmd := exec.Command(path, args...)
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), ExpandEnv(opts.Env)...)
+	}
+	cmd.Dir = os.ExpandEnv(opts.Dir)
+
+	logf, err := openLogFile(opts.Log)
+	if err != nil {
+		return err
+	}
+	if logf != nil {
+		defer func() { _ = logf.Close() }()
+		_, _ = fmt.Fprintf(logf, "command: %q\n", append([]string{path}, args...))
+		if len(opts.Env) > 0 {
+			_, _ = fmt.Fprintf(logf, "env: %q\n", ExpandEnv(opts.Env))
+		}
+		if cmd.Dir != "" {
+			_, _ = fmt.Fprintf(logf, "dir: %s\n", cmd.Dir)
+		}
+		_, _ = fmt.Fprintf(logf, "wait: %t\n", opts.Wait)
+	}
+
+	if opts.Wait {
+		// executes cmd and waits for it to finish
+		output, err := cmd.CombinedOutput()
+		if logf != nil {
+			if len(output) > 0 {
+				_, _ = fmt.Fprintf(logf, "output:\n%s\n", output)
+			}
+			_, _ = fmt.Fprintf(logf, "exit error: %v\n\n", err)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrFailed, path, err)
+		}
+		return nil
+	}
+
+	// executes cmd and return immediately
+	if err := cmd.Start(); err != nil {
+		if logf != nil {
+			_, _ = fmt.Fprintf(logf, "start error: %v\n\n", err)
+		}
+		return fmt.Errorf("%w: %s: %w", ErrFailed, path, err)
+	}
+	if logf != nil {
+		_, _ = fmt.Fprintf(logf, "pid: %d\n\n", cmd.Process.Pid)
+	}
+	return nil
+}
+
+// ExpandEnv expands $VAR and ${VAR} in the values of KEY=VALUE pairs.
+// Variables refer to earlier pairs first, then to the environment of bm,
+// so PATH=$HOME/bin:$PATH extends the inherited PATH.
+func ExpandEnv(env []string) []string {
+	set := map[string]string{}
+	expanded := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		value = os.Expand(value, func(name string) string {
+			if v, ok := set[name]; ok {
+				return v
+			}
+			return os.Getenv(name)
+		})
+		set[key] = value
+		expanded = append(expanded, key+"="+value)
+	}
+	return expanded
+}
+
+// AppendLog writes a formatted line to the diagnostics log at path, if one
+// is set.
+func AppendLog(path, format string, args ...any) error {
+	logf, err := openLogFile(path)
+	if err != nil || logf == nil {
+		return err
+	}
+	_, err = fmt.Fprintf(logf, format, args...)
+	if closeErr := logf.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func openLogFile(path string) (*os.File, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+}
@@ -0,0 +1,63 @@
+package launch
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("BM_TEST_HOME", "/home/me")
+	t.Setenv("BM_TEST_PATH", "/usr/bin")
+
+	got := ExpandEnv([]string{
+		"MOZ_ENABLE_WAYLAND=1",
+		"BM_TEST_PATH=$BM_TEST_HOME/bin:$BM_TEST_PATH",
+		"XDG_CONFIG_HOME=${BM_TEST_HOME}/.config/work",
+		"SEEN=$BM_TEST_PATH",
+		"EMPTY=$BM_TEST_UNSET",
+		"EQUALS=a=b",
+	})
+	want := []string{
+		"MOZ_ENABLE_WAYLAND=1",
+		"BM_TEST_PATH=/home/me/bin:/usr/bin",
+		"XDG_CONFIG_HOME=/home/me/.config/work",
+		"SEEN=/home/me/bin:/usr/bin",
+		"EMPTY=",
+		"EQUALS=a=b",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ExpandEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestRunEnvDir(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	t.Setenv("BM_TEST_DIR", dir)
+
+	err := Run("/bin/sh", []string{"-c", `printf '%s\n%s\n' "$BM_TEST_VAR" "$PWD" > "$0"`, out}, Options{
+		Wait: true,
+		Env:  []string{"BM_TEST_VAR=in $BM_TEST_DIR"},
+		Dir:  "$BM_TEST_DIR",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "in " + dir + "\n" + dir + "\n"
+	if got := string(data); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if strings.Contains(os.Getenv("BM_TEST_VAR"), "in") {
+		t.Error("Env leaked into the environment of bm")
+	}
+}
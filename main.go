@@ -1,28 +1,109 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/alecthomas/kong"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/store/file"
+	"github.com/allaman/bm/store/sqlite"
 )
 
 var Version = "dev"
 
 func main() {
+	os.Exit(run())
+}
+
+// run parses the command line, runs the selected command and returns the
+// exit code.
+func run() int {
 	cli := CLI{}
-	ctx := kong.Parse(&cli,
+	// Invalid command lines fail before --json-errors itself is parsed.
+	jsonErrors := hasFlag(os.Args[1:], "--json-errors")
+	options := []kong.Option{
 		kong.Name("bm"),
 		kong.Description("A minimal bookmarking management CLI"),
-		kong.UsageOnError())
-	repository, err := NewSQLiteRepository(cli.Path)
+		kong.Exit(func(code int) {
+			// kong only exits non-zero on invalid command lines.
+			if code != exitOK {
+				code = exitUsage
+			}
+			os.Exit(code)
+		}),
+	}
+	if !jsonErrors {
+		options = append(options, kong.UsageOnError())
+	}
+	parser := kong.Must(&cli, options...)
+	ctx, err := parser.Parse(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		if jsonErrors {
+			return writeError(os.Stderr, err, exitUsage, true)
+		}
+		parser.FatalIfErrorf(err)
+	}
+
+	repository, closeRepository, err := openRepository(&cli)
+	if err != nil {
+		return writeError(os.Stderr, err, exitCode(err), cli.JSONErrors)
 	}
 	defer func() {
-		if err := repository.db.Close(); err != nil {
+		if err := closeRepository(); err != nil {
 			log.Printf("error closing database connection: %v", err)
 		}
 	}()
-	err = ctx.Run(&Context{Repository: repository})
-	ctx.FatalIfErrorf(err)
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cli.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, cli.Timeout)
+		defer cancel()
+	}
+
+	if err := ctx.Run(&Context{Context: runCtx, Repository: repository}); err != nil {
+		return writeError(os.Stderr, err, exitCode(err), cli.JSONErrors)
+	}
+	return exitOK
+}
+
+// openRepository opens the backend selected by --backend and --path.
+func openRepository(cli *CLI) (bookmark.Repository, func() error, error) {
+	backend := cli.Backend
+	if backend == "auto" {
+		backend = "sqlite"
+		if strings.EqualFold(filepath.Ext(cli.Path), ".json") {
+			backend = "file"
+		}
+	}
+
+	if backend == "file" {
+		var opts []file.Option
+		if cli.Git {
+			opts = append(opts, file.WithGitCommit())
+		}
+		repository, err := file.New(cli.Path, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return repository, func() error { return nil }, nil
+	}
+
+	if cli.Git {
+		return nil, nil, fmt.Errorf("--git needs the file backend")
+	}
+	repository, err := sqlite.New(cli.Path, sqlite.WithBusyTimeout(cli.BusyTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	return repository, repository.Close, nil
 }
@@ -0,0 +1,222 @@
+// Package file implements bookmark.Repository on a JSON file that diffs and
+// merges well in version control.
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/allaman/bm/internal/state"
+)
+
+// Repository keeps all data in a single JSON file. The file has the layout
+// written by Export, plus the IDs of the routing rules, and is sorted so
+// equal data gives equal files. Reads need no lock because changes replace
+// the file atomically; writers take an exclusive lock on <path>.lock, which
+// is removed again. There is no change log, use WithGitCommit and git
+// instead.
+type Repository struct {
+	state.Repository
+	store *store
+}
+
+type store struct {
+	path string
+	git  bool
+}
+
+// Option configures a Repository.
+type Option func(*store)
+
+// WithGitCommit commits every change of the file to the git repository
+// containing it.
+func WithGitCommit() Option {
+	return func(st *store) { st.git = true }
+}
+
+// New opens the file at path, creating it if it does not exist.
+func New(path string, opts ...Option) (*Repository, error) {
+	st := &store{path: path}
+	for _, opt := range opts {
+		opt(st)
+	}
+
+	if st.git {
+		if err := st.runGit(context.Background(), "rev-parse", "--git-dir"); err != nil {
+			return nil, fmt.Errorf("%s is not in a git repository: %w", path, err)
+		}
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		err := st.Update(context.Background(), "create "+filepath.Base(path), func(*state.State) error { return nil })
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &Repository{Repository: state.NewRepository(st), store: st}, nil
+}
+
+func (st *store) View(ctx context.Context, fn func(*state.State) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s, err := st.load()
+	if err != nil {
+		return err
+	}
+	return fn(s)
+}
+
+// Update runs fn on the current contents of the file while holding the
+// lock and replaces the file if anything changed.
+func (st *store) Update(ctx context.Context, op string, fn func(*state.State) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock, err := lockFile(ctx, st.path+".lock")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Printf("error unlocking %s: %v", st.path, err)
+		}
+	}()
+
+	before, err := os.ReadFile(st.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+	s, err := st.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		return err
+	}
+	s.Sort()
+	after, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	after = append(after, '\n')
+	if exists && bytes.Equal(before, after) {
+		return nil
+	}
+
+	if err := writeFileAtomic(st.path, after); err != nil {
+		return err
+	}
+	if st.git {
+		// The change is saved; finish committing it even if ctx is done.
+		if err := st.commit(context.WithoutCancel(ctx), op); err != nil {
+			return fmt.Errorf("saved, but committing to git failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// load reads the file. A missing file holds no data.
+func (st *store) load() (*state.State, error) {
+	data, err := os.ReadFile(st.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state.New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := state.New()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", st.path, err)
+	}
+	if err := s.Check(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", st.path, err)
+	}
+	return s, nil
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so readers see either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing %s: %v", tmpPath, err)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (st *store) commit(ctx context.Context, op string) error {
+	name := filepath.Base(st.path)
+	if err := st.runGit(ctx, "add", "--", name); err != nil {
+		return err
+	}
+	// diff --quiet fails when there is something to commit.
+	if st.runGit(ctx, "diff", "--cached", "--quiet", "--", name) == nil {
+		return nil
+	}
+	return st.runGit(ctx, "commit", "--quiet", "--message", "bm: "+op, "--", name)
+}
+
+func (st *store) runGit(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", filepath.Dir(st.path)}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// lockRetryInterval is how often a writer checks whether the lock was
+// released.
+const lockRetryInterval = 10 * time.Millisecond
+
+// lockFile takes the lock at path, waiting until it is released or ctx is
+// done.
+func lockFile(ctx context.Context, path string) (unlock func() error, err error) {
+	for {
+		unlock, ok, err := tryLockFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+		if ok {
+			return unlock, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/bookmark/bookmarktest"
+	"github.com/allaman/bm/internal/state"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRepository(t *testing.T) {
+	bookmarktest.Run(t, bookmarktest.Backend{
+		Open: func(t *testing.T) bookmark.Repository {
+			repo, err := New(filepath.Join(t.TempDir(), "bm.json"))
+			if err != nil {
+				t.Fatalf("failed to create test file: %v", err)
+			}
+			return repo
+		},
+		BackdateTrash: func(t *testing.T, repo bookmark.Repository, name string, d time.Duration) {
+			err := repo.(*Repository).store.Update(context.Background(), "backdate", func(s *state.State) error {
+				i := slices.IndexFunc(s.Bookmarks, func(b bookmark.Bookmark) bool { return b.Name == name })
+				deleted := s.Bookmarks[i].DeletedAt.Add(-d)
+				s.Bookmarks[i].DeletedAt = &deleted
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to backdate deletion: %v", err)
+			}
+		},
+		// History is kept by git, see --git.
+		NoChangeLog: true,
+	})
+}
+
+func TestDeterministic(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bookmarks := []bookmark.Bookmark{
+		{Name: "b", URL: "https://b.com", Tags: []string{"z", "a"}},
+		{Name: "a", URL: "https://a.com", Tags: []string{"m"}},
+	}
+
+	var files [2][]byte
+	for i := range files {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		repo, err := New(path)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		for j := range bookmarks {
+			// Add in a different order each time.
+			b := bookmarks[(i+j)%len(bookmarks)]
+			if err := repo.Add(ctx, b); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+		}
+		if files[i], err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(files[0]) != string(files[1]) {
+		t.Errorf("files differ:\n%s\n%s", files[0], files[1])
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bm.json")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for w := range 4 {
+		repo, err := New(path)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 10 {
+				errs <- repo.Add(ctx, bookmark.Bookmark{Name: fmt.Sprintf("w%d-%d", w, i), URL: "https://example.com"})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	repo, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	got, err := repo.Ls(ctx, true)
+	if err != nil {
+		t.Fatalf("Ls() error = %v", err)
+	}
+	if len(got) != 40 {
+		t.Errorf("got %d bookmarks, want 40", len(got))
+	}
+	if _, err := os.Stat(path + ".lock"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestGitCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return string(out)
+	}
+
+	if _, err := New(filepath.Join(dir, "bm.json"), WithGitCommit()); err == nil {
+		t.Fatal("expected error outside a git repository")
+	}
+
+	git("init", "--quiet")
+	git("config", "user.name", "test")
+	git("config", "user.email", "test@example.com")
+	repo, err := New(filepath.Join(dir, "bm.json"), WithGitCommit())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Google", URL: "https://google.com"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := repo.Update(ctx, "Google", bookmark.BookmarkPatch{URL: ptr("https://google.com")}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	log := git("log", "--format=%s")
+	if want := "bm: add bookmark \"Google\"\nbm: create bm.json\n"; log != want {
+		t.Errorf("git log = %q, want %q", log, want)
+	}
+	if status := git("status", "--porcelain"); status != "" {
+		t.Errorf("git status = %q, want a clean tree", status)
+	}
+}
+
+func TestRejectsInvalidContents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bm.json")
+	contents := `{"version": 1, "bookmarks": [{"name": "a", "url": "https://a.com"}, {"name": "a", "url": "https://b.com"}]}`
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := repo.Ls(context.Background(), true); err == nil || !strings.Contains(err.Error(), "appears twice") {
+		t.Errorf("Ls() error = %v, want duplicate bookmark reported", err)
+	}
+}
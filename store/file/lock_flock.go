@@ -0,0 +1,53 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an advisory lock on the file at path without waiting.
+// The lock is released by the kernel if the process dies. Unlocking removes
+// the file, so it does not linger next to the data.
+func tryLockFile(path string) (unlock func() error, ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	// The previous holder may have removed the file after we opened it, and
+	// a lock on a removed file excludes nobody. Try again then.
+	if current, err := isFile(f, path); err != nil || !current {
+		_ = f.Close()
+		return nil, false, err
+	}
+	unlock = func() error {
+		// Remove before closing, while others still wait for this file.
+		return errors.Join(os.Remove(path), f.Close())
+	}
+	return unlock, true, nil
+}
+
+// isFile reports whether path still names the open file f.
+func isFile(f *os.File, path string) (bool, error) {
+	open, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(open, current), nil
+}
@@ -0,0 +1,24 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLockFile takes the lock by creating the file at path without waiting.
+// A lock left behind by a crashed process has to be removed by hand.
+func tryLockFile(path string) (unlock func() error, ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	unlock = func() error {
+		return errors.Join(f.Close(), os.Remove(path))
+	}
+	return unlock, true, nil
+}
@@ -0,0 +1,54 @@
+// Package memory implements bookmark.Repository in memory, for embedding bm
+// and for tests.
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/allaman/bm/internal/state"
+)
+
+// Repository keeps all data in memory. It is safe for concurrent use. Like
+// the file backend it keeps no change log.
+type Repository struct {
+	state.Repository
+	store *store
+}
+
+// New returns an empty Repository.
+func New() *Repository {
+	s := &store{s: state.New()}
+	return &Repository{Repository: state.NewRepository(s), store: s}
+}
+
+type store struct {
+	mu sync.RWMutex
+	s  *state.State
+}
+
+func (st *store) View(ctx context.Context, fn func(*state.State) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	st.mu.RLock()
+	s := st.s.Clone()
+	st.mu.RUnlock()
+	return fn(s)
+}
+
+// Update runs fn on a copy of the data and keeps it only if fn succeeds.
+func (st *store) Update(ctx context.Context, op string, fn func(*state.State) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.s.Clone()
+	if err := fn(s); err != nil {
+		return err
+	}
+	s.Sort()
+	st.s = s
+	return nil
+}
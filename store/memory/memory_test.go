@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/bookmark/bookmarktest"
+	"github.com/allaman/bm/internal/state"
+)
+
+func TestRepository(t *testing.T) {
+	bookmarktest.Run(t, bookmarktest.Backend{
+		Open: func(t *testing.T) bookmark.Repository { return New() },
+		BackdateTrash: func(t *testing.T, repo bookmark.Repository, name string, d time.Duration) {
+			err := repo.(*Repository).store.Update(context.Background(), "backdate", func(s *state.State) error {
+				i := slices.IndexFunc(s.Bookmarks, func(b bookmark.Bookmark) bool { return b.Name == name })
+				deleted := s.Bookmarks[i].DeletedAt.Add(-d)
+				s.Bookmarks[i].DeletedAt = &deleted
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to backdate deletion: %v", err)
+			}
+		},
+		NoChangeLog: true,
+	})
+}
+
+func TestConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	repo := New()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for w := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range 25 {
+				name := fmt.Sprintf("w%d-%d", w, i)
+				if err := repo.Add(ctx, bookmark.Bookmark{Name: name, URL: "https://example.com", Tags: []string{"t"}}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if _, err := repo.LsByTag(ctx, "t", false); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	got, err := repo.Ls(ctx, false)
+	if err != nil {
+		t.Fatalf("Ls() error = %v", err)
+	}
+	if len(got) != 100 {
+		t.Errorf("got %d bookmarks, want 100", len(got))
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	ctx := context.Background()
+	repo := New()
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Wiki", URL: "https://wiki.org", Tags: []string{"docs"}}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Results must not share memory with the stored data.
+	b, err := repo.Get(ctx, "Wiki")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	b.Tags[0] = "changed"
+	if b, _ := repo.Get(ctx, "Wiki"); b.Tags[0] != "docs" {
+		t.Errorf("changing a result changed the repository: %+v", b)
+	}
+
+	// A failing change leaves nothing behind.
+	failing := errors.New("fail")
+	err = repo.store.Update(ctx, "test", func(s *state.State) error {
+		s.Bookmarks[0].URL = "https://changed.org"
+		return failing
+	})
+	if !errors.Is(err, failing) {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if b, _ := repo.Get(ctx, "Wiki"); b.URL != "https://wiki.org" {
+		t.Errorf("failed update changed the repository: %+v", b)
+	}
+}
@@ -0,0 +1,501 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"slices"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// currentActor identifies who is making changes, falling back to
+// environment variables when the OS lookups fail.
+func currentActor() (host, username string) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	} else if username = os.Getenv("USER"); username == "" {
+		username = "unknown"
+	}
+	return host, username
+}
+
+// changeLog records the changes made within one transaction as one batch.
+// It carries the context of the transaction it belongs to. Changed entities
+// get a new modification stamp, or a tombstone when they were removed,
+// unless keepStamps is set because the caller writes the stamps itself.
+type changeLog struct {
+	ctx        context.Context
+	tx         *sql.Tx
+	repo       *Repository
+	op         string
+	batch      int64
+	keepStamps bool
+}
+
+func (r *Repository) newChangeLog(ctx context.Context, tx *sql.Tx, op string) (*changeLog, error) {
+	var batch int64
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(batch), 0) + 1 FROM changes").Scan(&batch); err != nil {
+		return nil, err
+	}
+	return &changeLog{ctx: ctx, tx: tx, repo: r, op: op, batch: batch}, nil
+}
+
+// bookmarks snapshots the named bookmarks around mutate and records every
+// one of them that changed.
+func (l *changeLog) bookmarks(names []string, mutate func() error) error {
+	return l.track(bookmark.EntityBookmark, names, mutate)
+}
+
+// browsers snapshots the named browser profiles around mutate and records
+// every one of them that changed.
+func (l *changeLog) browsers(names []string, mutate func() error) error {
+	return l.track(bookmark.EntityBrowser, names, mutate)
+}
+
+// collections snapshots the named collections around mutate and records
+// every one of them that changed.
+func (l *changeLog) collections(names []string, mutate func() error) error {
+	return l.track(bookmark.EntityCollection, names, mutate)
+}
+
+// track records the entities whose snapshot or dependents changed. Only a
+// changed snapshot gets a new modification stamp, as sync ignores
+// dependents.
+func (l *changeLog) track(entity string, names []string, mutate func() error) error {
+	before := make([][]byte, len(names))
+	beforeDeps := make([]dependents, len(names))
+	for i, name := range names {
+		snapshot, err := entitySnapshot(l.ctx, l.tx, entity, name)
+		if err != nil {
+			return err
+		}
+		before[i] = snapshot
+		if beforeDeps[i], err = entityDependents(l.ctx, l.tx, entity, name); err != nil {
+			return err
+		}
+	}
+
+	if err := mutate(); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		after, err := entitySnapshot(l.ctx, l.tx, entity, name)
+		if err != nil {
+			return err
+		}
+		afterDeps, err := entityDependents(l.ctx, l.tx, entity, name)
+		if err != nil {
+			return err
+		}
+		deps, err := encodeDependents(beforeDeps[i], afterDeps)
+		if err != nil {
+			return err
+		}
+		changed := string(before[i]) != string(after)
+		if !changed && deps == nil {
+			continue
+		}
+		_, err = l.tx.ExecContext(l.ctx, `
+			INSERT INTO changes (batch, at, host, user, op, entity, name, before, after, deps)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			l.batch, time.Now().Unix(), l.repo.host, l.repo.user, l.op, entity, name,
+			nullJSON(before[i]), nullJSON(after), deps,
+		)
+		if err != nil {
+			return err
+		}
+		if changed && !l.keepStamps {
+			if err := stamp(l.ctx, l.tx, entity, name, after != nil, nowStamp()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nowStamp returns the current time as a modification stamp in
+// milliseconds.
+func nowStamp() int64 {
+	return time.Now().UnixMilli()
+}
+
+// stamp sets the modification stamp of an existing entity, or records a
+// tombstone for one that was removed. Collections are not synced and carry
+// no stamps.
+func stamp(ctx context.Context, tx *sql.Tx, entity, name string, exists bool, at int64) error {
+	if entity == bookmark.EntityCollection {
+		return nil
+	}
+	if !exists {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO tombstones (entity, name, deleted_at) VALUES (?, ?, ?)
+			ON CONFLICT(entity, name) DO UPDATE SET deleted_at = excluded.deleted_at`,
+			entity, name, at)
+		return err
+	}
+	table, err := entityTable(entity)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET updated_at = ? WHERE name = ?", at, name); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM tombstones WHERE entity = ? AND name = ?", entity, name)
+	return err
+}
+
+func entityTable(entity string) (string, error) {
+	switch entity {
+	case bookmark.EntityBookmark:
+		return "bookmarks", nil
+	case bookmark.EntityBrowser:
+		return "browsers", nil
+	default:
+		return "", fmt.Errorf("unknown entity %q", entity)
+	}
+}
+
+func nullJSON(snapshot []byte) any {
+	if snapshot == nil {
+		return nil
+	}
+	return string(snapshot)
+}
+
+// entitySnapshot returns the JSON snapshot of a bookmark (including one in
+// the trash), browser profile or collection, or nil if it does not exist.
+func entitySnapshot(ctx context.Context, tx *sql.Tx, entity, name string) ([]byte, error) {
+	var v any
+	switch entity {
+	case bookmark.EntityBookmark:
+		b, err := getBookmark(ctx, tx, name, true)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Tags come back in no particular order; sort them so equal
+		// bookmarks have equal snapshots.
+		slices.Sort(b.Tags)
+		v = b
+	case bookmark.EntityBrowser:
+		b, err := getBrowser(ctx, tx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		v = b
+	case bookmark.EntityCollection:
+		members, err := collectionMembers(ctx, tx, name)
+		if errors.Is(err, bookmark.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		v = bookmark.Collection{Name: name, Bookmarks: members}
+	default:
+		return nil, fmt.Errorf("unknown entity %q", entity)
+	}
+	return json.Marshal(v)
+}
+
+// Changes lists recorded changes, newest first. A non-empty name limits the
+// list to that bookmark, browser profile or collection; limit 0 lists
+// everything.
+func (r *Repository) Changes(ctx context.Context, name string, limit int) ([]bookmark.Change, error) {
+	query := `SELECT id, batch, at, host, user, op, entity, name, before, after, undone FROM changes`
+	args := []any{}
+	if name != "" {
+		query += ` WHERE name = ?`
+		args = append(args, name)
+	}
+	query += ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	return read(ctx, func() ([]bookmark.Change, error) { return queryChanges(ctx, r.db, query, args...) })
+}
+
+func queryChanges(ctx context.Context, q queryer, query string, args ...any) ([]bookmark.Change, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var changes []bookmark.Change
+	for rows.Next() {
+		var c bookmark.Change
+		var at int64
+		var before, after sql.NullString
+		var undone int
+		err := rows.Scan(&c.ID, &c.Batch, &at, &c.Host, &c.User, &c.Op, &c.Entity, &c.Name, &before, &after, &undone)
+		if err != nil {
+			return nil, err
+		}
+		c.At = time.Unix(at, 0)
+		if before.Valid {
+			c.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			c.After = json.RawMessage(after.String)
+		}
+		c.Undone = undone != 0
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Undo reverts the given number of most recent batches that have not been
+// undone yet, newest first, in a single transaction. It refuses with
+// ErrUndoConflict when an entity no longer looks like the change left it.
+// Undoing is not recorded as a new change; the reverted changes are marked
+// as undone instead. It returns the reverted changes.
+func (r *Repository) Undo(ctx context.Context, steps int) ([]bookmark.Change, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("steps must be at least 1")
+	}
+
+	var changes []bookmark.Change
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		changes, err = queryChanges(ctx, tx, `
+			SELECT id, batch, at, host, user, op, entity, name, before, after, undone
+			FROM changes
+			WHERE batch IN (SELECT DISTINCT batch FROM changes WHERE undone = 0 ORDER BY batch DESC LIMIT ?)
+			ORDER BY id DESC`, steps)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return fmt.Errorf("nothing to undo")
+		}
+
+		for start := 0; start < len(changes); {
+			end := start
+			for end < len(changes) && changes[end].Batch == changes[start].Batch {
+				end++
+			}
+			if err = undoBatch(ctx, tx, changes[start:end]); err != nil {
+				return err
+			}
+			if _, err = tx.ExecContext(ctx, "UPDATE changes SET undone = 1 WHERE batch = ?", changes[start].Batch); err != nil {
+				return err
+			}
+			start = end
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// undoBatch restores the before snapshots of one batch. Browser profiles
+// are restored before the bookmarks that may reference them and removed
+// after the bookmarks no longer do; collections follow their members.
+// Dependents the changes added are removed
+// first and the ones they removed are put back last, once the entities they
+// refer to exist again.
+func undoBatch(ctx context.Context, tx *sql.Tx, changes []bookmark.Change) error {
+	deps := make([]*changedDependents, len(changes))
+	for i, c := range changes {
+		current, err := entitySnapshot(ctx, tx, c.Entity, c.Name)
+		if err != nil {
+			return err
+		}
+		if string(current) != string(c.After) {
+			return fmt.Errorf("cannot undo %s of %s %q: %w", c.Op, c.Entity, c.Name, bookmark.ErrUndoConflict)
+		}
+		if deps[i], err = changeDependents(ctx, tx, c.ID); err != nil || deps[i] == nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		currentDeps, err := entityDependents(ctx, tx, c.Entity, c.Name)
+		if err != nil {
+			return err
+		}
+		if !deps[i].After.without(deps[i].Before).without(currentDeps).isEmpty() {
+			return fmt.Errorf("cannot undo %s of %s %q: %w", c.Op, c.Entity, c.Name, bookmark.ErrUndoConflict)
+		}
+	}
+
+	for i, c := range changes {
+		if deps[i] == nil {
+			continue
+		}
+		if err := removeDependents(ctx, tx, c.Name, deps[i].After.without(deps[i].Before)); err != nil {
+			return fmt.Errorf("cannot undo %s of %s %q: %w", c.Op, c.Entity, c.Name, err)
+		}
+	}
+
+	phases := []func(bookmark.Change) bool{
+		func(c bookmark.Change) bool { return c.Entity == bookmark.EntityBrowser && c.Before != nil },
+		func(c bookmark.Change) bool { return c.Entity == bookmark.EntityBookmark },
+		func(c bookmark.Change) bool { return c.Entity == bookmark.EntityCollection },
+		func(c bookmark.Change) bool { return c.Entity == bookmark.EntityBrowser && c.Before == nil },
+	}
+	for _, phase := range phases {
+		for _, c := range changes {
+			if !phase(c) {
+				continue
+			}
+			if string(c.Before) == string(c.After) {
+				continue
+			}
+			if err := restoreSnapshot(ctx, tx, c); err != nil {
+				return fmt.Errorf("cannot undo %s of %s %q: %w", c.Op, c.Entity, c.Name, err)
+			}
+			if err := stamp(ctx, tx, c.Entity, c.Name, c.Before != nil, nowStamp()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, c := range changes {
+		if deps[i] == nil {
+			continue
+		}
+		if err := restoreDependents(ctx, tx, c.Name, deps[i].Before.without(deps[i].After)); err != nil {
+			return fmt.Errorf("cannot undo %s of %s %q: %w", c.Op, c.Entity, c.Name, err)
+		}
+	}
+	return nil
+}
+
+func restoreSnapshot(ctx context.Context, tx *sql.Tx, c bookmark.Change) error {
+	switch c.Entity {
+	case bookmark.EntityBookmark:
+		if c.Before == nil {
+			_, err := tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE name = ?", c.Name)
+			return err
+		}
+		var b bookmark.Bookmark
+		if err := json.Unmarshal(c.Before, &b); err != nil {
+			return err
+		}
+		return putBookmark(ctx, tx, b)
+	case bookmark.EntityBrowser:
+		if c.Before == nil {
+			var refs int
+			err := tx.QueryRowContext(ctx, `
+				SELECT (SELECT COUNT(*) FROM bookmarks WHERE browser = ?)
+				     + (SELECT COUNT(*) FROM browser_rules WHERE browser = ?)
+				     + (SELECT COUNT(*) FROM tag_browsers WHERE browser = ?)`,
+				c.Name, c.Name, c.Name,
+			).Scan(&refs)
+			if err != nil {
+				return err
+			}
+			if refs > 0 {
+				return fmt.Errorf("%w: browser profile is in use", bookmark.ErrUndoConflict)
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM browsers WHERE name = ?", c.Name)
+			return err
+		}
+		var b bookmark.Browser
+		if err := json.Unmarshal(c.Before, &b); err != nil {
+			return err
+		}
+		return putBrowser(ctx, tx, b)
+	case bookmark.EntityCollection:
+		if c.Before == nil {
+			_, err := tx.ExecContext(ctx, "DELETE FROM collections WHERE name = ?", c.Name)
+			return err
+		}
+		var col bookmark.Collection
+		if err := json.Unmarshal(c.Before, &col); err != nil {
+			return err
+		}
+		if err := putCollection(ctx, tx, col); err != nil {
+			return fmt.Errorf("%w: %v", bookmark.ErrUndoConflict, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown entity %q", c.Entity)
+	}
+}
+
+// putBookmark creates or overwrites a bookmark, including its tags and
+// trash state.
+func putBookmark(ctx context.Context, tx *sql.Tx, b bookmark.Bookmark) error {
+	var browserArg, deletedAt any
+	if b.BrowserName != "" {
+		browserArg = b.BrowserName
+	}
+	if b.DeletedAt != nil {
+		deletedAt = b.DeletedAt.Unix()
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO bookmarks (name, url, archived, browser, deleted_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			url = excluded.url, archived = excluded.archived,
+			browser = excluded.browser, deleted_at = excluded.deleted_at`,
+		b.Name, b.URL, boolInt(b.Archived), browserArg, deletedAt,
+	)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("bookmark %q: %w: %q", b.Name, bookmark.ErrUnknownBrowser, b.BrowserName)
+		}
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE name = ?", b.Name); err != nil {
+		return err
+	}
+	for _, tag := range b.Tags {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO tags (name, tag) VALUES (?, ?)", b.Name, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putBrowser creates or overwrites a browser profile.
+func putBrowser(ctx context.Context, tx *sql.Tx, b bookmark.Browser) error {
+	argsJSON, envJSON, err := encodeBrowserLists(b)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO browsers (name, path, args, env, dir, is_default) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			path = excluded.path, args = excluded.args, env = excluded.env, dir = excluded.dir,
+			is_default = excluded.is_default`,
+		b.Name, b.Path, argsJSON, envJSON, b.Dir, boolInt(b.Default),
+	)
+	return err
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
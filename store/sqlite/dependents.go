@@ -0,0 +1,269 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// dependents are the rows referring to a bookmark or browser profile that
+// its snapshot leaves out: the collections a bookmark is in, and the routing
+// rules and tag defaults of a browser profile. Deleting the entity removes
+// them too, so a change that alters them records them for undo.
+type dependents struct {
+	Collections []membership    `json:"collections,omitempty"`
+	Rules       []dependentRule `json:"rules,omitempty"`
+	TagDefaults []string        `json:"tag_defaults,omitempty"`
+}
+
+// membership places a bookmark in a collection at a 1-based position.
+type membership struct {
+	Collection string `json:"collection"`
+	Position   int    `json:"position"`
+}
+
+// dependentRule is a routing rule of a browser profile at a 1-based
+// position.
+type dependentRule struct {
+	ID       int64  `json:"id"`
+	Position int    `json:"position"`
+	Host     string `json:"host,omitempty"`
+	Regex    bool   `json:"regex,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+}
+
+// changedDependents are the dependents of an entity before and after a
+// change that altered them.
+type changedDependents struct {
+	Before dependents `json:"before"`
+	After  dependents `json:"after"`
+}
+
+// without returns the dependents of d missing from other. Positions are
+// ignored: they shift whenever other rules or members come and go.
+func (d dependents) without(other dependents) dependents {
+	var result dependents
+	for _, m := range d.Collections {
+		if !slices.ContainsFunc(other.Collections, func(o membership) bool { return o.Collection == m.Collection }) {
+			result.Collections = append(result.Collections, m)
+		}
+	}
+	for _, r := range d.Rules {
+		if !slices.ContainsFunc(other.Rules, func(o dependentRule) bool {
+			o.Position = r.Position
+			return o == r
+		}) {
+			result.Rules = append(result.Rules, r)
+		}
+	}
+	for _, tag := range d.TagDefaults {
+		if !slices.Contains(other.TagDefaults, tag) {
+			result.TagDefaults = append(result.TagDefaults, tag)
+		}
+	}
+	return result
+}
+
+func (d dependents) isEmpty() bool {
+	return len(d.Collections) == 0 && len(d.Rules) == 0 && len(d.TagDefaults) == 0
+}
+
+// entityDependents loads the dependents of a bookmark or browser profile.
+func entityDependents(ctx context.Context, tx *sql.Tx, entity, name string) (dependents, error) {
+	var d dependents
+	switch entity {
+	case bookmark.EntityBookmark:
+		// Positions may have gaps, so count the members up to this one.
+		rows, err := tx.QueryContext(ctx, `
+			SELECT i.collection, (
+				SELECT COUNT(*) FROM collection_items o
+				WHERE o.collection = i.collection AND o.position <= i.position)
+			FROM collection_items i WHERE i.bookmark = ? ORDER BY i.collection`, name)
+		if err != nil {
+			return d, err
+		}
+		err = scanRows(rows, func() error {
+			var m membership
+			if err := rows.Scan(&m.Collection, &m.Position); err != nil {
+				return err
+			}
+			d.Collections = append(d.Collections, m)
+			return nil
+		})
+		return d, err
+	case bookmark.EntityBrowser:
+		rows, err := tx.QueryContext(ctx,
+			"SELECT id, position, host, regex, tag FROM browser_rules WHERE browser = ? ORDER BY id", name)
+		if err != nil {
+			return d, err
+		}
+		err = scanRows(rows, func() error {
+			var r dependentRule
+			var regex int
+			if err := rows.Scan(&r.ID, &r.Position, &r.Host, &regex, &r.Tag); err != nil {
+				return err
+			}
+			r.Regex = regex != 0
+			d.Rules = append(d.Rules, r)
+			return nil
+		})
+		if err != nil {
+			return d, err
+		}
+		d.TagDefaults, err = queryNames(ctx, tx, "SELECT tag FROM tag_browsers WHERE browser = ? ORDER BY tag", name)
+		return d, err
+	case bookmark.EntityCollection:
+		// Its members are part of the snapshot.
+		return d, nil
+	default:
+		return d, fmt.Errorf("unknown entity %q", entity)
+	}
+}
+
+// scanRows calls scan for every row and closes rows.
+func scanRows(rows *sql.Rows, scan func() error) error {
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+	for rows.Next() {
+		if err := scan(); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// encodeDependents returns the deps column of a change: NULL unless the
+// change altered the dependents.
+func encodeDependents(before, after dependents) (any, error) {
+	if before.without(after).isEmpty() && after.without(before).isEmpty() {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(changedDependents{Before: before, After: after})
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// changeDependents loads the dependents recorded with a change, or nil if it
+// did not alter any.
+func changeDependents(ctx context.Context, tx *sql.Tx, id int64) (*changedDependents, error) {
+	var deps sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT deps FROM changes WHERE id = ?", id).Scan(&deps); err != nil {
+		return nil, err
+	}
+	if !deps.Valid {
+		return nil, nil
+	}
+	var d changedDependents
+	if err := json.Unmarshal([]byte(deps.String), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// removeDependents deletes dependents of the named entity.
+func removeDependents(ctx context.Context, tx *sql.Tx, name string, d dependents) error {
+	for _, m := range d.Collections {
+		_, err := tx.ExecContext(ctx, "DELETE FROM collection_items WHERE collection = ? AND bookmark = ?", m.Collection, name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range d.Rules {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM browser_rules WHERE id = ?", r.ID); err != nil {
+			return err
+		}
+	}
+	if len(d.Rules) > 0 {
+		if err := compactRules(ctx, tx); err != nil {
+			return err
+		}
+	}
+	for _, tag := range d.TagDefaults {
+		_, err := tx.ExecContext(ctx, "DELETE FROM tag_browsers WHERE tag = ? AND browser = ?", tag, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDependents puts dependents of the named entity back at their
+// positions. It fails with ErrUndoConflict when later changes are in the
+// way, e.g. the collection was deleted or the tag got another default.
+// Memberships already restored with the snapshot of their collection in the
+// same batch are left alone.
+func restoreDependents(ctx context.Context, tx *sql.Tx, name string, d dependents) error {
+	slices.SortFunc(d.Collections, func(a, b membership) int { return cmp.Compare(a.Position, b.Position) })
+	for _, m := range d.Collections {
+		members, err := collectionMembers(ctx, tx, m.Collection)
+		if errors.Is(err, bookmark.ErrNotFound) {
+			return fmt.Errorf("%w: collection %q no longer exists", bookmark.ErrUndoConflict, m.Collection)
+		}
+		if err != nil {
+			return err
+		}
+		if slices.Contains(members, name) {
+			continue
+		}
+		c := bookmark.Collection{Name: m.Collection, Bookmarks: members}
+		if err := c.Insert(name, m.Position); err != nil {
+			return fmt.Errorf("%w: %v", bookmark.ErrUndoConflict, err)
+		}
+		if err := writeCollection(ctx, tx, c); err != nil {
+			return err
+		}
+	}
+
+	slices.SortFunc(d.Rules, func(a, b dependentRule) int { return cmp.Compare(a.Position, b.Position) })
+	for _, r := range d.Rules {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM browser_rules WHERE id = ?", r.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return fmt.Errorf("%w: rule %d exists", bookmark.ErrUndoConflict, r.ID)
+		}
+		var last int
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position), 0) FROM browser_rules").Scan(&last); err != nil {
+			return err
+		}
+		pos := min(r.Position, last+1)
+		if _, err := tx.ExecContext(ctx, "UPDATE browser_rules SET position = position + 1 WHERE position >= ?", pos); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO browser_rules (id, position, host, regex, tag, browser) VALUES (?, ?, ?, ?, ?, ?)",
+			r.ID, pos, r.Host, boolInt(r.Regex), r.Tag, name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range d.TagDefaults {
+		var current sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT browser FROM tag_browsers WHERE tag = ?", tag).Scan(&current)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if current.Valid {
+			return fmt.Errorf("%w: tag %q has default browser profile %q", bookmark.ErrUndoConflict, tag, current.String)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tag_browsers (tag, browser) VALUES (?, ?)", tag, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
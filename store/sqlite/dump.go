@@ -0,0 +1,282 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// Export returns everything in one consistent snapshot, sorted so equal
+// databases give equal dumps.
+func (r *Repository) Export(ctx context.Context) (bookmark.Dump, error) {
+	d := bookmark.Dump{Version: bookmark.DumpVersion}
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if d.Browsers, err = lsBrowsers(ctx, tx); err != nil {
+			return err
+		}
+		live, err := list(ctx, tx, true, bookmark.Filter{})
+		if err != nil {
+			return err
+		}
+		trashed, err := lsTrash(ctx, tx)
+		if err != nil {
+			return err
+		}
+		d.Bookmarks = append(live, trashed...)
+		if d.Collections, err = lsCollections(ctx, tx); err != nil {
+			return err
+		}
+		if d.Rules, err = lsRules(ctx, tx); err != nil {
+			return err
+		}
+		d.TagBrowsers, err = lsTagBrowsers(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return bookmark.Dump{}, err
+	}
+
+	slices.SortFunc(d.Bookmarks, func(a, b bookmark.Bookmark) int { return strings.Compare(a.Name, b.Name) })
+	for _, b := range d.Bookmarks {
+		slices.Sort(b.Tags)
+	}
+	return d, nil
+}
+
+// Import writes the dump in a single transaction; on any error nothing is
+// imported. All changes are recorded in the change log as one batch, so an
+// import can be undone.
+func (r *Repository) Import(ctx context.Context, d bookmark.Dump, mode bookmark.ImportMode) (bookmark.ImportResult, error) {
+	switch mode {
+	case bookmark.ImportMerge, bookmark.ImportReplace, bookmark.ImportSkipExisting:
+	default:
+		return bookmark.ImportResult{}, fmt.Errorf("unknown import mode %q", mode)
+	}
+	// Validate normalizes in place; keep the caller's dump untouched.
+	d.Bookmarks = slices.Clone(d.Bookmarks)
+	d.Rules = slices.Clone(d.Rules)
+	if err := d.Validate(); err != nil {
+		return bookmark.ImportResult{}, err
+	}
+
+	var result bookmark.ImportResult
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		result = bookmark.ImportResult{}
+
+		var browserNames, bookmarkNames, collectionNames []string
+		for _, b := range d.Browsers {
+			browserNames = append(browserNames, b.Name)
+		}
+		for _, b := range d.Bookmarks {
+			bookmarkNames = append(bookmarkNames, b.Name)
+		}
+		for _, c := range d.Collections {
+			collectionNames = append(collectionNames, c.Name)
+		}
+		// Imported rules and tag defaults may belong to any existing
+		// profile, and they are recorded with it.
+		existing, err := queryNames(ctx, tx, "SELECT name FROM browsers")
+		if err != nil {
+			return err
+		}
+		browserNames = mergeNames(browserNames, existing)
+		if mode == bookmark.ImportReplace {
+			if existing, err = queryNames(ctx, tx, "SELECT name FROM bookmarks"); err != nil {
+				return err
+			}
+			bookmarkNames = mergeNames(bookmarkNames, existing)
+			if existing, err = queryNames(ctx, tx, "SELECT name FROM collections"); err != nil {
+				return err
+			}
+			collectionNames = mergeNames(collectionNames, existing)
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "import")
+		if err != nil {
+			return err
+		}
+		return changes.browsers(browserNames, func() error {
+			return changes.bookmarks(bookmarkNames, func() error {
+				return changes.collections(collectionNames, func() error {
+					if mode == bookmark.ImportReplace {
+						if err := deleteAll(ctx, tx); err != nil {
+							return err
+						}
+					}
+					return importDump(ctx, tx, d, mode, &result)
+				})
+			})
+		})
+	})
+	if err != nil {
+		return bookmark.ImportResult{}, err
+	}
+	return result, nil
+}
+
+// mergeNames appends the names of b missing from a.
+func mergeNames(a, b []string) []string {
+	for _, name := range b {
+		if !slices.Contains(a, name) {
+			a = append(a, name)
+		}
+	}
+	return a
+}
+
+func deleteAll(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range []string{"collections", "browser_rules", "tag_browsers", "bookmarks", "browsers"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importDump(ctx context.Context, tx *sql.Tx, d bookmark.Dump, mode bookmark.ImportMode, result *bookmark.ImportResult) error {
+	defaultBrowser := ""
+	for _, b := range d.Browsers {
+		local, err := getBrowser(ctx, tx, b.Name)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if !result.Reconcile(mode, "browser profile", b.Name, err == nil, bookmark.SameJSON(local, b)) {
+			continue
+		}
+		if err := putBrowser(ctx, tx, b); err != nil {
+			return err
+		}
+		if b.Default {
+			defaultBrowser = b.Name
+		}
+	}
+	if defaultBrowser != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE browsers SET is_default = (name = ?)", defaultBrowser); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range d.Bookmarks {
+		local, err := getBookmark(ctx, tx, b.Name, true)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		slices.Sort(local.Tags)
+		if !result.Reconcile(mode, "bookmark", b.Name, err == nil, bookmark.SameJSON(local, b)) {
+			continue
+		}
+		if err := putBookmark(ctx, tx, b); err != nil {
+			return fmt.Errorf("bookmark %q: %w", b.Name, err)
+		}
+	}
+
+	for _, c := range d.Collections {
+		var exists int
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM collections WHERE name = ?", c.Name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		var local []string
+		if exists > 0 {
+			if local, err = collectionMembers(ctx, tx, c.Name); err != nil {
+				return err
+			}
+		}
+		if !result.Reconcile(mode, "collection", c.Name, exists > 0, slices.Equal(local, c.Bookmarks)) {
+			continue
+		}
+		if err := putCollection(ctx, tx, c); err != nil {
+			return err
+		}
+	}
+
+	rules, err := lsRules(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range d.Rules {
+		if slices.ContainsFunc(rules, func(local bookmark.Rule) bool {
+			return local.Host == rule.Host && local.Regex == rule.Regex &&
+				local.Tag == rule.Tag && local.BrowserName == rule.BrowserName
+		}) {
+			result.Unchanged++
+			continue
+		}
+		result.Added++
+		rules = append(rules, rule)
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO browser_rules (position, host, regex, tag, browser) VALUES (?, ?, ?, ?, ?)`,
+			len(rules), rule.Host, boolInt(rule.Regex), rule.Tag, rule.BrowserName,
+		)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("rule %s: %w: %q", rule, bookmark.ErrUnknownBrowser, rule.BrowserName)
+			}
+			return err
+		}
+	}
+
+	tagBrowsers, err := lsTagBrowsers(ctx, tx)
+	if err != nil {
+		return err
+	}
+	tags := make([]string, 0, len(d.TagBrowsers))
+	for tag := range d.TagBrowsers {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		browser := d.TagBrowsers[tag]
+		local, exists := tagBrowsers[tag]
+		if !result.Reconcile(mode, "tag default", tag, exists, local == browser) {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO tag_browsers (tag, browser) VALUES (?, ?)
+			ON CONFLICT(tag) DO UPDATE SET browser = excluded.browser`,
+			tag, browser,
+		)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("tag default %q: %w: %q", tag, bookmark.ErrUnknownBrowser, browser)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// putCollection creates or overwrites a collection with the given members,
+// which must be bookmarks outside the trash.
+func putCollection(ctx context.Context, tx *sql.Tx, c bookmark.Collection) error {
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO collections (name) VALUES (?)", c.Name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM collection_items WHERE collection = ?", c.Name); err != nil {
+		return err
+	}
+	for i, member := range c.Bookmarks {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO collection_items (collection, bookmark, position)
+			SELECT ?, name, ? FROM bookmarks WHERE name = ? AND deleted_at IS NULL`,
+			c.Name, i+1, member,
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fmt.Errorf("collection %q: %w: %q", c.Name, bookmark.ErrBookmarkNotFound, member)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backup uses VACUUM INTO, which is safe while other processes are writing.
+// The copy is written to a temporary file next to dest first, so an
+// interrupted backup never replaces a good one.
+func (r *Repository) Backup(ctx context.Context, dest string, keep int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing %s: %v", tmpPath, err)
+		}
+	}()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	err = retryBusy(ctx, func() error {
+		_, err := r.db.ExecContext(ctx, "VACUUM INTO ?", tmpPath)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("backing up: %w", err)
+	}
+	if err := rotateBackups(dest, keep); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+// rotateBackups shifts dest to dest.1, dest.1 to dest.2 and so on, dropping
+// the ones beyond keep-1. With keep below 2 nothing is rotated and dest is
+// simply replaced.
+func rotateBackups(dest string, keep int) error {
+	if keep < 2 {
+		return nil
+	}
+	numbered := func(i int) string {
+		if i == 0 {
+			return dest
+		}
+		return fmt.Sprintf("%s.%d", dest, i)
+	}
+	if err := os.Remove(numbered(keep - 1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := keep - 2; i >= 0; i-- {
+		if err := os.Rename(numbered(i), numbered(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreFrom validates the backup before touching the database. The backup
+// is copied and migrated to the current schema, then swapped in with
+// SQLite's online backup API so other connections never see a partial
+// state. The change log is replaced by the one of the backup.
+func (r *Repository) RestoreFrom(ctx context.Context, src string) error {
+	if err := validateBackup(ctx, src); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp("", "bm-restore-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			log.Printf("error removing %s: %v", staging, err)
+		}
+	}()
+	stagedPath := filepath.Join(staging, "bm.sqlite")
+	if err := copyFile(src, stagedPath); err != nil {
+		return err
+	}
+	staged, err := New(stagedPath)
+	if err != nil {
+		return fmt.Errorf("migrating backup: %w", err)
+	}
+	defer func() {
+		if err := staged.db.Close(); err != nil {
+			log.Printf("error closing database connection: %v", err)
+		}
+	}()
+
+	return withSQLiteConn(ctx, r.db, func(dest *sqlite3.SQLiteConn) error {
+		return withSQLiteConn(ctx, staged.db, func(src *sqlite3.SQLiteConn) error {
+			return copyDatabase(dest, src)
+		})
+	})
+}
+
+// validateBackup makes sure src is an intact bm database without modifying
+// it.
+func validateBackup(ctx context.Context, src string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	// A URI needs # and ? in the path escaped, or SQLite opens another file.
+	dsn := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("error closing database connection: %v", err)
+		}
+	}()
+
+	var columns int
+	err = db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM pragma_table_info('bookmarks') WHERE name IN ('name', 'url')",
+	).Scan(&columns)
+	if err != nil {
+		return fmt.Errorf("%s is not a bm database: %w", src, err)
+	}
+	if columns != 2 {
+		return fmt.Errorf("%s is not a bm database", src)
+	}
+
+	problems, err := integrityProblems(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is corrupt: %s", src, problems[0])
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Printf("error closing %s: %v", src, err)
+		}
+	}()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// withSQLiteConn runs fn with the driver connection underlying db.
+func withSQLiteConn(ctx context.Context, db *sql.DB, fn func(*sqlite3.SQLiteConn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("error closing database connection: %v", err)
+		}
+	}()
+	return conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return fn(c)
+	})
+}
+
+// Check runs SQLite's integrity and foreign key checks and looks for tags
+// and collection entries of bookmarks that no longer exist.
+func (r *Repository) Check(ctx context.Context) ([]string, error) {
+	return read(ctx, func() ([]string, error) { return r.check(ctx) })
+}
+
+func (r *Repository) check(ctx context.Context) ([]string, error) {
+	problems, err := integrityProblems(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if parent == "bookmarks" && (table == "tags" || table == "collection_items") {
+			continue // reported by name below
+		}
+		problems = append(problems, fmt.Sprintf("%s row %d references a missing %s entry", table, rowid.Int64, parent))
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+
+	orphans := []struct{ query, format string }{
+		{`SELECT t.name, t.tag FROM tags t
+			LEFT JOIN bookmarks b ON b.name = t.name WHERE b.name IS NULL`,
+			"tag %[2]q belongs to missing bookmark %[1]q"},
+		{`SELECT c.collection, c.bookmark FROM collection_items c
+			LEFT JOIN bookmarks b ON b.name = c.bookmark WHERE b.name IS NULL`,
+			"collection %q contains missing bookmark %q"},
+	}
+	for _, o := range orphans {
+		rows, err := r.db.QueryContext(ctx, o.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var a, b string
+			if err := rows.Scan(&a, &b); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			problems = append(problems, fmt.Sprintf(o.format, a, b))
+		}
+		if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// integrityProblems runs PRAGMA integrity_check, which reports a single
+// "ok" row for a healthy database.
+func integrityProblems(ctx context.Context, q queryer) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Vacuum rebuilds the database file and truncates the write-ahead log.
+func (r *Repository) Vacuum(ctx context.Context) error {
+	return retryBusy(ctx, func() error {
+		if _, err := r.db.ExecContext(ctx, "VACUUM"); err != nil {
+			return err
+		}
+		_, err := r.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+		return err
+	})
+}
@@ -0,0 +1,1502 @@
+// Package sqlite implements bookmark.Repository on a SQLite database. Besides
+// the Repository methods it keeps a change log for undo, and implements
+// bookmark.Maintainer and bookmark.Syncer.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+// Repository is a bookmark.Repository stored in a SQLite database. Close it
+// when done.
+type Repository struct {
+	db *sql.DB
+	// path and opts are kept to open peer databases the same way.
+	path string
+	opts []Option
+	// host and user identify this process in the change log.
+	host string
+	user string
+}
+
+// DefaultBusyTimeout is how long a statement waits for a lock held by
+// another process before it fails with SQLITE_BUSY.
+const DefaultBusyTimeout = 5 * time.Second
+
+// maxTxAttempts limits how often a transaction is retried on SQLITE_BUSY.
+const maxTxAttempts = 8
+
+// ErrBusy is returned when the database stayed locked by another process
+// through every retry.
+var ErrBusy = errors.New("database is locked")
+
+// Option configures a Repository.
+type Option func(*options)
+
+type options struct {
+	busyTimeout time.Duration
+}
+
+// WithBusyTimeout sets how long a statement waits for a lock held by another
+// process.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(o *options) { o.busyTimeout = d }
+}
+
+// New opens or creates the database at path. It uses WAL journaling so
+// readers never block writers, and begins every transaction with an
+// immediate write lock so concurrent writers wait for each other instead of
+// failing halfway.
+func New(path string, opts ...Option) (*Repository, error) {
+	o := options{busyTimeout: DefaultBusyTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dsn := fmt.Sprintf("%s?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+		path, o.busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	createTables := `
+		CREATE TABLE IF NOT EXISTS browsers (
+				name TEXT PRIMARY KEY,
+				path TEXT NOT NULL,
+				args TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS bookmarks (
+				name TEXT PRIMARY KEY,
+				url TEXT,
+				archived INTEGER DEFAULT 0,
+				browser TEXT REFERENCES browsers(name) ON DELETE SET NULL
+		);
+		CREATE TABLE IF NOT EXISTS tags (
+				name TEXT,
+				tag TEXT,
+				FOREIGN KEY(name) REFERENCES bookmarks(name) ON DELETE CASCADE,
+				PRIMARY KEY(name, tag)
+		);
+		CREATE TABLE IF NOT EXISTS collections (
+				name TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS collection_items (
+				collection TEXT REFERENCES collections(name) ON DELETE CASCADE,
+				bookmark TEXT REFERENCES bookmarks(name) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				PRIMARY KEY(collection, bookmark)
+		);
+		CREATE TABLE IF NOT EXISTS browser_rules (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				position INTEGER NOT NULL,
+				host TEXT DEFAULT '',
+				regex INTEGER DEFAULT 0,
+				tag TEXT DEFAULT '',
+				browser TEXT NOT NULL REFERENCES browsers(name) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS tag_browsers (
+				tag TEXT PRIMARY KEY,
+				browser TEXT NOT NULL REFERENCES browsers(name) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS changes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				batch INTEGER NOT NULL,
+				at INTEGER NOT NULL,
+				host TEXT NOT NULL,
+				user TEXT NOT NULL,
+				op TEXT NOT NULL,
+				entity TEXT NOT NULL,
+				name TEXT NOT NULL,
+				before TEXT,
+				after TEXT,
+				undone INTEGER DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS changes_name ON changes(name);
+		CREATE TABLE IF NOT EXISTS tombstones (
+				entity TEXT NOT NULL,
+				name TEXT NOT NULL,
+				deleted_at INTEGER NOT NULL,
+				PRIMARY KEY(entity, name)
+		);
+		CREATE TABLE IF NOT EXISTS replica (
+				id TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sync_peers (
+				peer TEXT PRIMARY KEY,
+				synced_at INTEGER NOT NULL
+		);
+	`
+	_, err = db.Exec(createTables)
+	if err != nil {
+		return nil, err
+	}
+
+	// Migration: Add archived column if it doesn't exist (pre-archive DBs).
+	if err = addColumnIfMissing(db, "bookmarks", "archived", "INTEGER DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add browser column if it doesn't exist.
+	if err = addColumnIfMissing(db, "bookmarks", "browser", "TEXT REFERENCES browsers(name) ON DELETE SET NULL"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add soft delete timestamp; NULL means the bookmark is not in the trash.
+	if err = addColumnIfMissing(db, "bookmarks", "deleted_at", "INTEGER"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add default flag to browser profiles.
+	if err = addColumnIfMissing(db, "browsers", "is_default", "INTEGER DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add modification stamps used by sync; 0 means unknown.
+	if err = addColumnIfMissing(db, "bookmarks", "updated_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumnIfMissing(db, "browsers", "updated_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add environment (JSON like args) and working directory to
+	// browser profiles.
+	if err = addColumnIfMissing(db, "browsers", "env", "TEXT NOT NULL DEFAULT 'null'"); err != nil {
+		return nil, err
+	}
+	if err = addColumnIfMissing(db, "browsers", "dir", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+
+	// Migration: Add the rows depending on an entity that a change altered,
+	// such as the routing rules of a deleted browser profile, so undo can
+	// restore them.
+	if err = addColumnIfMissing(db, "changes", "deps", "TEXT"); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("INSERT INTO replica (id) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM replica)", newReplicaID())
+	if err != nil {
+		return nil, err
+	}
+
+	host, user := currentActor()
+	return &Repository{db: db, path: path, opts: opts, host: host, user: user}, nil
+}
+
+// Close closes the database.
+func (r *Repository) Close() error {
+	return r.db.Close()
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var count int
+	q := fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name='%s'`, table, column)
+	if err := db.QueryRow(q).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+		return err
+	}
+	return nil
+}
+
+// withTx runs fn in a transaction and commits it. When the database is
+// locked by another process for longer than the busy timeout, the whole
+// transaction is retried with exponential backoff.
+func (r *Repository) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return retryBusy(ctx, func() error { return r.runTx(ctx, fn) })
+}
+
+// read runs a query outside of a transaction, so it takes no write lock,
+// and retries it like withTx when the database is busy.
+func read[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var result T
+	err := retryBusy(ctx, func() error {
+		var err error
+		result, err = fn()
+		return err
+	})
+	return result, err
+}
+
+// retryBusy runs fn until the database is not busy, with exponential
+// backoff, and fails with ErrBusy after maxTxAttempts.
+func retryBusy(ctx context.Context, fn func() error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !isBusy(err) {
+			return err
+		}
+		if attempt == maxTxAttempts {
+			return fmt.Errorf("%w: %w", ErrBusy, err)
+		}
+		wait := backoff + time.Duration(rand.Int64N(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func (r *Repository) runTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) && err == nil {
+			err = fmt.Errorf("rollback error: %v", rbErr)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) Add(ctx context.Context, b bookmark.Bookmark) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, "add")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks([]string{b.Name}, func() error {
+			var browserArg any
+			if b.BrowserName != "" {
+				browserArg = b.BrowserName
+			}
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO bookmarks (name, url, archived, browser) VALUES (?, ?, ?, ?)",
+				b.Name, b.URL, boolInt(b.Archived), browserArg,
+			)
+			if err != nil {
+				if isUniqueViolation(err) {
+					var trashed int
+					if qErr := tx.QueryRowContext(ctx,
+						"SELECT COUNT(*) FROM bookmarks WHERE name = ? AND deleted_at IS NOT NULL", b.Name,
+					).Scan(&trashed); qErr == nil && trashed > 0 {
+						return bookmark.ErrNameInTrash
+					}
+					return bookmark.ErrDuplicateName
+				}
+				if isForeignKeyViolation(err) {
+					return fmt.Errorf("bookmark %q: %w: %q", b.Name, bookmark.ErrUnknownBrowser, b.BrowserName)
+				}
+				return err
+			}
+
+			for _, tag := range bookmark.NormalizeTags(b.Tags) {
+				if _, err = tx.ExecContext(ctx, "INSERT INTO tags (name, tag) VALUES (?, ?)", b.Name, tag); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Del moves a bookmark into the trash. Its tags and browser profile are kept
+// so it can be restored, but it is removed from all collections.
+func (r *Repository) Del(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, "del")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks([]string{name}, func() error {
+			result, err := tx.ExecContext(ctx,
+				"UPDATE bookmarks SET deleted_at = ? WHERE name = ? AND deleted_at IS NULL",
+				time.Now().Unix(), name,
+			)
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows == 0 {
+				return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM collection_items WHERE bookmark = ?", name)
+			return err
+		})
+	})
+}
+
+// Update applies the patch to the named bookmark outside the trash.
+func (r *Repository) Update(ctx context.Context, name string, p bookmark.BookmarkPatch) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getBookmark(ctx, tx, name, false); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+			}
+			return err
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "update")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks([]string{name}, func() error {
+			return applyPatch(ctx, tx, name, p)
+		})
+	})
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// UpdateWhere applies the patch to every bookmark matching the filter,
+// archived ones included, in a single transaction. With dryRun the update is
+// rolled back, so it fails exactly where the real one would but changes
+// nothing. It returns the matching bookmarks as they were before the update.
+func (r *Repository) UpdateWhere(ctx context.Context, f bookmark.Filter, p bookmark.BookmarkPatch, dryRun bool) ([]bookmark.Bookmark, error) {
+	if f == (bookmark.Filter{}) {
+		return nil, fmt.Errorf("at least one filter is required")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if f.URLGlob != "" {
+		if _, err := path.Match(f.URLGlob, ""); err != nil {
+			return nil, fmt.Errorf("invalid URL glob %q: %w", f.URLGlob, err)
+		}
+	}
+
+	var matched []bookmark.Bookmark
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		matched, err = list(ctx, tx, true, f)
+		if err != nil {
+			return err
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+
+		names := make([]string, len(matched))
+		for i, b := range matched {
+			names[i] = b.Name
+		}
+		if dryRun {
+			for _, name := range names {
+				if err := applyPatch(ctx, tx, name, p); err != nil {
+					return err
+				}
+			}
+			return errDryRun
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "bulk-update")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks(names, func() error {
+			for _, name := range names {
+				if err := applyPatch(ctx, tx, name, p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// patchColumns returns the column assignments of the patch together with
+// their arguments. New bookmark columns only need an entry here.
+func patchColumns(p bookmark.BookmarkPatch) ([]string, []any) {
+	var columns []string
+	var args []any
+	if p.URL != nil {
+		columns = append(columns, "url = ?")
+		args = append(args, *p.URL)
+	}
+	if p.Archived != nil {
+		columns = append(columns, "archived = ?")
+		args = append(args, boolInt(*p.Archived))
+	}
+	if p.BrowserName != nil {
+		columns = append(columns, "browser = ?")
+		if *p.BrowserName != "" {
+			args = append(args, *p.BrowserName)
+		} else {
+			args = append(args, nil) // NULL clears the association
+		}
+	}
+	return columns, args
+}
+
+func applyPatch(ctx context.Context, tx *sql.Tx, name string, p bookmark.BookmarkPatch) error {
+	if columns, args := patchColumns(p); len(columns) > 0 {
+		query := "UPDATE bookmarks SET " + strings.Join(columns, ", ") + " WHERE name = ?"
+		if _, err := tx.ExecContext(ctx, query, append(args, name)...); err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("bookmark %q: %w: %q", name, bookmark.ErrUnknownBrowser, *p.BrowserName)
+			}
+			return err
+		}
+	}
+	if p.Tags != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE name = ?", name); err != nil {
+			return err
+		}
+		if err := editTags(ctx, tx, name, *p.Tags, nil); err != nil {
+			return err
+		}
+	}
+	return editTags(ctx, tx, name, p.AddTags, p.RemoveTags)
+}
+
+// editTags removes exactly the given tags, leaving their descendants alone,
+// and then adds the given tags, ignoring ones the bookmark already has.
+func editTags(ctx context.Context, tx *sql.Tx, name string, add, remove []string) error {
+	for _, tag := range bookmark.NormalizeTags(remove) {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE name = ? AND tag = ?", name, tag); err != nil {
+			return err
+		}
+	}
+	for _, tag := range bookmark.NormalizeTags(add) {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO tags (name, tag) VALUES (?, ?)", name, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) Ls(ctx context.Context, includeArchived bool) ([]bookmark.Bookmark, error) {
+	return read(ctx, func() ([]bookmark.Bookmark, error) {
+		return list(ctx, r.db, includeArchived, bookmark.Filter{})
+	})
+}
+
+// LsByTag lists the bookmarks tagged with tag or any of its descendants.
+func (r *Repository) LsByTag(ctx context.Context, tag string, includeArchived bool) ([]bookmark.Bookmark, error) {
+	tag = bookmark.NormalizeTag(tag)
+	if tag == "" {
+		return nil, fmt.Errorf("tag must not be empty")
+	}
+	return read(ctx, func() ([]bookmark.Bookmark, error) {
+		return list(ctx, r.db, includeArchived, bookmark.Filter{Tag: tag})
+	})
+}
+
+// list returns the bookmarks outside the trash that match the filter. The
+// tag and browser are matched in SQL, the URL glob afterwards.
+func list(ctx context.Context, q queryer, includeArchived bool, f bookmark.Filter) ([]bookmark.Bookmark, error) {
+	query := `
+        SELECT b.name, b.url, b.archived, GROUP_CONCAT(t.tag) as tags, b.browser
+        FROM bookmarks b
+        LEFT JOIN tags t ON b.name = t.name`
+	conditions := []string{"b.deleted_at IS NULL"}
+	args := []any{}
+	if !includeArchived {
+		conditions = append(conditions, "b.archived = 0")
+	}
+	if tag := bookmark.NormalizeTag(f.Tag); tag != "" {
+		conditions = append(conditions, "b.name IN (SELECT name FROM tags WHERE "+tagMatchSQL+")")
+		args = append(args, tagMatchArgs(tag)...)
+	}
+	if f.BrowserName != "" {
+		conditions = append(conditions, "b.browser = ?")
+		args = append(args, f.BrowserName)
+	}
+	query += ` WHERE ` + strings.Join(conditions, " AND ")
+	query += ` GROUP BY b.name, b.url, b.archived, b.browser`
+	query += ` ORDER BY b.name`
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var bookmarks []bookmark.Bookmark
+	for rows.Next() {
+		var b bookmark.Bookmark
+		var tags sql.NullString
+		var archived int
+		var browserName sql.NullString
+		if err := rows.Scan(&b.Name, &b.URL, &archived, &tags, &browserName); err != nil {
+			return nil, err
+		}
+		b.Archived = archived != 0
+		if tags.Valid {
+			b.Tags = strings.Split(tags.String, ",")
+		}
+		if browserName.Valid {
+			b.BrowserName = browserName.String
+		}
+		if f.URLGlob != "" {
+			ok, err := bookmark.MatchURLGlob(b.URL, f.URLGlob)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bookmarks, nil
+}
+
+// tagMatchSQL matches a tag and all of its descendants without LIKE, so tags
+// containing % or _ need no escaping. Its arguments come from tagMatchArgs.
+const tagMatchSQL = "(tag = ? OR substr(tag, 1, length(?)) = ?)"
+
+func tagMatchArgs(tag string) []any {
+	prefix := tag + bookmark.TagSeparator
+	return []any{tag, prefix, prefix}
+}
+
+// RenameTag renames a tag together with its whole subtree, e.g. renaming
+// work to job turns work/infra into job/infra. Bookmarks that already carry
+// a target tag keep a single copy of it. Tag defaults and routing rules
+// follow the rename.
+func (r *Repository) RenameTag(ctx context.Context, from, to string) error {
+	from, to = bookmark.NormalizeTag(from), bookmark.NormalizeTag(to)
+	if from == "" || to == "" {
+		return fmt.Errorf("tag must not be empty")
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT name, tag FROM tags WHERE "+tagMatchSQL, tagMatchArgs(from)...)
+		if err != nil {
+			return err
+		}
+		type tagRow struct{ name, tag string }
+		var matched []tagRow
+		for rows.Next() {
+			var row tagRow
+			if err = rows.Scan(&row.name, &row.tag); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			matched = append(matched, row)
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		// Browser profiles whose tag defaults or rules are renamed.
+		args := append(tagMatchArgs(from), tagMatchArgs(from)...)
+		browsers, err := queryNames(ctx, tx, `
+			SELECT browser FROM tag_browsers WHERE `+tagMatchSQL+`
+			UNION SELECT browser FROM browser_rules WHERE `+tagMatchSQL, args...)
+		if err != nil {
+			return err
+		}
+		if len(matched) == 0 && len(browsers) == 0 {
+			return fmt.Errorf("tag %w: %q", bookmark.ErrNotFound, from)
+		}
+
+		var names []string
+		for _, row := range matched {
+			if !slices.Contains(names, row.name) {
+				names = append(names, row.name)
+			}
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "rename-tag")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks(names, func() error {
+			return changes.browsers(browsers, func() error {
+				// Delete everything first: the new names may overlap the old subtree
+				// (e.g. renaming a to a/b), so renaming row by row could drop tags.
+				if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE "+tagMatchSQL, tagMatchArgs(from)...); err != nil {
+					return err
+				}
+				for _, row := range matched {
+					renamed := to + strings.TrimPrefix(row.tag, from)
+					if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO tags (name, tag) VALUES (?, ?)", row.name, renamed); err != nil {
+						return err
+					}
+				}
+				return renameTagReferences(ctx, tx, from, to)
+			})
+		})
+	})
+}
+
+// renameTagReferences renames a tag and its descendants in the tag defaults
+// and routing rules. A tag that already has a default keeps it.
+func renameTagReferences(ctx context.Context, tx *sql.Tx, from, to string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT tag, browser FROM tag_browsers WHERE "+tagMatchSQL, tagMatchArgs(from)...)
+	if err != nil {
+		return err
+	}
+	var defaults [][2]string
+	for rows.Next() {
+		var tag, browser string
+		if err = rows.Scan(&tag, &browser); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		defaults = append(defaults, [2]string{tag, browser})
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM tag_browsers WHERE "+tagMatchSQL, tagMatchArgs(from)...); err != nil {
+		return err
+	}
+	for _, d := range defaults {
+		renamed := to + strings.TrimPrefix(d[0], from)
+		if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO tag_browsers (tag, browser) VALUES (?, ?)", renamed, d[1]); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE browser_rules SET tag = ? || substr(tag, length(?) + 1) WHERE "+tagMatchSQL,
+		append([]any{to, from}, tagMatchArgs(from)...)...,
+	)
+	return err
+}
+
+func (r *Repository) Get(ctx context.Context, name string) (bookmark.Bookmark, error) {
+	b, err := read(ctx, func() (bookmark.Bookmark, error) { return getBookmark(ctx, r.db, name, false) })
+	if errors.Is(err, sql.ErrNoRows) {
+		return bookmark.Bookmark{}, fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, name)
+	}
+	return b, err
+}
+
+// getBookmark loads a bookmark, optionally one in the trash. It returns
+// sql.ErrNoRows if there is none.
+func getBookmark(ctx context.Context, q queryRower, name string, includeDeleted bool) (bookmark.Bookmark, error) {
+	var b bookmark.Bookmark
+	var tags sql.NullString
+	var archived int
+	var browserName sql.NullString
+	var deletedAt sql.NullInt64
+	query := `
+		SELECT b.name, b.url, b.archived, GROUP_CONCAT(t.tag) as tags, b.browser, b.deleted_at
+		FROM bookmarks b
+		LEFT JOIN tags t ON b.name = t.name
+		WHERE b.name = ?`
+	if !includeDeleted {
+		query += ` AND b.deleted_at IS NULL`
+	}
+	query += ` GROUP BY b.name`
+	err := q.QueryRowContext(ctx, query, name).Scan(&b.Name, &b.URL, &archived, &tags, &browserName, &deletedAt)
+	if err != nil {
+		return bookmark.Bookmark{}, err
+	}
+	b.Archived = archived != 0
+	if tags.Valid {
+		b.Tags = strings.Split(tags.String, ",")
+	}
+	if browserName.Valid {
+		b.BrowserName = browserName.String
+	}
+	if deletedAt.Valid {
+		deleted := time.Unix(deletedAt.Int64, 0).UTC()
+		b.DeletedAt = &deleted
+	}
+	return b, nil
+}
+
+// queryRower and queryer are implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Trash lists the deleted bookmarks, most recently deleted first.
+func (r *Repository) Trash(ctx context.Context) ([]bookmark.Bookmark, error) {
+	return read(ctx, func() ([]bookmark.Bookmark, error) { return lsTrash(ctx, r.db) })
+}
+
+func lsTrash(ctx context.Context, q queryer) ([]bookmark.Bookmark, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT b.name, b.url, b.archived, GROUP_CONCAT(t.tag) as tags, b.browser, b.deleted_at
+		FROM bookmarks b
+		LEFT JOIN tags t ON b.name = t.name
+		WHERE b.deleted_at IS NOT NULL
+		GROUP BY b.name, b.url, b.archived, b.browser, b.deleted_at
+		ORDER BY b.deleted_at DESC, b.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var bookmarks []bookmark.Bookmark
+	for rows.Next() {
+		var b bookmark.Bookmark
+		var tags sql.NullString
+		var archived int
+		var browserName sql.NullString
+		var deletedAt int64
+		if err := rows.Scan(&b.Name, &b.URL, &archived, &tags, &browserName, &deletedAt); err != nil {
+			return nil, err
+		}
+		b.Archived = archived != 0
+		if tags.Valid {
+			b.Tags = strings.Split(tags.String, ",")
+		}
+		if browserName.Valid {
+			b.BrowserName = browserName.String
+		}
+		deleted := time.Unix(deletedAt, 0).UTC()
+		b.DeletedAt = &deleted
+		bookmarks = append(bookmarks, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bookmarks, nil
+}
+
+// Restore moves a bookmark out of the trash together with its tags and
+// browser profile.
+func (r *Repository) Restore(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, "restore")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks([]string{name}, func() error {
+			result, err := tx.ExecContext(ctx,
+				"UPDATE bookmarks SET deleted_at = NULL WHERE name = ? AND deleted_at IS NOT NULL", name,
+			)
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows == 0 {
+				return fmt.Errorf("%w in the trash: %q", bookmark.ErrBookmarkNotFound, name)
+			}
+			return nil
+		})
+	})
+}
+
+// Purge permanently deletes the bookmarks that were moved into the trash at
+// or before the given time and returns how many were deleted.
+func (r *Repository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		names, err := queryNames(ctx, tx,
+			"SELECT name FROM bookmarks WHERE deleted_at IS NOT NULL AND deleted_at <= ?", before.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+		purged = int64(len(names))
+
+		changes, err := r.newChangeLog(ctx, tx, "purge")
+		if err != nil {
+			return err
+		}
+		return changes.bookmarks(names, func() error {
+			_, err := tx.ExecContext(ctx,
+				"DELETE FROM bookmarks WHERE deleted_at IS NOT NULL AND deleted_at <= ?", before.Unix(),
+			)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// queryNames runs a query selecting a single text column.
+func queryNames(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (r *Repository) AddBrowser(ctx context.Context, b bookmark.Browser) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	argsJSON, envJSON, err := encodeBrowserLists(b)
+	if err != nil {
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		names := []string{b.Name}
+		if b.Default {
+			defaults, err := queryNames(ctx, tx, "SELECT name FROM browsers WHERE is_default = 1 AND name != ?", b.Name)
+			if err != nil {
+				return err
+			}
+			names = append(names, defaults...)
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "add-browser")
+		if err != nil {
+			return err
+		}
+		return changes.browsers(names, func() error {
+			if b.Default {
+				if _, err := tx.ExecContext(ctx, "UPDATE browsers SET is_default = 0"); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO browsers (name, path, args, env, dir, is_default) VALUES (?, ?, ?, ?, ?, ?)",
+				b.Name, b.Path, argsJSON, envJSON, b.Dir, boolInt(b.Default),
+			)
+			if err != nil && isUniqueViolation(err) {
+				return bookmark.ErrDuplicateBrowser
+			}
+			return err
+		})
+	})
+}
+
+// UpdateBrowser applies the patch to a browser profile.
+func (r *Repository) UpdateBrowser(ctx context.Context, name string, p bookmark.BrowserPatch) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		b, err := getBrowser(ctx, tx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+		}
+		if err != nil {
+			return err
+		}
+		b = p.Apply(b)
+		argsJSON, envJSON, err := encodeBrowserLists(b)
+		if err != nil {
+			return err
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "update-browser")
+		if err != nil {
+			return err
+		}
+		return changes.browsers([]string{name}, func() error {
+			_, err := tx.ExecContext(ctx,
+				"UPDATE browsers SET path = ?, args = ?, env = ?, dir = ? WHERE name = ?",
+				b.Path, argsJSON, envJSON, b.Dir, name,
+			)
+			return err
+		})
+	})
+}
+
+// SetDefaultBrowser marks a browser profile as the global default. An empty
+// name clears the default.
+func (r *Repository) SetDefaultBrowser(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		names, err := queryNames(ctx, tx, "SELECT name FROM browsers WHERE is_default = 1 OR name = ?", name)
+		if err != nil {
+			return err
+		}
+		if name != "" && !slices.Contains(names, name) {
+			return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "default-browser")
+		if err != nil {
+			return err
+		}
+		return changes.browsers(names, func() error {
+			_, err := tx.ExecContext(ctx, "UPDATE browsers SET is_default = (name = ?)", name)
+			return err
+		})
+	})
+}
+
+// DelBrowser deletes a browser profile. Bookmarks using it lose their
+// association; its routing rules and tag defaults are deleted.
+func (r *Repository) DelBrowser(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		users, err := queryNames(ctx, tx, "SELECT name FROM bookmarks WHERE browser = ?", name)
+		if err != nil {
+			return err
+		}
+
+		changes, err := r.newChangeLog(ctx, tx, "del-browser")
+		if err != nil {
+			return err
+		}
+		// ON DELETE SET NULL updates the bookmarks, so track them as well.
+		return changes.bookmarks(users, func() error {
+			return changes.browsers([]string{name}, func() error {
+				result, err := tx.ExecContext(ctx, "DELETE FROM browsers WHERE name = ?", name)
+				if err != nil {
+					return err
+				}
+				rows, err := result.RowsAffected()
+				if err != nil {
+					return err
+				}
+				if rows == 0 {
+					return fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+				}
+				// ON DELETE CASCADE leaves gaps where the rules of the browser were.
+				return compactRules(ctx, tx)
+			})
+		})
+	})
+}
+
+func (r *Repository) LsBrowsers(ctx context.Context) ([]bookmark.Browser, error) {
+	return read(ctx, func() ([]bookmark.Browser, error) { return lsBrowsers(ctx, r.db) })
+}
+
+func lsBrowsers(ctx context.Context, q queryer) ([]bookmark.Browser, error) {
+	rows, err := q.QueryContext(ctx, "SELECT "+browserColumns+" FROM browsers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var browsers []bookmark.Browser
+	for rows.Next() {
+		b, err := scanBrowser(rows)
+		if err != nil {
+			return nil, err
+		}
+		browsers = append(browsers, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return browsers, nil
+}
+
+func (r *Repository) GetBrowser(ctx context.Context, name string) (bookmark.Browser, error) {
+	b, err := read(ctx, func() (bookmark.Browser, error) { return getBrowser(ctx, r.db, name) })
+	if errors.Is(err, sql.ErrNoRows) {
+		return bookmark.Browser{}, fmt.Errorf("%w: %q", bookmark.ErrBrowserNotFound, name)
+	}
+	return b, err
+}
+
+// getBrowser loads a browser profile. It returns sql.ErrNoRows if there is none.
+func getBrowser(ctx context.Context, q queryRower, name string) (bookmark.Browser, error) {
+	return scanBrowser(q.QueryRowContext(ctx, "SELECT "+browserColumns+" FROM browsers WHERE name = ?", name))
+}
+
+// browserColumns are the columns scanBrowser reads.
+const browserColumns = "name, path, args, env, dir, is_default"
+
+// scanBrowser reads a browser profile selected with browserColumns.
+func scanBrowser(row interface{ Scan(dest ...any) error }) (bookmark.Browser, error) {
+	var b bookmark.Browser
+	var argsJSON, envJSON string
+	var isDefault int
+	if err := row.Scan(&b.Name, &b.Path, &argsJSON, &envJSON, &b.Dir, &isDefault); err != nil {
+		return bookmark.Browser{}, err
+	}
+	if err := json.Unmarshal([]byte(argsJSON), &b.Args); err != nil {
+		return bookmark.Browser{}, fmt.Errorf("decoding args for %q: %w", b.Name, err)
+	}
+	if err := json.Unmarshal([]byte(envJSON), &b.Env); err != nil {
+		return bookmark.Browser{}, fmt.Errorf("decoding env for %q: %w", b.Name, err)
+	}
+	b.Default = isDefault != 0
+	return b, nil
+}
+
+// encodeBrowserLists encodes the args and env of b as stored in the
+// browsers table.
+func encodeBrowserLists(b bookmark.Browser) (args, env string, err error) {
+	argsJSON, err := json.Marshal(b.Args)
+	if err != nil {
+		return "", "", fmt.Errorf("encoding args: %w", err)
+	}
+	envJSON, err := json.Marshal(b.Env)
+	if err != nil {
+		return "", "", fmt.Errorf("encoding env: %w", err)
+	}
+	return string(argsJSON), string(envJSON), nil
+}
+
+// SetTagBrowser makes a browser profile the default for bookmarks carrying a
+// tag or one of its descendants. An empty browser name clears the default.
+func (r *Repository) SetTagBrowser(ctx context.Context, tag, browser string) error {
+	tag = bookmark.NormalizeTag(tag)
+	if tag == "" {
+		return fmt.Errorf("tag must not be empty")
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		// The tag default is recorded with the browser profiles it moves
+		// between.
+		names, err := queryNames(ctx, tx, "SELECT browser FROM tag_browsers WHERE tag = ?", tag)
+		if err != nil {
+			return err
+		}
+		op := "unset-tag-browser"
+		if browser != "" {
+			op = "set-tag-browser"
+			names = mergeNames(names, []string{browser})
+		}
+		changes, err := r.newChangeLog(ctx, tx, op)
+		if err != nil {
+			return err
+		}
+		return changes.browsers(names, func() error {
+			if browser == "" {
+				result, err := tx.ExecContext(ctx, "DELETE FROM tag_browsers WHERE tag = ?", tag)
+				if err != nil {
+					return err
+				}
+				rows, err := result.RowsAffected()
+				if err != nil {
+					return err
+				}
+				if rows == 0 {
+					return fmt.Errorf("tag %q has no default browser profile", tag)
+				}
+				return nil
+			}
+
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO tag_browsers (tag, browser) VALUES (?, ?) ON CONFLICT(tag) DO UPDATE SET browser = excluded.browser",
+				tag, browser,
+			)
+			if err != nil && isForeignKeyViolation(err) {
+				return fmt.Errorf("tag %q: %w: %q", tag, bookmark.ErrUnknownBrowser, browser)
+			}
+			return err
+		})
+	})
+}
+
+// LsTagBrowsers returns the default browser profile of every tag that has one.
+func (r *Repository) LsTagBrowsers(ctx context.Context) (map[string]string, error) {
+	return read(ctx, func() (map[string]string, error) { return lsTagBrowsers(ctx, r.db) })
+}
+
+func lsTagBrowsers(ctx context.Context, q queryer) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT tag, browser FROM tag_browsers")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	tagBrowsers := map[string]string{}
+	for rows.Next() {
+		var tag, browser string
+		if err := rows.Scan(&tag, &browser); err != nil {
+			return nil, err
+		}
+		tagBrowsers[tag] = browser
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tagBrowsers, nil
+}
+
+func (r *Repository) AddCollection(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, "add-collection")
+		if err != nil {
+			return err
+		}
+		return changes.collections([]string{name}, func() error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO collections (name) VALUES (?)", name)
+			if err != nil && isUniqueViolation(err) {
+				return bookmark.ErrDuplicateCollection
+			}
+			return err
+		})
+	})
+}
+
+func (r *Repository) DelCollection(ctx context.Context, name string) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, "del-collection")
+		if err != nil {
+			return err
+		}
+		return changes.collections([]string{name}, func() error {
+			result, err := tx.ExecContext(ctx, "DELETE FROM collections WHERE name = ?", name)
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows == 0 {
+				return fmt.Errorf("collection %w: %q", bookmark.ErrNotFound, name)
+			}
+			return nil
+		})
+	})
+}
+
+func (r *Repository) LsCollections(ctx context.Context) ([]bookmark.Collection, error) {
+	return read(ctx, func() ([]bookmark.Collection, error) { return lsCollections(ctx, r.db) })
+}
+
+func lsCollections(ctx context.Context, q queryer) ([]bookmark.Collection, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT c.name, i.bookmark
+		FROM collections c
+		LEFT JOIN collection_items i ON c.name = i.collection
+		ORDER BY c.name, i.position`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var collections []bookmark.Collection
+	for rows.Next() {
+		var name string
+		var member sql.NullString
+		if err := rows.Scan(&name, &member); err != nil {
+			return nil, err
+		}
+		if len(collections) == 0 || collections[len(collections)-1].Name != name {
+			collections = append(collections, bookmark.Collection{Name: name})
+		}
+		if member.Valid {
+			c := &collections[len(collections)-1]
+			c.Bookmarks = append(c.Bookmarks, member.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func (r *Repository) GetCollection(ctx context.Context, name string) (bookmark.Collection, error) {
+	members, err := read(ctx, func() ([]string, error) { return collectionMembers(ctx, r.db, name) })
+	if err != nil {
+		return bookmark.Collection{}, err
+	}
+	return bookmark.Collection{Name: name, Bookmarks: members}, nil
+}
+
+// AddToCollection inserts a bookmark at the given 1-based position of a
+// collection. Position 0 or a position past the end appends it.
+func (r *Repository) AddToCollection(ctx context.Context, collection, member string, position int) error {
+	return r.editCollection(ctx, "add-to-collection", collection, func(c *bookmark.Collection) error { return c.Insert(member, position) })
+}
+
+func (r *Repository) RemoveFromCollection(ctx context.Context, collection, member string) error {
+	return r.editCollection(ctx, "remove-from-collection", collection, func(c *bookmark.Collection) error { return c.Remove(member) })
+}
+
+// MoveInCollection moves a member of a collection to the given 1-based
+// position. Position 0 or a position past the end moves it to the end.
+func (r *Repository) MoveInCollection(ctx context.Context, collection, member string, position int) error {
+	return r.editCollection(ctx, "move-in-collection", collection, func(c *bookmark.Collection) error { return c.Move(member, position) })
+}
+
+// editCollection rewrites the ordered membership of a collection in a single
+// transaction and records it as op. Positions are renumbered from 1 so they
+// stay contiguous.
+func (r *Repository) editCollection(ctx context.Context, op, collection string, edit func(*bookmark.Collection) error) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		changes, err := r.newChangeLog(ctx, tx, op)
+		if err != nil {
+			return err
+		}
+		return changes.collections([]string{collection}, func() error {
+			members, err := collectionMembers(ctx, tx, collection)
+			if err != nil {
+				return err
+			}
+			c := bookmark.Collection{Name: collection, Bookmarks: members}
+			if err := edit(&c); err != nil {
+				return err
+			}
+			return writeCollection(ctx, tx, c)
+		})
+	})
+}
+
+// writeCollection replaces the members of a collection.
+func writeCollection(ctx context.Context, tx *sql.Tx, c bookmark.Collection) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM collection_items WHERE collection = ?", c.Name); err != nil {
+		return err
+	}
+	for i, member := range c.Bookmarks {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO collection_items (collection, bookmark, position)
+			SELECT ?, name, ? FROM bookmarks WHERE name = ? AND deleted_at IS NULL`,
+			c.Name, i+1, member,
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fmt.Errorf("%w: %q", bookmark.ErrBookmarkNotFound, member)
+		}
+	}
+	return nil
+}
+
+// collectionMembers returns the members of a collection in order. A single
+// statement checks that the collection exists and lists its members, so it
+// needs no transaction to be consistent.
+func collectionMembers(ctx context.Context, q queryer, collection string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT c.name, i.bookmark
+		FROM collections c
+		LEFT JOIN collection_items i ON c.name = i.collection
+		WHERE c.name = ?
+		ORDER BY i.position`, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	found := false
+	var members []string
+	for rows.Next() {
+		var name string
+		var member sql.NullString
+		if err := rows.Scan(&name, &member); err != nil {
+			return nil, err
+		}
+		found = true
+		if member.Valid {
+			members = append(members, member.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("collection %w: %q", bookmark.ErrNotFound, collection)
+	}
+	return members, nil
+}
+
+// AddRule inserts a routing rule at the given 1-based position. Position 0 or
+// a position past the end appends it. It returns the ID of the new rule.
+func (r *Repository) AddRule(ctx context.Context, rule bookmark.Rule, position int) (int64, error) {
+	rule.Tag = bookmark.NormalizeTag(rule.Tag)
+	if err := rule.Validate(); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		// Rules are recorded with the browser profile they route to.
+		changes, err := r.newChangeLog(ctx, tx, "add-rule")
+		if err != nil {
+			return err
+		}
+		return changes.browsers([]string{rule.BrowserName}, func() error {
+			var last int
+			if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position), 0) FROM browser_rules").Scan(&last); err != nil {
+				return err
+			}
+			pos := position
+			if pos <= 0 || pos > last {
+				pos = last + 1
+			} else if _, err := tx.ExecContext(ctx, "UPDATE browser_rules SET position = position + 1 WHERE position >= ?", pos); err != nil {
+				return err
+			}
+
+			regex := 0
+			if rule.Regex {
+				regex = 1
+			}
+			result, err := tx.ExecContext(ctx,
+				"INSERT INTO browser_rules (position, host, regex, tag, browser) VALUES (?, ?, ?, ?, ?)",
+				pos, rule.Host, regex, rule.Tag, rule.BrowserName,
+			)
+			if err != nil {
+				if isForeignKeyViolation(err) {
+					return fmt.Errorf("rule %s: %w: %q", rule, bookmark.ErrUnknownBrowser, rule.BrowserName)
+				}
+				return err
+			}
+			id, err = result.LastInsertId()
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *Repository) DelRule(ctx context.Context, id int64) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		var position int
+		var browser string
+		err := tx.QueryRowContext(ctx, "SELECT position, browser FROM browser_rules WHERE id = ?", id).Scan(&position, &browser)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("rule %w: %d", bookmark.ErrNotFound, id)
+		}
+		if err != nil {
+			return err
+		}
+		changes, err := r.newChangeLog(ctx, tx, "del-rule")
+		if err != nil {
+			return err
+		}
+		return changes.browsers([]string{browser}, func() error {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM browser_rules WHERE id = ?", id); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE browser_rules SET position = position - 1 WHERE position > ?", position)
+			return err
+		})
+	})
+}
+
+// compactRules renumbers the routing rules 1, 2, ... in their current order,
+// so that positions passed to AddRule count rules.
+func compactRules(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM browser_rules ORDER BY position, id")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, "UPDATE browser_rules SET position = ? WHERE id = ?", i+1, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LsRules lists the routing rules in the order they are evaluated.
+func (r *Repository) LsRules(ctx context.Context) ([]bookmark.Rule, error) {
+	return read(ctx, func() ([]bookmark.Rule, error) { return lsRules(ctx, r.db) })
+}
+
+func lsRules(ctx context.Context, q queryer) ([]bookmark.Rule, error) {
+	rows, err := q.QueryContext(ctx, "SELECT id, host, regex, tag, browser FROM browser_rules ORDER BY position")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v", err)
+		}
+	}()
+
+	var rules []bookmark.Rule
+	for rows.Next() {
+		var rule bookmark.Rule
+		var regex int
+		if err := rows.Scan(&rule.ID, &rule.Host, &regex, &rule.Tag, &rule.BrowserName); err != nil {
+			return nil, err
+		}
+		rule.Regex = regex != 0
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
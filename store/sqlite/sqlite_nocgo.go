@@ -0,0 +1,28 @@
+//go:build !cgo
+
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Without cgo the SQLite driver is a stub that fails to open any database,
+// so these are never reached; they only keep the build working.
+
+func isBusy(error) bool {
+	return false
+}
+
+func isUniqueViolation(error) bool {
+	return false
+}
+
+func isForeignKeyViolation(error) bool {
+	return false
+}
+
+func copyDatabase(dest, src *sqlite3.SQLiteConn) error {
+	return errors.New("restoring needs a build with cgo")
+}
@@ -0,0 +1,856 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+	"github.com/allaman/bm/bookmark/bookmarktest"
+)
+
+func setupTestDB(t *testing.T) *Repository {
+	repo, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	return repo
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRepository(t *testing.T) {
+	bookmarktest.Run(t, bookmarktest.Backend{
+		Open: func(t *testing.T) bookmark.Repository { return setupTestDB(t) },
+		BackdateTrash: func(t *testing.T, repo bookmark.Repository, name string, d time.Duration) {
+			_, err := repo.(*Repository).db.Exec("UPDATE bookmarks SET deleted_at = deleted_at - ? WHERE name = ?", int64(d.Seconds()), name)
+			if err != nil {
+				t.Fatalf("failed to backdate deletion: %v", err)
+			}
+		},
+	})
+}
+
+func TestChangeLog(t *testing.T) {
+	repo := setupTestDB(t)
+	ctx := context.Background()
+
+	if err := repo.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Wiki", URL: "https://wiki.com", Tags: []string{"docs"}, BrowserName: "work"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := repo.Update(ctx, "Wiki", bookmark.BookmarkPatch{URL: ptr("https://wiki.org")}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	t.Run("mutations are recorded", func(t *testing.T) {
+		changes, err := repo.Changes(ctx, "", 0)
+		if err != nil {
+			t.Fatalf("Changes() error = %v", err)
+		}
+		var ops []string
+		for _, c := range changes {
+			ops = append(ops, c.Op)
+		}
+		if want := []string{"update", "add", "add-browser"}; !slices.Equal(ops, want) {
+			t.Fatalf("got ops %v, want %v", ops, want)
+		}
+		if changes[1].Before != nil || changes[1].After == nil {
+			t.Errorf("add: got before %s, after %s", changes[1].Before, changes[1].After)
+		}
+		if changes[0].Host == "" || changes[0].User == "" || changes[0].At.IsZero() {
+			t.Errorf("missing metadata in %+v", changes[0])
+		}
+	})
+
+	t.Run("filter by name", func(t *testing.T) {
+		changes, err := repo.Changes(ctx, "work", 0)
+		if err != nil {
+			t.Fatalf("Changes() error = %v", err)
+		}
+		if len(changes) != 1 || changes[0].Entity != bookmark.EntityBrowser {
+			t.Errorf("got %+v, want the browser change only", changes)
+		}
+	})
+
+	t.Run("undo update", func(t *testing.T) {
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.URL != "https://wiki.com" {
+			t.Errorf("got URL %q, want the original URL", got.URL)
+		}
+	})
+
+	t.Run("undo delete browser restores associations", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "work"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.BrowserName != "work" {
+			t.Errorf("got BrowserName %q, want work", got.BrowserName)
+		}
+	})
+
+	t.Run("undo delete", func(t *testing.T) {
+		if err := repo.Del(ctx, "Wiki"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		got, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !slices.Equal(got.Tags, []string{"docs"}) {
+			t.Errorf("got tags %v, want [docs]", got.Tags)
+		}
+	})
+
+	t.Run("refuse conflicting undo", func(t *testing.T) {
+		if err := repo.Update(ctx, "Wiki", bookmark.BookmarkPatch{URL: ptr("https://wiki.net")}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		// Simulate a change that bypassed the change log.
+		if _, err := repo.db.Exec("UPDATE bookmarks SET url = 'https://elsewhere.com' WHERE name = 'Wiki'"); err != nil {
+			t.Fatalf("failed to update bookmark: %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); !errors.Is(err, bookmark.ErrUndoConflict) {
+			t.Errorf("Undo() error = %v, want ErrUndoConflict", err)
+		}
+		got, err := repo.Get(ctx, "Wiki")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.URL != "https://elsewhere.com" {
+			t.Errorf("got URL %q, refused undo must not change anything", got.URL)
+		}
+	})
+
+	t.Run("undo several steps in one go", func(t *testing.T) {
+		if _, err := repo.db.Exec("UPDATE bookmarks SET url = 'https://wiki.net' WHERE name = 'Wiki'"); err != nil {
+			t.Fatalf("failed to update bookmark: %v", err)
+		}
+		changes, err := repo.Undo(ctx, 2)
+		if err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if len(changes) != 2 || changes[0].Op != "update" || changes[1].Op != "add" {
+			t.Errorf("got %+v, want the update and the add", changes)
+		}
+		if _, err := repo.Get(ctx, "Wiki"); err == nil {
+			t.Error("expected bookmark to be removed by undoing its creation")
+		}
+	})
+
+	t.Run("undo rule del", func(t *testing.T) {
+		for _, host := range []string{"a.corp.com", "b.corp.com"} {
+			if _, err := repo.AddRule(ctx, bookmark.Rule{Host: host, BrowserName: "work"}, 0); err != nil {
+				t.Fatalf("AddRule() error = %v", err)
+			}
+		}
+		want, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		if err := repo.DelRule(ctx, want[0].ID); err != nil {
+			t.Fatalf("DelRule() error = %v", err)
+		}
+		changes, err := repo.Undo(ctx, 1)
+		if err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if len(changes) != 1 || changes[0].Op != "del-rule" || changes[0].Name != "work" {
+			t.Errorf("got %+v, want the rule deletion recorded with browser work", changes)
+		}
+		got, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got rules %v, want %v", got, want)
+		}
+		if _, err := repo.Undo(ctx, 2); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got, _ := repo.LsRules(ctx); len(got) != 0 {
+			t.Errorf("got rules %v, want none after undoing their creation", got)
+		}
+	})
+
+	t.Run("undo tag default", func(t *testing.T) {
+		if err := repo.SetTagBrowser(ctx, "docs", "work"); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+		if err := repo.SetTagBrowser(ctx, "docs", ""); err != nil {
+			t.Fatalf("SetTagBrowser() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got, _ := repo.LsTagBrowsers(ctx); got["docs"] != "work" {
+			t.Errorf("got tag defaults %v, want docs on work", got)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got, _ := repo.LsTagBrowsers(ctx); len(got) != 0 {
+			t.Errorf("got tag defaults %v, want none", got)
+		}
+	})
+
+	t.Run("undo collection del", func(t *testing.T) {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: "Mail", URL: "https://mail.com"}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if err := repo.AddCollection(ctx, "reading"); err != nil {
+			t.Fatalf("AddCollection() error = %v", err)
+		}
+		if err := repo.AddToCollection(ctx, "reading", "Mail", 0); err != nil {
+			t.Fatalf("AddToCollection() error = %v", err)
+		}
+		if err := repo.DelCollection(ctx, "reading"); err != nil {
+			t.Fatalf("DelCollection() error = %v", err)
+		}
+		logged, err := repo.Changes(ctx, "reading", 0)
+		if err != nil {
+			t.Fatalf("Changes() error = %v", err)
+		}
+		if len(logged) != 3 || logged[0].Entity != bookmark.EntityCollection {
+			t.Errorf("got %+v, want three collection changes", logged)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		got, err := repo.GetCollection(ctx, "reading")
+		if err != nil {
+			t.Fatalf("GetCollection() error = %v", err)
+		}
+		if !slices.Equal(got.Bookmarks, []string{"Mail"}) {
+			t.Errorf("got members %v, want [Mail]", got.Bookmarks)
+		}
+		if _, err := repo.Undo(ctx, 3); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if _, err := repo.GetCollection(ctx, "reading"); !errors.Is(err, bookmark.ErrNotFound) {
+			t.Errorf("GetCollection() error = %v, want ErrNotFound after undoing its creation", err)
+		}
+	})
+
+	t.Run("refuse removing a browser in use", func(t *testing.T) {
+		// Simulate a change that bypassed the change log.
+		if _, err := repo.db.Exec("INSERT INTO browser_rules (position, host, browser) VALUES (1, '*.corp.com', 'work')"); err != nil {
+			t.Fatalf("failed to add rule: %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); !errors.Is(err, bookmark.ErrUndoConflict) {
+			t.Errorf("Undo() error = %v, want ErrUndoConflict", err)
+		}
+		if _, err := repo.db.Exec("DELETE FROM browser_rules"); err != nil {
+			t.Fatalf("failed to delete rule: %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if _, err := repo.GetBrowser(ctx, "work"); err == nil {
+			t.Error("expected browser to be removed by undoing its creation")
+		}
+		if _, err := repo.Undo(ctx, 1); err == nil {
+			t.Error("expected error when there is nothing left to undo")
+		}
+	})
+}
+
+func TestUndoDependents(t *testing.T) {
+	repo := setupTestDB(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"work", "home"} {
+		if err := repo.AddBrowser(ctx, bookmark.Browser{Name: name, Path: "/usr/bin/firefox"}); err != nil {
+			t.Fatalf("AddBrowser() error = %v", err)
+		}
+	}
+	for _, name := range []string{"Mail", "Wiki", "Jira"} {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: name, URL: "https://" + strings.ToLower(name) + ".com"}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := repo.AddCollection(ctx, "onboarding"); err != nil {
+		t.Fatalf("AddCollection() error = %v", err)
+	}
+	for _, name := range []string{"Mail", "Wiki", "Jira"} {
+		if err := repo.AddToCollection(ctx, "onboarding", name, 0); err != nil {
+			t.Fatalf("AddToCollection() error = %v", err)
+		}
+	}
+	for _, rule := range []bookmark.Rule{
+		{Host: "a.com", BrowserName: "home"},
+		{Tag: "work", BrowserName: "work"},
+		{Host: "b.com", BrowserName: "home"},
+	} {
+		if _, err := repo.AddRule(ctx, rule, 0); err != nil {
+			t.Fatalf("AddRule() error = %v", err)
+		}
+	}
+	if err := repo.SetTagBrowser(ctx, "work/infra", "work"); err != nil {
+		t.Fatalf("SetTagBrowser() error = %v", err)
+	}
+
+	rules := func(t *testing.T) []string {
+		t.Helper()
+		rules, err := repo.LsRules(ctx)
+		if err != nil {
+			t.Fatalf("LsRules() error = %v", err)
+		}
+		var result []string
+		for _, rule := range rules {
+			result = append(result, rule.String())
+		}
+		return result
+	}
+	wantRules := rules(t)
+	tagDefaults := func(t *testing.T) map[string]string {
+		t.Helper()
+		got, err := repo.LsTagBrowsers(ctx)
+		if err != nil {
+			t.Fatalf("LsTagBrowsers() error = %v", err)
+		}
+		return got
+	}
+	members := func(t *testing.T) []string {
+		t.Helper()
+		collections, err := repo.LsCollections(ctx)
+		if err != nil {
+			t.Fatalf("LsCollections() error = %v", err)
+		}
+		if len(collections) != 1 {
+			t.Fatalf("got %d collections, want 1", len(collections))
+		}
+		return collections[0].Bookmarks
+	}
+
+	t.Run("undo delete browser restores rules and tag defaults", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "work"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got := rules(t); !slices.Equal(got, wantRules) {
+			t.Errorf("got rules %q, want %q", got, wantRules)
+		}
+		if got, want := tagDefaults(t), map[string]string{"work/infra": "work"}; !maps.Equal(got, want) {
+			t.Errorf("got tag defaults %v, want %v", got, want)
+		}
+	})
+
+	t.Run("undo delete restores collection membership", func(t *testing.T) {
+		if err := repo.Del(ctx, "Wiki"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got, want := members(t), []string{"Mail", "Wiki", "Jira"}; !slices.Equal(got, want) {
+			t.Errorf("got members %v, want %v", got, want)
+		}
+	})
+
+	t.Run("undo rename tag restores tag defaults and rules", func(t *testing.T) {
+		if err := repo.RenameTag(ctx, "work", "job"); err != nil {
+			t.Fatalf("RenameTag() error = %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got := rules(t); !slices.Equal(got, wantRules) {
+			t.Errorf("got rules %q, want %q", got, wantRules)
+		}
+		if got, want := tagDefaults(t), map[string]string{"work/infra": "work"}; !maps.Equal(got, want) {
+			t.Errorf("got tag defaults %v, want %v", got, want)
+		}
+	})
+
+	t.Run("refuse when the tag got another default", func(t *testing.T) {
+		if err := repo.DelBrowser(ctx, "work"); err != nil {
+			t.Fatalf("DelBrowser() error = %v", err)
+		}
+		// Simulate a change that bypassed the change log.
+		if _, err := repo.db.Exec("INSERT INTO tag_browsers (tag, browser) VALUES ('work/infra', 'home')"); err != nil {
+			t.Fatalf("failed to set tag default: %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); !errors.Is(err, bookmark.ErrUndoConflict) {
+			t.Errorf("Undo() error = %v, want ErrUndoConflict", err)
+		}
+		if _, err := repo.GetBrowser(ctx, "work"); err == nil {
+			t.Error("refused undo must not restore the browser profile")
+		}
+	})
+
+	t.Run("refuse when the collection is gone", func(t *testing.T) {
+		if err := repo.Del(ctx, "Wiki"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		if _, err := repo.db.Exec("DELETE FROM collections WHERE name = 'onboarding'"); err != nil {
+			t.Fatalf("failed to delete collection: %v", err)
+		}
+		if _, err := repo.Undo(ctx, 1); !errors.Is(err, bookmark.ErrUndoConflict) {
+			t.Errorf("Undo() error = %v, want ErrUndoConflict", err)
+		}
+		if _, err := repo.Get(ctx, "Wiki"); err == nil {
+			t.Error("refused undo must not restore the bookmark")
+		}
+	})
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	path := filepath.Join(t.TempDir(), "bm.sqlite")
+	ctx := context.Background()
+
+	// Every repository has its own connection, like separate bm processes.
+	repos := make([]*Repository, 4)
+	for i := range repos {
+		repo, err := New(path)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = repo.db.Close() })
+		repos[i] = repo
+	}
+
+	const workers, iterations = 16, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations)
+	for w := range workers {
+		repo := repos[w%len(repos)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				name := fmt.Sprintf("bm-%d-%d", w, i)
+				if err := repo.Add(ctx, bookmark.Bookmark{Name: name, URL: "https://example.com", Tags: []string{"stress"}}); err != nil {
+					errs <- fmt.Errorf("Add(%s): %w", name, err)
+					continue
+				}
+				if err := repo.Update(ctx, name, bookmark.BookmarkPatch{AddTags: []string{"updated"}}); err != nil {
+					errs <- fmt.Errorf("Update(%s): %w", name, err)
+					continue
+				}
+				if i%2 == 0 {
+					if err := repo.Del(ctx, name); err != nil {
+						errs <- fmt.Errorf("Del(%s): %w", name, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	live, err := repos[0].LsByTag(ctx, "updated", true)
+	if err != nil {
+		t.Fatalf("LsByTag() error = %v", err)
+	}
+	if want := workers * iterations / 2; len(live) != want {
+		t.Errorf("got %d live bookmarks, want %d", len(live), want)
+	}
+	changes, err := repos[0].Changes(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("Changes() error = %v", err)
+	}
+	if want := workers * iterations * 5 / 2; len(changes) != want {
+		t.Errorf("got %d changes, want %d", len(changes), want)
+	}
+}
+
+func TestWritersReportBusy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for all retries")
+	}
+	path := filepath.Join(t.TempDir(), "bm.sqlite")
+	ctx := context.Background()
+
+	holder, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = holder.db.Close() })
+	if err := holder.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	if err := holder.AddCollection(ctx, "onboarding"); err != nil {
+		t.Fatalf("AddCollection() error = %v", err)
+	}
+	repo, err := New(path, WithBusyTimeout(time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = repo.db.Close() })
+
+	// Hold the write lock like another bm process in the middle of a write.
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+
+	writes := map[string]func() error{
+		"SetTagBrowser": func() error { return repo.SetTagBrowser(ctx, "work", "work") },
+		"AddCollection": func() error { return repo.AddCollection(ctx, "reading") },
+		"DelCollection": func() error { return repo.DelCollection(ctx, "onboarding") },
+	}
+	t.Run("writes", func(t *testing.T) {
+		for name, write := range writes {
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				if err := write(); !errors.Is(err, ErrBusy) {
+					t.Errorf("%s() error = %v, want ErrBusy", name, err)
+				}
+			})
+		}
+	})
+	if _, err := repo.LsCollections(ctx); err != nil {
+		t.Errorf("LsCollections() error = %v, reads must not wait for writers", err)
+	}
+	if _, err := repo.GetCollection(ctx, "onboarding"); err != nil {
+		t.Errorf("GetCollection() error = %v, reads must not wait for writers", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := New(filepath.Join(dir, "bm.sqlite"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = repo.db.Close() })
+	ctx := context.Background()
+
+	if err := repo.Add(ctx, bookmark.Bookmark{Name: "Google", URL: "https://google.com", Tags: []string{"search"}}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	backup := filepath.Join(dir, "backup.sqlite")
+
+	t.Run("backup rotates", func(t *testing.T) {
+		for range 4 {
+			if err := repo.Backup(ctx, backup, 3); err != nil {
+				t.Fatalf("Backup() error = %v", err)
+			}
+		}
+		for _, name := range []string{backup, backup + ".1", backup + ".2"} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("expected %s to exist: %v", name, err)
+			}
+		}
+		if _, err := os.Stat(backup + ".3"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s.3 to be rotated away, got %v", backup, err)
+		}
+	})
+
+	t.Run("restore replaces all data", func(t *testing.T) {
+		if err := repo.Add(ctx, bookmark.Bookmark{Name: "Later", URL: "https://later.com"}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if err := repo.RestoreFrom(ctx, backup); err != nil {
+			t.Fatalf("RestoreFrom() error = %v", err)
+		}
+		got, err := repo.Ls(ctx, true)
+		if err != nil {
+			t.Fatalf("Ls() error = %v", err)
+		}
+		if len(got) != 1 || got[0].Name != "Google" || !slices.Equal(got[0].Tags, []string{"search"}) {
+			t.Errorf("got %+v, want only Google", got)
+		}
+		changes, err := repo.Changes(ctx, "Later", 0)
+		if err != nil {
+			t.Fatalf("Changes() error = %v", err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("got %d changes of Later, want the change log of the backup", len(changes))
+		}
+	})
+
+	t.Run("restore from a path that needs escaping", func(t *testing.T) {
+		odd := filepath.Join(dir, "bk#1?.sqlite")
+		if err := repo.Backup(ctx, odd, 1); err != nil {
+			t.Fatalf("Backup() error = %v", err)
+		}
+		if err := repo.RestoreFrom(ctx, odd); err != nil {
+			t.Fatalf("RestoreFrom() error = %v", err)
+		}
+		if _, err := repo.Get(ctx, "Google"); err != nil {
+			t.Errorf("Get() error = %v after restore", err)
+		}
+	})
+
+	t.Run("restore rejects invalid backups", func(t *testing.T) {
+		junk := filepath.Join(dir, "junk")
+		if err := os.WriteFile(junk, []byte("not a database"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		other, err := New(filepath.Join(dir, "other.sqlite"))
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if _, err := other.db.Exec("DROP TABLE bookmarks"); err != nil {
+			t.Fatal(err)
+		}
+		_ = other.db.Close()
+
+		for _, src := range []string{junk, filepath.Join(dir, "other.sqlite"), filepath.Join(dir, "missing")} {
+			if err := repo.RestoreFrom(ctx, src); err == nil {
+				t.Errorf("expected error restoring %s", src)
+			}
+		}
+		if _, err := repo.Get(ctx, "Google"); err != nil {
+			t.Errorf("Get() error = %v after failed restores", err)
+		}
+	})
+
+	t.Run("check", func(t *testing.T) {
+		problems, err := repo.Check(ctx)
+		if err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if len(problems) != 0 {
+			t.Errorf("got problems %v on a healthy database", problems)
+		}
+
+		if _, err := repo.db.Exec("PRAGMA foreign_keys = off"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.db.Exec("INSERT INTO tags (name, tag) VALUES ('Ghost', 'x')"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.db.Exec("PRAGMA foreign_keys = on"); err != nil {
+			t.Fatal(err)
+		}
+		problems, err = repo.Check(ctx)
+		if err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if want := []string{`tag "x" belongs to missing bookmark "Ghost"`}; !slices.Equal(problems, want) {
+			t.Errorf("got problems %v, want %v", problems, want)
+		}
+	})
+
+	t.Run("vacuum", func(t *testing.T) {
+		if err := repo.Vacuum(ctx); err != nil {
+			t.Fatalf("Vacuum() error = %v", err)
+		}
+	})
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func(name string) *Repository {
+		repo, err := New(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = repo.db.Close() })
+		return repo
+	}
+	local, remote := open("local.sqlite"), open("remote.sqlite")
+	remotePath := filepath.Join(dir, "remote.sqlite")
+
+	doSync := func(strategy bookmark.SyncStrategy, resolve bookmark.SyncResolver) bookmark.SyncResult {
+		t.Helper()
+		res, err := local.Sync(ctx, remotePath, strategy, resolve)
+		if err != nil {
+			t.Fatalf("Sync() error = %v", err)
+		}
+		return res
+	}
+	url := func(repo *Repository, name string) string {
+		t.Helper()
+		b, err := repo.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get(%q) error = %v", name, err)
+		}
+		return b.URL
+	}
+	// Stamps have millisecond resolution.
+	tick := func() { time.Sleep(2 * time.Millisecond) }
+
+	if err := local.Add(ctx, bookmark.Bookmark{Name: "Local", URL: "https://local.example", Tags: []string{"a"}}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := remote.AddBrowser(ctx, bookmark.Browser{Name: "work", Path: "/usr/bin/firefox"}); err != nil {
+		t.Fatalf("AddBrowser() error = %v", err)
+	}
+	if err := remote.Add(ctx, bookmark.Bookmark{Name: "Remote", URL: "https://remote.example", BrowserName: "work"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	t.Run("merges both ways", func(t *testing.T) {
+		res := doSync(bookmark.SyncNewest, nil)
+		if res.Pulled != 2 || res.Pushed != 1 || len(res.Conflicts) != 0 {
+			t.Errorf("Sync() = %+v, want 2 pulled and 1 pushed", res)
+		}
+		if got := url(remote, "Local"); got != "https://local.example" {
+			t.Errorf("remote Local = %q", got)
+		}
+		if b, _ := local.Get(ctx, "Remote"); b.BrowserName != "work" {
+			t.Errorf("local Remote = %+v, want browser work", b)
+		}
+		if res := doSync(bookmark.SyncNewest, nil); res.Pulled+res.Pushed != 0 {
+			t.Errorf("second Sync() = %+v, want nothing to do", res)
+		}
+	})
+
+	t.Run("one-sided edits win regardless of strategy", func(t *testing.T) {
+		tick()
+		if err := remote.Update(ctx, "Local", bookmark.BookmarkPatch{URL: ptr("https://edited.example")}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		if res := doSync(bookmark.SyncLocal, nil); res.Pulled != 1 || len(res.Conflicts) != 0 {
+			t.Errorf("Sync() = %+v, want 1 pulled", res)
+		}
+		if got := url(local, "Local"); got != "https://edited.example" {
+			t.Errorf("local Local = %q, want the remote edit", got)
+		}
+	})
+
+	t.Run("deletions propagate", func(t *testing.T) {
+		tick()
+		if err := local.Del(ctx, "Local"); err != nil {
+			t.Fatalf("Del() error = %v", err)
+		}
+		doSync(bookmark.SyncNewest, nil)
+		if trash, _ := remote.Trash(ctx); len(trash) != 1 || trash[0].Name != "Local" {
+			t.Errorf("remote trash = %+v, want Local", trash)
+		}
+
+		if _, err := remote.Purge(ctx, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Purge() error = %v", err)
+		}
+		if res := doSync(bookmark.SyncLocal, nil); res.Pulled != 1 {
+			t.Errorf("Sync() = %+v, want the purge pulled", res)
+		}
+		if _, err := local.Get(ctx, "Local"); err == nil {
+			t.Error("purged bookmark still exists locally")
+		}
+	})
+
+	conflict := func(t *testing.T, round int) {
+		t.Helper()
+		tick()
+		if err := local.Update(ctx, "Remote", bookmark.BookmarkPatch{URL: ptr(fmt.Sprintf("https://local-%d.example", round))}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		tick()
+		if err := remote.Update(ctx, "Remote", bookmark.BookmarkPatch{URL: ptr(fmt.Sprintf("https://remote-%d.example", round))}); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+
+	t.Run("conflicts", func(t *testing.T) {
+		conflict(t, 1)
+		res := doSync(bookmark.SyncLocal, nil)
+		if len(res.Conflicts) != 1 || res.Conflicts[0].Name != "Remote" {
+			t.Errorf("Sync() conflicts = %+v, want Remote", res.Conflicts)
+		}
+		if got := url(remote, "Remote"); got != "https://local-1.example" {
+			t.Errorf("local strategy left remote URL %q", got)
+		}
+
+		conflict(t, 2)
+		doSync(bookmark.SyncNewest, nil)
+		if got := url(local, "Remote"); got != "https://remote-2.example" {
+			t.Errorf("newest strategy left local URL %q", got)
+		}
+
+		conflict(t, 3)
+		var asked []bookmark.SyncConflict
+		doSync(bookmark.SyncInteractive, func(c bookmark.SyncConflict) (bool, error) {
+			asked = append(asked, c)
+			return false, nil
+		})
+		if len(asked) != 1 || !strings.Contains(string(asked[0].Remote), "remote-3") {
+			t.Errorf("resolver asked %+v", asked)
+		}
+		if got := url(remote, "Remote"); got != "https://local-3.example" {
+			t.Errorf("interactive choice left remote URL %q", got)
+		}
+	})
+
+	t.Run("undo of a sync propagates", func(t *testing.T) {
+		if _, err := remote.Undo(ctx, 1); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		doSync(bookmark.SyncLocal, nil)
+		if got := url(local, "Remote"); got != "https://remote-3.example" {
+			t.Errorf("local URL after undo on remote = %q", got)
+		}
+	})
+
+	t.Run("copied database", func(t *testing.T) {
+		copied := filepath.Join(dir, "copy.sqlite")
+		if err := local.Backup(ctx, copied, 1); err != nil {
+			t.Fatalf("Backup() error = %v", err)
+		}
+		if _, err := local.Sync(ctx, copied, bookmark.SyncNewest, nil); err != nil {
+			t.Fatalf("Sync() with a copy error = %v", err)
+		}
+		if _, err := local.Sync(ctx, filepath.Join(dir, "local.sqlite"), bookmark.SyncNewest, nil); err == nil {
+			t.Error("Sync() with itself succeeded")
+		}
+	})
+
+	t.Run("refuse a foreign database", func(t *testing.T) {
+		foreign := filepath.Join(dir, "foreign.sqlite")
+		db, err := sql.Open("sqlite3", foreign)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		if _, err := db.Exec("CREATE TABLE notes (body TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := local.Sync(ctx, foreign, bookmark.SyncNewest, nil); err == nil {
+			t.Error("Sync() with a foreign database succeeded")
+		}
+		var tables int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+			t.Fatal(err)
+		}
+		if tables != 1 {
+			t.Errorf("foreign database has %d tables, want it untouched", tables)
+		}
+	})
+}
@@ -0,0 +1,485 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/allaman/bm/bookmark"
+)
+
+func newReplicaID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// syncState is one side of an entity: a live row, a tombstone, or nothing
+// known at all.
+type syncState struct {
+	known    bool
+	stamp    int64
+	snapshot []byte
+}
+
+func (s syncState) at() time.Time {
+	if s.stamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(s.stamp)
+}
+
+// syncAction copies the winning side of an entity over the losing one.
+type syncAction struct {
+	entity string
+	name   string
+	from   syncState
+	pull   bool
+}
+
+// Sync uses the modification stamps and tombstones kept by the change log.
+// An entity that changed on one side only since the last sync with this
+// peer is copied to the other side; one that changed on both is a conflict
+// resolved by strategy. Both databases are written in their own
+// transaction, the peer first; running sync again after a failure is safe.
+// Sync relies on the clocks of the machines making changes being roughly
+// in agreement.
+func (r *Repository) Sync(ctx context.Context, peerPath string, strategy bookmark.SyncStrategy, resolve bookmark.SyncResolver) (bookmark.SyncResult, error) {
+	switch strategy {
+	case bookmark.SyncNewest, bookmark.SyncLocal, bookmark.SyncRemote:
+	case bookmark.SyncInteractive:
+		if resolve == nil {
+			return bookmark.SyncResult{}, fmt.Errorf("interactive sync needs a resolver")
+		}
+	default:
+		return bookmark.SyncResult{}, fmt.Errorf("unknown sync strategy %q", strategy)
+	}
+	if err := checkDistinctFiles(r.path, peerPath); err != nil {
+		return bookmark.SyncResult{}, err
+	}
+	// Opening the peer migrates it, so make sure it is a bm database first.
+	if err := validateBackup(ctx, peerPath); err != nil {
+		return bookmark.SyncResult{}, err
+	}
+	peer, err := New(peerPath, r.opts...)
+	if err != nil {
+		return bookmark.SyncResult{}, err
+	}
+	defer func() { _ = peer.db.Close() }()
+
+	// Ask about conflicts before taking the write locks, then make sure
+	// nothing changed in between.
+	var decisions map[string]bookmark.SyncConflict
+	var decided map[string]bool
+	if strategy == bookmark.SyncInteractive {
+		conflicts, err := r.syncConflicts(ctx, peer)
+		if err != nil {
+			return bookmark.SyncResult{}, err
+		}
+		decisions = make(map[string]bookmark.SyncConflict, len(conflicts))
+		decided = make(map[string]bool, len(conflicts))
+		for _, c := range conflicts {
+			useRemote, err := resolve(c)
+			if err != nil {
+				return bookmark.SyncResult{}, err
+			}
+			decisions[c.Entity+"/"+c.Name] = c
+			decided[c.Entity+"/"+c.Name] = useRemote
+		}
+	}
+
+	var result bookmark.SyncResult
+	err = peer.withTx(ctx, func(remoteTx *sql.Tx) error {
+		return r.withTx(ctx, func(localTx *sql.Tx) error {
+			result = bookmark.SyncResult{}
+			plan, err := planSync(ctx, localTx, remoteTx)
+			if err != nil {
+				return err
+			}
+
+			actions := make([]syncAction, 0, len(plan.items))
+			for _, item := range plan.items {
+				pull := item.pull
+				if item.conflict != nil {
+					c := *item.conflict
+					key := c.Entity + "/" + c.Name
+					switch strategy {
+					case bookmark.SyncNewest:
+						pull = item.remote.stamp > item.local.stamp
+					case bookmark.SyncLocal:
+						pull = false
+					case bookmark.SyncRemote:
+						pull = true
+					case bookmark.SyncInteractive:
+						asked, ok := decisions[key]
+						if !ok || !bytes.Equal(asked.Local, c.Local) || !bytes.Equal(asked.Remote, c.Remote) {
+							return bookmark.ErrSyncChanged
+						}
+						pull = decided[key]
+					}
+					result.Conflicts = append(result.Conflicts, c)
+				}
+				from := item.local
+				if pull {
+					from = item.remote
+					result.Pulled++
+				} else {
+					result.Pushed++
+				}
+				actions = append(actions, syncAction{entity: item.entity, name: item.name, from: from, pull: pull})
+			}
+
+			if err := r.applySync(ctx, remoteTx, actions, false); err != nil {
+				return fmt.Errorf("writing %s: %w", peerPath, err)
+			}
+			if err := r.applySync(ctx, localTx, actions, true); err != nil {
+				return err
+			}
+			if err := recordSync(ctx, localTx, plan.remoteID, plan.syncedAt); err != nil {
+				return err
+			}
+			return recordSync(ctx, remoteTx, plan.localID, plan.syncedAt)
+		})
+	})
+	if err != nil {
+		return bookmark.SyncResult{}, err
+	}
+	return result, nil
+}
+
+// syncConflicts lists the conflicts a sync with peer would have to resolve.
+func (r *Repository) syncConflicts(ctx context.Context, peer *Repository) ([]bookmark.SyncConflict, error) {
+	var conflicts []bookmark.SyncConflict
+	err := peer.withTx(ctx, func(remoteTx *sql.Tx) error {
+		return r.withTx(ctx, func(localTx *sql.Tx) error {
+			conflicts = nil
+			plan, err := planSync(ctx, localTx, remoteTx)
+			if err != nil {
+				return err
+			}
+			for _, item := range plan.items {
+				if item.conflict != nil {
+					conflicts = append(conflicts, *item.conflict)
+				}
+			}
+			return nil
+		})
+	})
+	return conflicts, err
+}
+
+// syncItem is an entity that differs between both sides.
+type syncItem struct {
+	entity   string
+	name     string
+	local    syncState
+	remote   syncState
+	pull     bool
+	conflict *bookmark.SyncConflict
+}
+
+// syncPlan holds the differences between both sides. syncedAt is the newest
+// stamp seen: anything stamped later was changed after the sync.
+type syncPlan struct {
+	localID  string
+	remoteID string
+	syncedAt int64
+	items    []syncItem
+}
+
+// planSync compares both databases. Browser profiles come before bookmarks
+// so bookmarks can refer to them when the plan is applied.
+func planSync(ctx context.Context, localTx, remoteTx *sql.Tx) (syncPlan, error) {
+	var plan syncPlan
+	var err error
+	plan.localID, plan.remoteID, err = replicaIDs(ctx, localTx, remoteTx)
+	if err != nil {
+		return plan, err
+	}
+	lastSync, err := lastSyncWith(ctx, localTx, plan.remoteID)
+	if err != nil {
+		return plan, err
+	}
+
+	plan.syncedAt = lastSync
+	for _, entity := range []string{bookmark.EntityBrowser, bookmark.EntityBookmark} {
+		local, err := syncStates(ctx, localTx, entity)
+		if err != nil {
+			return plan, err
+		}
+		remote, err := syncStates(ctx, remoteTx, entity)
+		if err != nil {
+			return plan, err
+		}
+		for _, name := range syncNames(local, remote) {
+			l, rem := local[name], remote[name]
+			plan.syncedAt = max(plan.syncedAt, l.stamp, rem.stamp)
+			pull, conflict, ok := reconcileSync(l, rem, lastSync)
+			if !ok {
+				continue
+			}
+			item := syncItem{entity: entity, name: name, local: l, remote: rem, pull: pull}
+			if conflict {
+				item.conflict = &bookmark.SyncConflict{
+					Entity: entity, Name: name,
+					Local: l.snapshot, Remote: rem.snapshot,
+					LocalAt: l.at(), RemoteAt: rem.at(),
+				}
+			}
+			plan.items = append(plan.items, item)
+		}
+	}
+	return plan, nil
+}
+
+// reconcileSync decides what to do with an entity. ok is false when both
+// sides agree. Otherwise pull reports whether the remote side wins, unless
+// conflict is set and the strategy has to decide.
+func reconcileSync(local, remote syncState, lastSync int64) (pull, conflict, ok bool) {
+	if bytes.Equal(local.snapshot, remote.snapshot) {
+		return false, false, false
+	}
+	// Never delete an entity because the other side has not heard of it.
+	if !local.known {
+		return true, false, true
+	}
+	if !remote.known {
+		return false, false, true
+	}
+	localChanged := local.stamp > lastSync
+	remoteChanged := remote.stamp > lastSync
+	if localChanged != remoteChanged {
+		return remoteChanged, false, true
+	}
+	return false, true, true
+}
+
+// checkDistinctFiles refuses to sync a database with itself, which would
+// deadlock on the write lock.
+func checkDistinctFiles(a, b string) error {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return nil
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return nil
+	}
+	if os.SameFile(ai, bi) {
+		return fmt.Errorf("cannot sync %s with itself", a)
+	}
+	return nil
+}
+
+// replicaIDs returns the ids of both databases. A copied database file
+// shares the id of its original, so the peer gets a new one in that case.
+func replicaIDs(ctx context.Context, localTx, remoteTx *sql.Tx) (localID, remoteID string, err error) {
+	if err = localTx.QueryRowContext(ctx, "SELECT id FROM replica").Scan(&localID); err != nil {
+		return "", "", err
+	}
+	if err = remoteTx.QueryRowContext(ctx, "SELECT id FROM replica").Scan(&remoteID); err != nil {
+		return "", "", err
+	}
+	if localID == remoteID {
+		remoteID = newReplicaID()
+		if _, err = remoteTx.ExecContext(ctx, "UPDATE replica SET id = ?", remoteID); err != nil {
+			return "", "", err
+		}
+	}
+	return localID, remoteID, nil
+}
+
+// lastSyncWith returns the stamp of the last sync with peer, or 0.
+func lastSyncWith(ctx context.Context, tx *sql.Tx, peer string) (int64, error) {
+	var at int64
+	err := tx.QueryRowContext(ctx, "SELECT synced_at FROM sync_peers WHERE peer = ?", peer).Scan(&at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return at, err
+}
+
+func recordSync(ctx context.Context, tx *sql.Tx, peer string, at int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO sync_peers (peer, synced_at) VALUES (?, ?)
+		ON CONFLICT(peer) DO UPDATE SET synced_at = excluded.synced_at`,
+		peer, at)
+	return err
+}
+
+// syncStates returns the state of every live or deleted entity.
+func syncStates(ctx context.Context, tx *sql.Tx, entity string) (map[string]syncState, error) {
+	table, err := entityTable(entity)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]syncState)
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{"SELECT name, updated_at FROM " + table, nil},
+		{"SELECT name, deleted_at FROM tombstones WHERE entity = ?", []any{entity}},
+	}
+	for _, q := range queries {
+		rows, err := tx.QueryContext(ctx, q.query, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			var at int64
+			if err := rows.Scan(&name, &at); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			if _, ok := states[name]; !ok {
+				states[name] = syncState{known: true, stamp: at}
+			}
+		}
+		if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+			return nil, err
+		}
+	}
+	for name, s := range states {
+		if s.snapshot, err = entitySnapshot(ctx, tx, entity, name); err != nil {
+			return nil, err
+		}
+		states[name] = s
+	}
+	return states, nil
+}
+
+// syncNames returns the names known to either side in a stable order.
+func syncNames(local, remote map[string]syncState) []string {
+	names := make([]string, 0, len(local)+len(remote))
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// applySync writes the winning versions into one side. Browser profiles
+// come first so bookmarks can refer to them. The change log of that side
+// records the sync as one step, keeping the stamps of the winning side.
+func (r *Repository) applySync(ctx context.Context, tx *sql.Tx, actions []syncAction, local bool) error {
+	var browserNames, bookmarkNames []string
+	var mine []syncAction
+	for _, a := range actions {
+		// Pulled entities are written locally, pushed ones into the peer.
+		if a.pull != local {
+			continue
+		}
+		mine = append(mine, a)
+		if a.entity == bookmark.EntityBookmark {
+			bookmarkNames = append(bookmarkNames, a.name)
+		}
+	}
+	// The default flag may move between any of the profiles.
+	browserNames, err := queryNames(ctx, tx, "SELECT name FROM browsers")
+	if err != nil {
+		return err
+	}
+	for _, a := range mine {
+		if a.entity == bookmark.EntityBrowser && !slices.Contains(browserNames, a.name) {
+			browserNames = append(browserNames, a.name)
+		}
+	}
+	// Removing a profile clears it from the bookmarks using it.
+	for _, a := range mine {
+		if a.entity == bookmark.EntityBrowser && a.from.snapshot == nil {
+			users, err := queryNames(ctx, tx, "SELECT name FROM bookmarks WHERE browser = ?", a.name)
+			if err != nil {
+				return err
+			}
+			for _, u := range users {
+				if !slices.Contains(bookmarkNames, u) {
+					bookmarkNames = append(bookmarkNames, u)
+				}
+			}
+		}
+	}
+
+	changes, err := r.newChangeLog(ctx, tx, "sync")
+	if err != nil {
+		return err
+	}
+	changes.keepStamps = true
+	return changes.bookmarks(bookmarkNames, func() error {
+		return changes.browsers(browserNames, func() error {
+			for _, a := range mine {
+				if err := putSynced(ctx, tx, a); err != nil {
+					return fmt.Errorf("%s %q: %w", a.entity, a.name, err)
+				}
+			}
+			return fixDefaultBrowser(ctx, tx)
+		})
+	})
+}
+
+// putSynced overwrites one entity with the winning version and its stamp.
+func putSynced(ctx context.Context, tx *sql.Tx, a syncAction) error {
+	table, err := entityTable(a.entity)
+	if err != nil {
+		return err
+	}
+	if a.from.snapshot == nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE name = ?", a.name); err != nil {
+			return err
+		}
+		return stamp(ctx, tx, a.entity, a.name, false, a.from.stamp)
+	}
+	switch a.entity {
+	case bookmark.EntityBookmark:
+		var b bookmark.Bookmark
+		if err := json.Unmarshal(a.from.snapshot, &b); err != nil {
+			return err
+		}
+		if b.BrowserName != "" {
+			// The profile may have been removed on this side.
+			if _, err := getBrowser(ctx, tx, b.BrowserName); errors.Is(err, sql.ErrNoRows) {
+				b.BrowserName = ""
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := putBookmark(ctx, tx, b); err != nil {
+			return err
+		}
+	case bookmark.EntityBrowser:
+		var b bookmark.Browser
+		if err := json.Unmarshal(a.from.snapshot, &b); err != nil {
+			return err
+		}
+		if err := putBrowser(ctx, tx, b); err != nil {
+			return err
+		}
+	}
+	return stamp(ctx, tx, a.entity, a.name, true, a.from.stamp)
+}
+
+// fixDefaultBrowser keeps only the most recently changed default profile
+// when both sides had chosen a different one.
+func fixDefaultBrowser(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE browsers SET is_default = 0
+		WHERE is_default = 1 AND name != (
+			SELECT name FROM browsers WHERE is_default = 1
+			ORDER BY updated_at DESC, name LIMIT 1
+		)`)
+	return err
+}